@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// stdioConn returns the connection of inetd mode. inetd and systemd's
+// Accept=yes hand over the accepted socket as stdin and stdout; anything
+// else, such as pipes from socat or a test, is served as a pair of files.
+func stdioConn() (net.Conn, error) {
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		// conn has its own copy of the socket, which only closes once
+		// these are closed too
+		_ = os.Stdin.Close()
+		_ = os.Stdout.Close()
+		return conn, nil
+	}
+	in, err := pollable(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	out, err := pollable(os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	return &fileConn{in: in, out: out}, nil
+}
+
+// pollable reopens f in non-blocking mode, which lets pipes and terminals
+// have read and write deadlines.
+func pollable(f *os.File) (*os.File, error) {
+	fd := int(f.Fd())
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// stderrIsSocket reports whether stderr is the client's socket, as with
+// systemd's default StandardError=inherit, where log lines would end up in
+// the HTTP stream.
+func stderrIsSocket() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeSocket != 0
+}
+
+// fileConn is a net.Conn reading from one file and writing to another.
+type fileConn struct {
+	in, out *os.File
+}
+
+func (c *fileConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *fileConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func (c *fileConn) Close() error {
+	return errors.Join(c.in.Close(), c.out.Close())
+}
+
+func (c *fileConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *fileConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+func (c *fileConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+// SetReadDeadline and SetWriteDeadline do nothing for regular files, which
+// never block.
+func (c *fileConn) SetReadDeadline(t time.Time) error {
+	return ignoreNoDeadline(c.in.SetReadDeadline(t))
+}
+
+func (c *fileConn) SetWriteDeadline(t time.Time) error {
+	return ignoreNoDeadline(c.out.SetWriteDeadline(t))
+}
+
+func ignoreNoDeadline(err error) error {
+	if errors.Is(err, os.ErrNoDeadline) {
+		return nil
+	}
+	return err
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
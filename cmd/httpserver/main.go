@@ -1,123 +1,376 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"httpfromtcp.haonguyen.tech/internal/accesslog"
+	"httpfromtcp.haonguyen.tech/internal/activation"
+	"httpfromtcp.haonguyen.tech/internal/clientauth"
 	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/metrics"
+	"httpfromtcp.haonguyen.tech/internal/problem"
 	"httpfromtcp.haonguyen.tech/internal/request"
 	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/router"
 	"httpfromtcp.haonguyen.tech/internal/server"
+	"httpfromtcp.haonguyen.tech/internal/sse"
+	"httpfromtcp.haonguyen.tech/internal/tracing"
+	"httpfromtcp.haonguyen.tech/internal/websocket"
 )
 
-const port = 42069
+const defaultAddr = ":42069"
+
+const shutdownTimeout = 10 * time.Second
 
 func main() {
-	server, err := server.Serve(port, testHandler)
+	os.Exit(run())
+}
+
+// run serves until told to stop and returns the exit code, once the deferred
+// flushes of the access log and spans have run.
+func run() int {
+	certFile := flag.String("cert", "", "serve TLS with this PEM certificate chain")
+	keyFile := flag.String("key", "", "private key for -cert")
+	clientCA := flag.String("client-ca", "", "ask TLS clients for a certificate signed by one of these CAs")
+	allow := flag.String("allow", "", "comma-separated certificate subjects and URI SANs allowed on /whoami")
+	listen := flag.String("listen", defaultAddr, "comma-separated addresses to listen on: host:port, or unix:/path/to.sock")
+	socketMode := flag.String("socket-mode", "", "permissions of Unix sockets, in octal (e.g. 660)")
+	reusePort := flag.Int("reuseport", 0, "open this many SO_REUSEPORT sockets per TCP address, each with its own accept loop")
+	backlog := flag.Int("backlog", 0, "length of the accept queue (default the system maximum)")
+	deferAccept := flag.Duration("defer-accept", 0, "hold new TCP connections in the kernel until the client sends data, for up to this long")
+	maxConns := flag.Int("max-conns", 0, "most connections served at once (default unlimited)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "most connections from one client IP address (default unlimited)")
+	maxRequests := flag.Int("max-requests", 0, "most requests handled at once (default unlimited)")
+	shed := flag.Bool("shed", false, "answer work past -max-conns and -max-requests with 503 instead of making it wait")
+	inetd := flag.Bool("inetd", false, "serve one connection on stdin and stdout, as started by inetd or systemd with Accept=yes")
+	logFormat := flag.String("log-format", "text", "format of the server's logs on stderr: text or json")
+	logLevel := flag.String("log-level", "info", "least severe level logged: debug, info, warn or error")
+	accessLog := flag.String("access-log", "", "write a line per request to this file, or - for stdout")
+	accessLogFormat := flag.String("access-log-format", "combined", "format of the access log: common, combined or json")
+	accessLogMaxMB := flag.Int("access-log-max-mb", 100, "start a new access log file once it reaches this many megabytes (0 never does)")
+	accessLogBackups := flag.Int("access-log-backups", 5, "old access log files to keep")
+	traceEndpoint := flag.String("trace-endpoint", "", "export spans as OTLP/JSON to this collector URL (e.g. http://localhost:4318/v1/traces)")
+	traceFile := flag.String("trace-file", "", "append spans as OTLP/JSON lines to this file, or - for stdout")
+	flag.Parse()
+
+	var logOut io.Writer = os.Stderr
+	if *inetd && stderrIsSocket() {
+		logOut = io.Discard
+	}
+	if err := setupLogging(logOut, *logFormat, *logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up logging: %v\n", err)
+		return 2
+	}
+
+	socket := server.SocketOptions{ReusePort: *reusePort, Backlog: *backlog, DeferAccept: *deferAccept}
+	listeners, err := parseListeners(*listen, *socketMode, socket)
+	if err != nil {
+		return fail("error parsing -listen", err)
+	}
+
+	config := server.DefaultConfig
+	config.Logger = slog.Default()
+	config.Middleware = []server.Middleware{withServerHeader}
+	if *inetd && *traceFile == "-" {
+		return fail("error opening trace file", errors.New("stdout is the connection in inetd mode"))
+	}
+	exporter, err := newExporter(*traceEndpoint, *traceFile)
 	if err != nil {
-		log.Fatalf("error starting server: %v\n", err)
+		return fail("error setting up span export", err)
 	}
+	// Without an exporter the trace context is still passed on upstream.
+	tracer := tracing.NewTracer(serverName, exporter)
 	defer func() {
-		if err := server.Close(); err != nil {
-			log.Fatalf("error closing server: %v\n", err)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := tracer.Shutdown(ctx); err != nil {
+			slog.Error("error exporting remaining spans", "err", err)
 		}
 	}()
-	log.Println("Server started on port:", port)
+	config.Middleware = append([]server.Middleware{tracing.Middleware(tracer)}, config.Middleware...)
+	if *accessLog != "" {
+		if *inetd && *accessLog == "-" {
+			return fail("error opening access log", errors.New("stdout is the connection in inetd mode"))
+		}
+		out, err := openAccessLog(*accessLog, *accessLogMaxMB, *accessLogBackups)
+		if err != nil {
+			return fail("error opening access log", err)
+		}
+		defer func() { _ = out.Close() }()
+		format, err := accesslog.ParseFormat(*accessLogFormat)
+		if err != nil {
+			return fail("error parsing -access-log-format", err)
+		}
+		// the server reports every answer, its own included
+		config.OnResponse = accesslog.New(out, format).Log
+	}
+	config.MaxConns, config.MaxConnsPerIP, config.MaxRequests = *maxConns, *maxConnsPerIP, *maxRequests
+	if *shed {
+		config.Overload = server.OverloadReject
+	}
+	var s *server.Server
+	if *certFile != "" {
+		tlsConfig := server.TLSConfig{
+			Certificates:   []server.CertificateFiles{{CertFile: *certFile, KeyFile: *keyFile}},
+			ReloadInterval: time.Minute,
+		}
+		if *clientCA != "" {
+			tlsConfig.ClientAuth = server.ClientAuthRequest
+			tlsConfig.ClientCAFile = *clientCA
+		}
+		s, err = server.NewTLS(newRouter(allowPolicy(*allow)).Serve, config, tlsConfig)
+		if err != nil {
+			return fail("error starting server", err)
+		}
+	} else {
+		s = server.New(newRouter(allowPolicy(*allow)).Serve, config)
+	}
+	// on every way out, so a listener that did start leaves no socket file
+	// behind; after Shutdown it is a no-op
+	defer func() { _ = s.Close() }()
+	if *inetd {
+		conn, err := stdioConn()
+		if err != nil {
+			return fail("error opening stdin and stdout", err)
+		}
+		if err := s.ServeConn(conn); err != nil {
+			return fail("error serving stdin and stdout", err)
+		}
+		return 0
+	}
+	// Sockets passed by systemd or a previous process replace -listen.
+	activated, err := activation.Listeners()
+	if err != nil {
+		return fail("error taking activated sockets", err)
+	}
+	if len(activated) > 0 {
+		listeners = listeners[:0]
+		for _, l := range activated {
+			listeners = append(listeners, server.Listener{Listener: l})
+		}
+	}
+	for _, l := range listeners {
+		addr, err := s.Serve(l)
+		if err != nil {
+			return fail("error starting server", err)
+		}
+		slog.Info("server listening", "addr", addr.String())
+	}
+	if err := activation.Notify("READY=1"); err != nil {
+		slog.Error("error notifying readiness", "err", err)
+	}
 
-	// Common pattern to exit the program.
+	// Common pattern to exit the program. SIGHUP reloads the certificates,
+	// SIGUSR2 hands the sockets to a new copy of the binary and exits.
 	sigChn := make(chan os.Signal, 1)
-	signal.Notify(sigChn, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChn
-	log.Println("Server gracefully shutdown")
-}
+	signal.Notify(sigChn, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+loop:
+	for sig := range sigChn {
+		switch sig {
+		case syscall.SIGHUP:
+			if err := s.ReloadCertificates(); err != nil {
+				slog.Error("error reloading certificates", "err", err)
+				continue
+			}
+			slog.Info("reloaded TLS certificates")
+		case syscall.SIGUSR2:
+			pid, err := handOff(s)
+			if err != nil {
+				slog.Error("error handing off listeners", "err", err)
+				continue
+			}
+			slog.Info("handed listeners off", "pid", pid)
+			break loop
+		default:
+			break loop
+		}
+	}
 
-func testHandler(w *response.Writer, req *request.Request) {
-	if req.RequestLine.RequestTarget == "/yourproblem" {
-		handler400(w, req)
-		return
-	} else if req.RequestLine.RequestTarget == "/myproblem" {
-		handler500(w, req)
-		return
-	} else if req.RequestLine.RequestTarget == "/video" {
-		handlerVideo(w, req)
-		return
-	} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		handlerProxy(w, req)
-		return
-	} else {
-		handler200(w, req)
-		return
+	// Give in-flight requests a chance to finish before exiting.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		return fail("error shutting down server", err)
 	}
+	slog.Info("server gracefully shut down")
+	return 0
+}
+
+// fail logs msg with err and returns the exit code for it.
+func fail(msg string, err error) int {
+	slog.Error(msg, "err", err)
+	return 1
 }
 
-func handler400(w *response.Writer, _ *request.Request) {
-	err := w.WriteStatusLine(response.StatusBadRequest)
+// setupLogging makes the default logger write to w in format, from level
+// up.
+func setupLogging(w io.Writer, format, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	h, err := logging.NewHandler(w, format, l)
 	if err != nil {
-		log.Printf("error write status line :%v\n", err)
-		return
+		return err
 	}
-	body := []byte(`<html>
-<head>
-<title>400 Bad Request</title>
-</head>
-<body>
-<h1>Bad Request</h1>
-<p>Your request honestly kinda sucked.</p>
-</body>
-</html>
-`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
-	err = w.WriteHeaders(h)
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// openAccessLog opens the -access-log file, rotating once it reaches maxMB,
+// or stdout for "-".
+func openAccessLog(path string, maxMB, backups int) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return logging.OpenRotatingFile(path, int64(maxMB)<<20, backups)
+}
+
+// newExporter returns the exporter for the -trace-endpoint and -trace-file
+// flags, or nil if neither is set. The file stays open until the process
+// exits.
+func newExporter(endpoint, file string) (tracing.Exporter, error) {
+	switch {
+	case endpoint != "" && file != "":
+		return nil, errors.New("-trace-endpoint and -trace-file are exclusive")
+	case endpoint != "":
+		return tracing.NewHTTPExporter(endpoint), nil
+	case file == "-":
+		return tracing.NewFileExporter(os.Stdout), nil
+	case file != "":
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return tracing.NewFileExporter(f), nil
+	}
+	return nil, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// handOff starts the new binary on the server's sockets and returns its pid
+// once it is accepting connections.
+func handOff(s *server.Server) (int, error) {
+	files, err := s.ListenerFiles()
 	if err != nil {
-		log.Printf("error when write header %v\n", err)
+		return 0, err
 	}
-	_, err = w.WriteBody(body)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	p, err := activation.Handoff(files, shutdownTimeout)
 	if err != nil {
-		log.Printf("error when write body %v\n", err)
+		return 0, err
 	}
+	// the new process is ready and serves the socket files from now on
+	s.KeepSocketFiles()
+	return p.Pid, nil
 }
 
-func handler500(w *response.Writer, _ *request.Request) {
-	if err := w.WriteStatusLine(response.StatusServerInternalError); err != nil {
-		log.Printf("error: %v\n", err)
-		return
+// parseListeners parses the -listen and -socket-mode flags, tuning TCP
+// sockets with socket.
+func parseListeners(listen, socketMode string, socket server.SocketOptions) ([]server.Listener, error) {
+	var mode uint64
+	if socketMode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(socketMode, 8, 32); err != nil {
+			return nil, fmt.Errorf("invalid -socket-mode %q: %w", socketMode, err)
+		}
+	}
+	var listeners []server.Listener
+	for _, addr := range strings.Split(listen, ",") {
+		addr = strings.TrimSpace(addr)
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			listeners = append(listeners, server.Listener{
+				Network: "unix",
+				Address: path,
+				Mode:    os.FileMode(mode),
+				Socket:  server.SocketOptions{Backlog: socket.Backlog},
+			})
+		} else if addr != "" {
+			listeners = append(listeners, server.Listener{Address: addr, Socket: socket})
+		}
 	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no addresses to listen on")
+	}
+	return listeners, nil
+}
 
-	body := []byte(`<html>
-<head>
-<title>500 Internal Server Error</title>
-</head>
-<body>
-<h1>Internal Server Error</h1>
-<p>Okay, you know what? This one is on me.</p>
-</body>
-</html>
-`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+// allowPolicy parses the -allow flag: entries with a scheme are URI SANs,
+// the rest subjects.
+func allowPolicy(allow string) clientauth.Policy {
+	var p clientauth.Policy
+	for _, entry := range strings.Split(allow, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "://"):
+			p.URIs = append(p.URIs, entry)
+		default:
+			p.Subjects = append(p.Subjects, entry)
+		}
+	}
+	return p
+}
 
-	if err := w.WriteHeaders(h); err != nil {
-		log.Printf("error: %v\n", err)
-		return
+func newRouter(whoamiPolicy clientauth.Policy) *router.Router {
+	rt := router.New()
+	rt.Handle("GET", "/yourproblem", handler400)
+	rt.Handle("GET", "/myproblem", handler500)
+	rt.Handle("GET", "/video", handlerVideo)
+	rt.Handle("GET", "/events", handlerEvents)
+	rt.Handle("GET", "/echo", handlerEcho)
+	// the wildcard needs the slash, so the bare prefix is a route of its own
+	rt.Handle("GET", "/httpbin", handlerProxy)
+	rt.Handle("GET", "/httpbin/{path...}", handlerProxy)
+	rt.Handle("GET", "/whoami", handlerWhoami, clientauth.Require(whoamiPolicy))
+	// the server records its metrics in metrics.Default
+	rt.Handle("GET", "/metrics", metrics.Default.Serve)
+	// everything else gets the friendly 200 page
+	rt.Handle("GET", "/{path...}", handler200)
+	return rt
+}
+
+func handler400(w response.ResponseWriter, req *request.Request) {
+	err := problem.Write(w, req, problem.New(response.StatusBadRequest, "Your request honestly kinda sucked."))
+	if err != nil {
+		logging.FromContext(req.Context()).Error("writing problem", "err", err)
 	}
-	if _, err := w.WriteBody(body); err != nil {
-		log.Printf("error: %v\n", err)
-		return
+}
+
+func handler500(w response.ResponseWriter, req *request.Request) {
+	err := problem.Write(w, req, problem.New(response.StatusServerInternalError, "Okay, you know what? This one is on me."))
+	if err != nil {
+		logging.FromContext(req.Context()).Error("writing problem", "err", err)
 	}
 }
 
-func handler200(w *response.Writer, _ *request.Request) {
+func handler200(w response.ResponseWriter, req *request.Request) {
+	logger := logging.FromContext(req.Context())
 	if err := w.WriteStatusLine(response.StatusOK); err != nil {
-		log.Printf("error: %v\n", err)
+		logger.Error("writing response", "err", err)
 		return
 	}
 	body := []byte(`<html>
@@ -133,16 +386,17 @@ func handler200(w *response.Writer, _ *request.Request) {
 	h := response.GetDefaultHeaders(len(body))
 	h.Override("Content-Type", "text/html")
 	if err := w.WriteHeaders(h); err != nil {
-		log.Printf("error: %v\n", err)
+		logger.Error("writing response", "err", err)
 		return
 	}
 	if _, err := w.WriteBody(body); err != nil {
-		log.Printf("error: %v\n", err)
+		logger.Error("writing response", "err", err)
 		return
 	}
 }
 
-func handlerProxy(w *response.Writer, req *request.Request) {
+func handlerProxy(w response.ResponseWriter, req *request.Request) {
+	logger := logging.FromContext(req.Context())
 	// trim the request target, to get the correct endpoint later to make the actual request
 	query := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
 	if query == req.RequestLine.RequestTarget {
@@ -151,30 +405,31 @@ func handlerProxy(w *response.Writer, req *request.Request) {
 	}
 
 	endpoint := fmt.Sprintf("https://httpbin.org%s", query)
-	res, err := http.Get(endpoint)
+	res, err := getUpstream(req.Context(), endpoint)
+	if err != nil {
+		logger.Error("calling upstream", "url", endpoint, "err", err)
+		if err := problem.Write(w, req, problem.New(response.StatusBadGateway, "The upstream server could not be reached.")); err != nil {
+			logger.Error("writing problem", "err", err)
+		}
+		return
+	}
 	defer func() {
 		if err := res.Body.Close(); err != nil {
-			log.Printf("error closing response body when using proxy: %v\n", err)
+			logger.Error("closing upstream response body", "err", err)
 		}
 	}()
-
-	if err != nil {
-		log.Printf("error when calling %s: %v\n", endpoint, err)
-		handler500(w, req)
-	}
 	if err := w.WriteStatusLine(response.StatusOK); err != nil {
-		log.Printf("error: %v\n", err)
+		logger.Error("writing response", "err", err)
 		return
 	}
 	// get the header and remove content-type, set Transfer-Encoding
 	h := response.GetDefaultHeaders(0)
 	h.Delete("Content-Length")
-	h.Delete("Connection")
 	h.Set("Transfer-Encoding", "chunked")
 	h.Set("Trailer", "X-Content-SHA256")
 	h.Set("Trailer", "X-Content-Length")
 	if err := w.WriteHeaders(h); err != nil {
-		log.Printf("error: %v\n", err)
+		logger.Error("writing response", "err", err)
 		return
 	}
 
@@ -187,7 +442,7 @@ func handlerProxy(w *response.Writer, req *request.Request) {
 		if numBytesRead > 0 {
 			_, err = w.WriteChunkedBody(b[:numBytesRead])
 			if err != nil {
-				log.Printf("error write chunk body: %v\n", err)
+				logger.Error("writing chunk", "err", err)
 				return
 			}
 			fullBody = append(fullBody, b[:numBytesRead]...)
@@ -196,12 +451,12 @@ func handlerProxy(w *response.Writer, req *request.Request) {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			log.Printf("error reading buffer: %v\n", err)
+			logger.Error("reading upstream response body", "err", err)
 			return
 		}
 	}
 	if _, err := w.WriteChunkedBodyDone(); err != nil {
-		log.Printf("error WriteChunkedBodyDone: %v", err)
+		logger.Error("ending chunked body", "err", err)
 		return
 	}
 
@@ -211,23 +466,52 @@ func handlerProxy(w *response.Writer, req *request.Request) {
 	trailers.Override("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
 	err = w.WriteTrailers(trailers)
 	if err != nil {
-		log.Printf("error write trailer: %v\n", err)
+		logger.Error("writing trailers", "err", err)
 		return
 	}
 }
 
-func handlerVideo(w *response.Writer, req *request.Request) {
-	log.Println("Getting video file for you")
+// getUpstream requests url in a client span, passing the trace on to the
+// upstream server.
+func getUpstream(ctx context.Context, url string) (*http.Response, error) {
+	ctx, span := tracing.StartSpan(ctx, http.MethodGet, tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttributes(
+		tracing.Attribute{Key: "http.request.method", Value: http.MethodGet},
+		tracing.Attribute{Key: "url.full", Value: url},
+	)
+	outReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		span.SetStatus(tracing.StatusError, err.Error())
+		return nil, err
+	}
+	tracing.Inject(span.Context(), outReq.Header)
+	res, err := http.DefaultClient.Do(outReq)
+	if err != nil {
+		span.SetStatus(tracing.StatusError, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(tracing.Attribute{Key: "http.response.status_code", Value: res.StatusCode})
+	// for a client, any failed response is an error
+	if res.StatusCode >= 400 {
+		span.SetStatus(tracing.StatusError, "")
+	}
+	return res, nil
+}
+
+func handlerVideo(w response.ResponseWriter, req *request.Request) {
+	logger := logging.FromContext(req.Context())
+	logger.Info("getting video file")
 	videoFile, err := os.ReadFile("assets/vim.mp4")
 	if err != nil {
-		log.Printf("error ReadFile for video: %v\n", err)
+		logger.Error("reading video file", "err", err)
 		handler500(w, req)
 		return
 	}
 	// Write status line
 	err = w.WriteStatusLine(response.StatusOK)
 	if err != nil {
-		log.Printf("error write status line :%v\n", err)
+		logger.Error("writing status line", "err", err)
 		return
 	}
 
@@ -236,12 +520,102 @@ func handlerVideo(w *response.Writer, req *request.Request) {
 	h.Override("Content-Type", "video/mp4")
 	err = w.WriteHeaders(h)
 	if err != nil {
-		log.Printf("error when write header %v\n", err)
+		logger.Error("writing headers", "err", err)
 		return
 	}
 	_, err = w.WriteBody(videoFile)
 	if err != nil {
-		log.Printf("error when write body, for video file %v\n", err)
+		logger.Error("writing body", "err", err)
 		return
 	}
 }
+
+func handlerWhoami(w response.ResponseWriter, req *request.Request) {
+	logger := logging.FromContext(req.Context())
+	leaf := req.PeerCertificates()[0]
+	body := []byte(fmt.Sprintf("subject: %s\n", leaf.Subject))
+	for _, u := range req.PeerSANs().URIs {
+		body = fmt.Appendf(body, "uri: %s\n", u)
+	}
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		logger.Error("writing response", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(response.GetDefaultHeaders(len(body))); err != nil {
+		logger.Error("writing response", "err", err)
+		return
+	}
+	if _, err := w.WriteBody(body); err != nil {
+		logger.Error("writing response", "err", err)
+	}
+}
+
+func handlerEvents(w response.ResponseWriter, req *request.Request) {
+	logger := logging.FromContext(req.Context())
+	stream, err := sse.NewStream(w, req, sse.DefaultHeartbeat)
+	if err != nil {
+		logger.Error("starting event stream", "err", err)
+		return
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			logger.Error("closing event stream", "err", err)
+		}
+	}()
+
+	// Resume after the last event the client saw, if it is reconnecting.
+	next := 1
+	if id, err := strconv.Atoi(stream.LastEventID()); err == nil {
+		next = id + 1
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for ; ; next++ {
+		select {
+		case <-stream.Done():
+			logger.Info("event stream client disconnected")
+			return
+		case <-ticker.C:
+			ev := sse.Event{
+				ID:    strconv.Itoa(next),
+				Event: "log",
+				Data:  fmt.Sprintf("build step %d\ncompleted at %s", next, time.Now().Format(time.RFC3339)),
+			}
+			if err := stream.Send(ev); err != nil {
+				logger.Error("sending event", "err", err)
+				return
+			}
+		}
+	}
+}
+
+func handlerEcho(w response.ResponseWriter, req *request.Request) {
+	logger := logging.FromContext(req.Context())
+	conn, err := websocket.Upgrade(w, req, websocket.Options{Compression: &websocket.Compression{}})
+	if err != nil {
+		logger.Error("upgrading to websocket", "err", err)
+		return
+	}
+	defer func() {
+		if err := conn.Close(websocket.CloseNormalClosure, ""); err != nil {
+			logger.Error("closing websocket", "err", err)
+		}
+	}()
+
+	// Send every message straight back until the client closes.
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				logger.Error("reading websocket message", "err", err)
+			}
+			return
+		}
+		if err := conn.WriteMessage(typ, msg); err != nil {
+			logger.Error("writing websocket message", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/server"
+)
+
+const serverName = "httpfromtcp"
+
+// withServerHeader adds a Server header to every response.
+func withServerHeader(next server.Handler) server.Handler {
+	return func(w response.ResponseWriter, req *request.Request) {
+		next(serverHeaderWriter{response.Wrapper{ResponseWriter: w}}, req)
+	}
+}
+
+type serverHeaderWriter struct {
+	response.Wrapper
+}
+
+func (w serverHeaderWriter) WriteHeaders(h headers.Headers) error {
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	if _, ok := h.Get("Server"); !ok {
+		h.Set("Server", serverName)
+	}
+	return w.Wrapper.WriteHeaders(h)
+}
@@ -0,0 +1,239 @@
+// Package accesslog records one line per request, in the Common or Combined
+// Log Format that Apache and nginx write, or as JSON.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// Format is the layout of the access log lines.
+type Format int
+
+const (
+	// Common is the Common Log Format:
+	//	host ident authuser [time] "method target proto" status bytes
+	Common Format = iota
+	// Combined is the Common Log Format followed by the quoted Referer and
+	// User-Agent.
+	Combined
+	// JSON writes an object per line with the fields of Combined and how
+	// long the request took.
+	JSON
+)
+
+// ParseFormat returns the Format named "common", "combined" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "common":
+		return Common, nil
+	case "combined":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("accesslog: unknown format %q", name)
+}
+
+// clfTime is the timestamp layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// now is replaced by tests.
+var now = time.Now
+
+// Logger writes a line to its output for every request. Each line is a
+// single Write, and lines are never written concurrently, so the output
+// needs no locking of its own.
+type Logger struct {
+	out    io.Writer
+	format Format
+	mu     sync.Mutex
+}
+
+// New returns a Logger writing to out in format. Set its Log method as the
+// server's Config.OnResponse, so requests the server answers itself, such as
+// those that panicked or could not be parsed, are logged too.
+func New(out io.Writer, format Format) *Logger {
+	return &Logger{out: out, format: format}
+}
+
+// Log writes the line for req, answered on w since start.
+func (l *Logger) Log(w response.ResponseWriter, req *request.Request, start time.Time) {
+	st, _ := response.StatsOf(w)
+	e := entry{
+		time:     start,
+		req:      req,
+		status:   int(st.StatusCode),
+		bytes:    st.EncodedBodyBytes,
+		duration: now().Sub(start),
+	}
+	if err := l.write(e); err != nil {
+		logging.FromContext(req.Context()).Error("writing access log", "err", err)
+	}
+}
+
+// entry describes a request that was answered.
+type entry struct {
+	time     time.Time
+	req      *request.Request
+	status   int
+	bytes    int64
+	duration time.Duration
+}
+
+func (l *Logger) write(e entry) error {
+	var line []byte
+	if l.format == JSON {
+		var err error
+		if line, err = e.appendJSON(nil); err != nil {
+			return err
+		}
+	} else {
+		line = e.appendCommon(nil)
+		if l.format == Combined {
+			line = append(line, ' ')
+			line = appendQuoted(line, e.header("Referer"))
+			line = append(line, ' ')
+			line = appendQuoted(line, e.header("User-Agent"))
+		}
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.out.Write(line)
+	return err
+}
+
+func (e entry) appendCommon(b []byte) []byte {
+	b = append(b, orDash(e.host())...)
+	b = append(b, " - - ["...)
+	b = e.time.AppendFormat(b, clfTime)
+	b = append(b, "] "...)
+	b = appendQuoted(b, e.requestLine())
+	b = append(b, ' ')
+	if e.status == 0 {
+		b = append(b, '-')
+	} else {
+		b = strconv.AppendInt(b, int64(e.status), 10)
+	}
+	b = append(b, ' ')
+	if e.bytes == 0 {
+		b = append(b, '-')
+	} else {
+		b = strconv.AppendInt(b, e.bytes, 10)
+	}
+	return b
+}
+
+func (e entry) appendJSON(b []byte) ([]byte, error) {
+	rl := e.req.RequestLine
+	j, err := json.Marshal(struct {
+		Time       string  `json:"time"`
+		RemoteAddr string  `json:"remote_addr"`
+		Method     string  `json:"method"`
+		Target     string  `json:"target"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMS float64 `json:"duration_ms"`
+		UserAgent  string  `json:"user_agent"`
+		Referer    string  `json:"referer"`
+	}{
+		Time:       e.time.Format(time.RFC3339Nano),
+		RemoteAddr: e.host(),
+		Method:     rl.Method,
+		Target:     rl.RequestTarget,
+		Proto:      e.proto(),
+		Status:     e.status,
+		Bytes:      e.bytes,
+		DurationMS: float64(e.duration.Microseconds()) / 1000,
+		UserAgent:  e.header("User-Agent"),
+		Referer:    e.header("Referer"),
+	})
+	return append(b, j...), err
+}
+
+// host is the client's address without its port.
+func (e entry) host() string {
+	host, _, err := net.SplitHostPort(e.req.RemoteAddr)
+	if err != nil {
+		return e.req.RemoteAddr
+	}
+	return host
+}
+
+// requestLine is the request line, or "" for a request that could not be
+// read that far.
+func (e entry) requestLine() string {
+	rl := e.req.RequestLine
+	if rl.Method == "" {
+		return ""
+	}
+	return rl.Method + " " + rl.RequestTarget + " " + e.proto()
+}
+
+func (e entry) proto() string {
+	if e.req.RequestLine.HttpVersion == "" {
+		return ""
+	}
+	return "HTTP/" + e.req.RequestLine.HttpVersion
+}
+
+func (e entry) header(key string) string {
+	if e.req.Headers == nil {
+		return ""
+	}
+	v, _ := e.req.Headers.Get(key)
+	return v
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// appendQuoted appends s in double quotes, or "-" if it is empty. Quotes,
+// backslashes and control characters are escaped as nginx does, so a
+// client cannot forge lines or fields.
+func appendQuoted(b []byte, s string) []byte {
+	b = append(b, '"')
+	if s == "" {
+		b = append(b, '-')
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			b = fmt.Appendf(b, `\x%02X`, c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// String returns the name ParseFormat takes.
+func (f Format) String() string {
+	switch f {
+	case Common:
+		return "common"
+	case Combined:
+		return "combined"
+	case JSON:
+		return "json"
+	}
+	return "Format(" + strconv.Itoa(int(f)) + ")"
+}
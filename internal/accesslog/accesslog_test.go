@@ -0,0 +1,116 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// logRequest answers raw with body and returns the line logged for it in
+// format.
+func logRequest(t *testing.T, format Format, raw, body string) string {
+	t.Helper()
+	clock := time.Date(2026, time.March, 7, 14, 5, 9, 0, time.FixedZone("", 2*3600))
+	now = func() time.Time {
+		clock = clock.Add(1500 * time.Microsecond)
+		return clock
+	}
+	t.Cleanup(func() { now = time.Now })
+
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.7:51234"
+	var out bytes.Buffer
+	start := now()
+	w := response.NewWriter(&bytes.Buffer{})
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody([]byte(body))
+	New(&out, format).Log(w, req, start)
+	require.NoError(t, w.Flush())
+	return out.String()
+}
+
+const get = "GET /index.html?q=1 HTTP/1.1\r\nHost: x\r\nReferer: http://example.com/\r\nUser-Agent: curl/8.5.0\r\n\r\n"
+
+func TestCommon(t *testing.T) {
+	// Test: A line as Apache writes it
+	line := logRequest(t, Common, get, "hello")
+	assert.Equal(t, `192.0.2.7 - - [07/Mar/2026:14:05:09 +0200] "GET /index.html?q=1 HTTP/1.1" 200 5`+"\n", line)
+
+	// Test: An empty body is logged as "-"
+	line = logRequest(t, Common, get, "")
+	assert.True(t, strings.HasSuffix(line, `" 200 -`+"\n"), line)
+
+	// Test: So is a request line that could not be read, and a response
+	// not sent
+	var out bytes.Buffer
+	req := &request.Request{RemoteAddr: "192.0.2.7:51234"}
+	New(&out, Common).Log(response.NewWriter(&bytes.Buffer{}), req, time.Now())
+	assert.True(t, strings.HasSuffix(out.String(), `] "-" - -`+"\n"), out.String())
+}
+
+func TestCombined(t *testing.T) {
+	// Test: Referer and User-Agent follow, quoted
+	line := logRequest(t, Combined, get, "hello")
+	assert.Equal(t, `192.0.2.7 - - [07/Mar/2026:14:05:09 +0200] "GET /index.html?q=1 HTTP/1.1" 200 5 "http://example.com/" "curl/8.5.0"`+"\n", line)
+
+	// Test: Missing headers are "-", and quotes in them are escaped so they
+	// cannot end the field
+	line = logRequest(t, Combined, "GET / HTTP/1.1\r\nHost: x\r\nUser-Agent: a\" \"b\\\r\n\r\n", "")
+	assert.True(t, strings.HasSuffix(line, ` "-" "a\" \"b\\"`+"\n"), line)
+}
+
+func TestJSON(t *testing.T) {
+	line := logRequest(t, JSON, get, "hello")
+
+	// Test: One object per line with every field
+	require.True(t, strings.HasSuffix(line, "}\n"), line)
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	var got map[string]any
+	require.NoError(t, json.Unmarshal([]byte(line), &got))
+	assert.Equal(t, map[string]any{
+		"time":        "2026-03-07T14:05:09.0015+02:00",
+		"remote_addr": "192.0.2.7",
+		"method":      "GET",
+		"target":      "/index.html?q=1",
+		"proto":       "HTTP/1.1",
+		"status":      float64(200),
+		"bytes":       float64(5),
+		"duration_ms": 1.5,
+		"user_agent":  "curl/8.5.0",
+		"referer":     "http://example.com/",
+	}, got)
+}
+
+func TestAppendQuoted(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "", want: `"-"`},
+		{in: "plain", want: `"plain"`},
+		{in: `a"b\c`, want: `"a\"b\\c"`},
+		{in: "line\nbreak\x7f", want: `"line\x0Abreak\x7F"`},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, string(appendQuoted(nil, tt.in)))
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, f := range []Format{Common, Combined, JSON} {
+		got, err := ParseFormat(f.String())
+		require.NoError(t, err)
+		assert.Equal(t, f, got)
+	}
+	_, err := ParseFormat("apache")
+	assert.Error(t, err)
+}
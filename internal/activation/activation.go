@@ -0,0 +1,96 @@
+// Package activation receives listening sockets from a parent process, as
+// systemd socket activation passes them (LISTEN_FDS), and hands them on to
+// a new copy of the program for restarts that never stop accepting
+// connections.
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed, after stdin, stdout
+// and stderr.
+const listenFDsStart = 3
+
+// Listeners returns the listening sockets passed to the process: LISTEN_FDS
+// of them from file descriptor 3 on, if LISTEN_PID is unset or names this
+// process. Without LISTEN_FDS it returns none. It unsets the variables, so
+// child processes do not take the sockets for theirs.
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	n, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make([]net.Listener, 0, n)
+	for i := range n {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener takes a copy that is closed on exec, so the inherited
+		// descriptor is not leaked into children
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("activation: %s: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenFDs returns how many sockets the environment says were passed to
+// the process pid.
+func listenFDs(listenPID, listenFDs string, pid int) (int, error) {
+	if listenFDs == "" {
+		return 0, nil
+	}
+	// a handoff cannot know the pid of the process it starts, so an unset
+	// LISTEN_PID is accepted
+	if listenPID != "" && listenPID != strconv.Itoa(pid) {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("activation: invalid LISTEN_FDS %q", listenFDs)
+	}
+	return n, nil
+}
+
+// Notify sends state, such as "READY=1", to the service manager or the
+// process that started this one by Handoff, through NOTIFY_SOCKET. It does
+// nothing if NOTIFY_SOCKET is unset.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "@") {
+		// an abstract socket
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("activation: notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("activation: notify: %w", err)
+	}
+	return nil
+}
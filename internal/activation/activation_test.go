@@ -0,0 +1,206 @@
+package activation
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// helperEnv tells the test binary, run as a child process, to act as
+// TestHelperProcess.
+const helperEnv = "ACTIVATION_TEST_HELPER"
+
+// TestHelperProcess is the child process of the tests, not a test itself.
+// It takes its listeners from the environment and answers every connection
+// with the greeting in helperEnv.
+func TestHelperProcess(t *testing.T) {
+	greeting := os.Getenv(helperEnv)
+	if greeting == "" {
+		t.Skip("only run as a child process")
+	}
+	defer os.Exit(0)
+	if greeting == "exit" {
+		return
+	}
+	listeners, err := Listeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, l := range listeners {
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "%s %d %q\n", greeting, len(listeners), os.Getenv("LISTEN_FDS"))
+				_ = conn.Close()
+			}
+		}()
+	}
+	if greeting != "never ready" {
+		if err := Notify("READY=1"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	time.Sleep(time.Minute)
+}
+
+// helperArgs runs only TestHelperProcess in the child.
+var helperArgs = []string{"-test.run=^TestHelperProcess$"}
+
+// listenerFiles listens on n loopback ports and returns the listeners and
+// their files.
+func listenerFiles(t *testing.T, n int) ([]net.Listener, []*os.File) {
+	t.Helper()
+	var listeners []net.Listener
+	var files []*os.File
+	for range n {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = f.Close() })
+		listeners = append(listeners, l)
+		files = append(files, f)
+	}
+	return listeners, files
+}
+
+// greeting reads what the process listening on addr says.
+func greeting(t *testing.T, addr net.Addr) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestListeners(t *testing.T) {
+	listeners, files := listenerFiles(t, 2)
+	cmd := exec.Command(os.Args[0], helperArgs...)
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), helperEnv+"=hello", "LISTEN_FDS=2", "LISTEN_FDNAMES=a:b")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// Test: The child serves every socket passed to it, and unsets
+	// LISTEN_FDS so its own children do not take them
+	for _, l := range listeners {
+		assert.Equal(t, "hello 2 \"\"\n", greeting(t, l.Addr()))
+	}
+}
+
+func TestListenFDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		listenPID string
+		listenFDs string
+		want      int
+		wantErr   bool
+	}{
+		{name: "not activated", want: 0},
+		{name: "this process", listenPID: "42", listenFDs: "2", want: 2},
+		{name: "no pid", listenFDs: "1", want: 1},
+		{name: "another process", listenPID: "43", listenFDs: "2", want: 0},
+		{name: "invalid count", listenFDs: "two", wantErr: true},
+		{name: "negative count", listenFDs: "-1", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := listenFDs(tc.listenPID, tc.listenFDs, 42)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, n)
+		})
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+
+	// Test: Sockets meant for another process are left alone, and the
+	// variables still unset
+	listeners, err := Listeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok)
+}
+
+func TestNotify(t *testing.T) {
+	path := t.TempDir() + "/notify"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	// Test: Without NOTIFY_SOCKET, Notify does nothing
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, Notify("READY=1"))
+
+	// Test: The state is sent as one datagram
+	t.Setenv("NOTIFY_SOCKET", path)
+	require.NoError(t, Notify("STATUS=serving\nREADY=1"))
+	require.NoError(t, waitReady(conn, time.Now().Add(5*time.Second)))
+}
+
+func TestHandoff(t *testing.T) {
+	listeners, files := listenerFiles(t, 1)
+	addr := listeners[0].Addr()
+	t.Setenv(helperEnv, "new")
+
+	// Test: Handoff returns once the new process is ready, which then
+	// serves the sockets alongside the old one until it stops accepting
+	p, err := handoff(os.Args[0], helperArgs, files, 10*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = p.Kill() })
+	require.NoError(t, listeners[0].Close())
+	assert.Equal(t, "new 1 \"\"\n", greeting(t, addr))
+}
+
+func TestHandoffFails(t *testing.T) {
+	_, files := listenerFiles(t, 1)
+
+	// Test: A new process that exits before it is ready fails the handoff
+	t.Setenv(helperEnv, "exit")
+	_, err := handoff(os.Args[0], helperArgs, files, 10*time.Second)
+	assert.ErrorIs(t, err, errNotReady)
+	assert.ErrorContains(t, err, "exited")
+
+	// Test: So does one that takes too long, which is killed
+	t.Setenv(helperEnv, "never ready")
+	start := time.Now()
+	_, err = handoff(os.Args[0], helperArgs, files, 500*time.Millisecond)
+	assert.ErrorIs(t, err, errNotReady)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// Test: And one that cannot be started
+	_, err = handoff("/nonexistent", nil, files, time.Second)
+	assert.Error(t, err)
+}
+
+func TestHandoffEnv(t *testing.T) {
+	env := handoffEnv([]string{"PATH=/bin", "LISTEN_FDS=2", "LISTEN_PID=1", "LISTEN_FDNAMES=a:b", "NOTIFY_SOCKET=/run/notify", "LISTEN=kept"})
+	assert.Equal(t, []string{"PATH=/bin", "LISTEN=kept"}, env)
+}
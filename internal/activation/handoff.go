@@ -0,0 +1,113 @@
+package activation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNotReady is returned by Handoff when the new process exits or times out
+// before it is ready.
+var errNotReady = errors.New("activation: new process did not become ready")
+
+// Handoff starts a new copy of the running program, with the same arguments,
+// passing it files, which must be listening sockets, as its activated
+// listeners. It returns once the new process has sent "READY=1" with
+// Notify, which it should do when it is accepting connections. The caller
+// can then stop accepting, finish its requests and exit.
+//
+// If the new process exits or does not become ready within timeout, it is
+// killed and Handoff returns an error, leaving the caller to carry on.
+func Handoff(files []*os.File, timeout time.Duration) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("activation: finding the executable: %w", err)
+	}
+	return handoff(path, os.Args[1:], files, timeout)
+}
+
+func handoff(path string, args []string, files []*os.File, timeout time.Duration) (*os.Process, error) {
+	dir, err := os.MkdirTemp("", "handoff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("activation: notify socket: %w", err)
+	}
+	defer notify.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(handoffEnv(os.Environ()),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"NOTIFY_SOCKET="+notify.LocalAddr().String(),
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("activation: starting %s: %w", path, err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready := make(chan error, 1)
+	go func() { ready <- waitReady(notify, time.Now().Add(timeout)) }()
+	select {
+	case err = <-ready:
+		if err == nil {
+			return cmd.Process, nil
+		}
+	case err = <-exited:
+		if err == nil {
+			err = fmt.Errorf("%w: it exited", errNotReady)
+		} else {
+			err = fmt.Errorf("%w: %v", errNotReady, err)
+		}
+		return nil, err
+	}
+	_ = cmd.Process.Kill()
+	<-exited
+	return nil, err
+}
+
+// handoffEnv drops the variables that describe this process's own
+// activation from env.
+func handoffEnv(env []string) []string {
+	var kept []string
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "NOTIFY_SOCKET":
+		default:
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// waitReady reads notifications until one says READY=1.
+func waitReady(conn *net.UnixConn, deadline time.Time) error {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errNotReady, err)
+		}
+		for line := range bytes.SplitSeq(buf[:n], []byte("\n")) {
+			if string(line) == "READY=1" {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package clientauth authorizes requests by the TLS client certificate the
+// server verified, for service-to-service calls over mutual TLS.
+package clientauth
+
+import (
+	"crypto/x509"
+	"slices"
+	"strings"
+
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/problem"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/server"
+)
+
+// Policy lists the clients allowed through. A client is allowed if its
+// verified certificate matches any entry.
+type Policy struct {
+	// Subjects match the certificate subject, either its common name
+	// ("billing") or its whole distinguished name ("CN=billing,O=Example").
+	Subjects []string
+	// URIs match the certificate's URI SANs, such as SPIFFE IDs
+	// ("spiffe://example.org/ns/prod/sa/billing"). An entry ending in "/*"
+	// matches every URI under it, e.g. "spiffe://example.org/*" for a whole
+	// trust domain.
+	URIs []string
+}
+
+// Require returns middleware that lets a request through only if its
+// client certificate satisfies p, answering 403 otherwise. The server must
+// be asking for client certificates; see server.TLSConfig.ClientAuth.
+func Require(p Policy) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w response.ResponseWriter, req *request.Request) {
+			if p.Allows(req.PeerCertificates()) {
+				next(w, req)
+				return
+			}
+			logger := logging.FromContext(req.Context())
+			logger.Warn("client certificate refused")
+			err := problem.Write(w, req, problem.New(response.StatusForbidden, "A client certificate allowed to access this resource is required."))
+			if err != nil {
+				logger.Error("writing problem", "err", err)
+			}
+		}
+	}
+}
+
+// Allows reports whether the leaf of a verified chain satisfies p.
+func (p Policy) Allows(chain []*x509.Certificate) bool {
+	if len(chain) == 0 {
+		return false
+	}
+	leaf := chain[0]
+	if slices.Contains(p.Subjects, leaf.Subject.CommonName) || slices.Contains(p.Subjects, leaf.Subject.String()) {
+		return true
+	}
+	for _, u := range leaf.URIs {
+		for _, allowed := range p.URIs {
+			if matchURI(allowed, u.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchURI(pattern, uri string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(uri, prefix)
+	}
+	return pattern == uri
+}
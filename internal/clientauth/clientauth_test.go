@@ -0,0 +1,84 @@
+package clientauth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+func cert(t *testing.T, cn string, uris ...string) *x509.Certificate {
+	t.Helper()
+	c := &x509.Certificate{Subject: pkix.Name{CommonName: cn, Organization: []string{"Example"}}}
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		c.URIs = append(c.URIs, u)
+	}
+	return c
+}
+
+func TestPolicyAllows(t *testing.T) {
+	p := Policy{
+		Subjects: []string{"billing", "CN=audit,O=Example"},
+		URIs:     []string{"spiffe://example.org/ns/prod/sa/web", "spiffe://partner.org/*"},
+	}
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{name: "common name", cert: cert(t, "billing"), want: true},
+		{name: "distinguished name", cert: cert(t, "audit"), want: true},
+		{name: "exact SPIFFE ID", cert: cert(t, "x", "spiffe://example.org/ns/prod/sa/web"), want: true},
+		{name: "trust domain", cert: cert(t, "x", "spiffe://partner.org/ns/a/sa/b"), want: true},
+		{name: "other SPIFFE ID", cert: cert(t, "x", "spiffe://example.org/ns/prod/sa/db"), want: false},
+		{name: "prefix is not a domain", cert: cert(t, "x", "spiffe://partner.org.evil/sa"), want: false},
+		{name: "unknown subject", cert: cert(t, "mallory"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, p.Allows([]*x509.Certificate{tt.cert}))
+		})
+	}
+	assert.False(t, p.Allows(nil))
+}
+
+func TestRequire(t *testing.T) {
+	handler := Require(Policy{Subjects: []string{"billing"}})(func(w response.ResponseWriter, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	serve := func(state *tls.ConnectionState) string {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+		req.TLS = state
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		handler(w, req)
+		require.NoError(t, w.Flush())
+		return buf.String()
+	}
+
+	// Test: An allowed verified certificate passes
+	res := serve(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert(t, "billing")}}})
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+
+	// Test: Anything else is forbidden
+	res = serve(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert(t, "mallory")}}})
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 403 Forbidden\r\n"), res)
+	// an unverified certificate does not count
+	res = serve(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert(t, "billing")}})
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 403 Forbidden\r\n"), res)
+	res = serve(nil)
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 403 Forbidden\r\n"), res)
+}
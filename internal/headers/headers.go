@@ -15,22 +15,32 @@ func NewHeaders() Headers {
 }
 
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+	n, _, done, err = h.ParseField(data)
+	return n, done, err
+}
+
+// ParseField is like Parse but also returns the lower-cased name of the
+// field it parsed, if any.
+func (h Headers) ParseField(data []byte) (n int, key string, done bool, err error) {
 	// Find of data have the crlf
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
-		return 0, done, nil
+		return 0, "", done, nil
 	}
 
 	// If it's at the start of the data, you've found the end of the headers, so return the proper values immediately.
 	if idx == 0 {
-		return idx + 2, true, nil
+		return idx + 2, "", true, nil
 	}
 
 	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
 
-	key := string(parts[0])
+	if len(parts) != 2 {
+		return 0, "", false, fmt.Errorf("invalid header line: missing colon")
+	}
+	key = string(parts[0])
 	if key != strings.TrimRight(key, " ") {
-		return 0, false, fmt.Errorf("invalid header name: %s", key)
+		return 0, "", false, fmt.Errorf("invalid header name: %s", key)
 	}
 
 	// Trim leading white spaces
@@ -39,11 +49,11 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 
 	// Validate field name
 	if err := validateFieldName(key); err != nil {
-		return 0, false, err
+		return 0, "", false, err
 	}
 
 	h.Set(key, string(value))
-	return idx + 2, false, nil
+	return idx + 2, strings.ToLower(key), false, nil
 }
 
 func (h Headers) Set(key, value string) {
@@ -110,6 +110,19 @@ func TestHeadersParse(t *testing.T) {
 	// assert.Equal(t, 0, n)
 	assert.False(t, done)
 	assert.Equal(t, "lane-loves-go, prime-loves-zig", headers["set-person"])
+
+	// Test: ParseField names the field it parsed
+	headers = NewHeaders()
+	n, key, done, err := headers.ParseField([]byte("HoSt: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 23, n)
+	assert.Equal(t, "host", key)
+	assert.False(t, done)
+
+	// Test: A line without a colon is an error
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("Host localhost\r\n\r\n"))
+	require.Error(t, err)
 }
 
 func TestHeaders_Get(t *testing.T) {
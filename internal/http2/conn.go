@@ -0,0 +1,1029 @@
+// Package http2 serves HTTP/2 (RFC 9113) connections: the connection
+// preface, the frame layer, HPACK, stream states, flow control and the
+// SETTINGS, PING and GOAWAY exchanges. Streams are answered by the same
+// handlers as HTTP/1.1 requests.
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp.haonguyen.tech/internal/http2/hpack"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// ClientPreface is what an HTTP/2 client sends before its first frame.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	defaultMaxConcurrentStreams = 100
+	defaultMaxHeaderListSize    = 64 << 10
+	defaultMaxBodySize          = 16 << 20
+	defaultWriteTimeout         = 30 * time.Second
+	// maxResetsPerSecond is how many streams a client may reset in a
+	// second before the connection is ended, as opening and resetting
+	// streams in a loop would otherwise keep the server busy for free
+	maxResetsPerSecond = 100
+	// initialWindowSize is the receive window of every stream and of the
+	// connection. Request bodies are buffered, up to MaxBodySize, so data
+	// is acknowledged as soon as it is.
+	initialWindowSize = 1 << 20
+)
+
+// Handler answers one stream. It has the same shape as server.Handler.
+type Handler func(w response.ResponseWriter, req *request.Request)
+
+// ErrAbortStream may be passed to panic by a handler that has sent part of
+// a response and cannot finish it. The stream is reset instead of ended,
+// so the client knows the response is incomplete; the panic is not logged.
+var ErrAbortStream = errors.New("http2: abort stream")
+
+// ErrUpgradeSettings is returned by DecodeUpgradeSettings for an
+// HTTP2-Settings header that does not decode to valid settings.
+var ErrUpgradeSettings = errors.New("http2: invalid HTTP2-Settings")
+
+var errStreamClosed = errors.New("http2: stream closed")
+
+// Config holds the limits of a Conn. Zero values pick the defaults.
+type Config struct {
+	// MaxConcurrentStreams is how many streams a client may have open at
+	// once, 100 by default. Streams it has reset count until their handlers
+	// return.
+	MaxConcurrentStreams uint32
+	// MaxHeaderListSize bounds the decoded size of a request's headers, as
+	// counted by HPACK, 64 KiB by default. Larger requests get 431.
+	MaxHeaderListSize uint32
+	// MaxBodySize bounds the request body buffered for a stream, 16 MiB by
+	// default. Requests declaring a larger Content-Length get 413; streams
+	// sending more are reset.
+	MaxBodySize int64
+	// IdleTimeout closes the connection once it has had no open streams
+	// for this long. Zero disables it.
+	IdleTimeout time.Duration
+	// WriteTimeout bounds each write to the connection, 30 seconds by
+	// default. A client that does not take a frame in time has its
+	// connection closed, so it cannot hold up the other streams.
+	WriteTimeout time.Duration
+	// Logger receives the connection's logs. If nil, slog.Default is used.
+	Logger *slog.Logger
+}
+
+type streamState int
+
+const (
+	// stateOpen streams are still receiving the request.
+	stateOpen streamState = iota
+	// stateHalfClosedRemote streams have the whole request and are being
+	// answered.
+	stateHalfClosedRemote
+	stateClosed
+)
+
+type stream struct {
+	id  uint32
+	req *request.Request
+	// declaredLength is the request's Content-Length, or -1
+	declaredLength int64
+	ctx            context.Context
+	cancel         context.CancelFunc
+
+	// state and sendWindow are guarded by Conn.mu
+	state      streamState
+	sendWindow int64
+	// recvWindow is only used by the read loop
+	recvWindow int64
+}
+
+// Conn is one HTTP/2 connection on the server side.
+type Conn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	handler Handler
+	config  Config
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// read loop state
+	readBuf         []byte
+	decoder         *hpack.Decoder
+	connRecvWindow  int64
+	contStream      uint32 // stream of an unfinished header block, or 0
+	headerBlock     []byte
+	headerEndStream bool
+	headerSelfDep   bool // the block's HEADERS made its stream depend on itself
+	handlers        sync.WaitGroup
+	resets          int       // streams the client reset since resetsSince
+	resetsSince     time.Time // start of the second resets counts in
+
+	mu   sync.Mutex
+	cond *sync.Cond // broadcast when send windows grow or streams close
+	// started is set once our SETTINGS are out, so GOAWAY may follow
+	started           bool
+	streams           map[uint32]*stream
+	maxStreamID       uint32
+	connSendWindow    int64
+	peerInitialWindow int64
+	peerMaxFrameSize  int
+	running           int // handlers that have not returned
+	goingAway         bool
+	closed            bool
+	idleTimer         *time.Timer
+
+	wmu     sync.Mutex // serializes writes, and the encoder with them
+	encoder *hpack.Encoder
+}
+
+// NewConn prepares to serve HTTP/2 on conn, reading through br, which may
+// already hold the client preface.
+func NewConn(conn net.Conn, br *bufio.Reader, handler Handler, config Config) *Conn {
+	if config.MaxConcurrentStreams == 0 {
+		config.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.MaxHeaderListSize == 0 {
+		config.MaxHeaderListSize = defaultMaxHeaderListSize
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultWriteTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		conn:              conn,
+		br:                br,
+		handler:           handler,
+		config:            config,
+		ctx:               ctx,
+		cancel:            cancel,
+		decoder:           hpack.NewDecoder(hpack.DefaultTableSize),
+		connRecvWindow:    initialWindowSize,
+		streams:           make(map[uint32]*stream),
+		connSendWindow:    defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		encoder:           hpack.NewEncoder(),
+	}
+	c.decoder.MaxStringLength = int(config.MaxHeaderListSize)
+	c.decoder.MaxHeaderListSize = int(config.MaxHeaderListSize)
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Serve reads the client preface and serves streams until the connection
+// ends, then waits for the handlers to return. Any read deadline on the
+// connection bounds the wait for the preface and is cleared after it. Serve
+// returns nil when the connection ended cleanly.
+func (c *Conn) Serve() error {
+	defer c.close()
+	if err := c.readPreface(); err != nil {
+		return err
+	}
+	if err := c.sendPreface(); err != nil {
+		return err
+	}
+	return c.serveFrames()
+}
+
+// DecodeUpgradeSettings decodes the HTTP2-Settings header of an h2c
+// upgrade request: base64url SETTINGS frame payload. Invalid settings are
+// an error wrapping ErrUpgradeSettings, and the upgrade must not happen.
+func DecodeUpgradeSettings(v string) ([]Setting, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpgradeSettings, err)
+	}
+	settings, err := parseSettings(Frame{FrameHeader: FrameHeader{Type: FrameSettings}, Payload: payload})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpgradeSettings, err)
+	}
+	for _, s := range settings {
+		if err := checkSetting(s); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUpgradeSettings, err)
+		}
+	}
+	return settings, nil
+}
+
+// ServeUpgrade is Serve for a connection that asked to switch with an
+// HTTP/1.1 "Upgrade: h2c" request (RFC 7540, section 3.2). req is that
+// request, fully read, and settings come from its HTTP2-Settings header;
+// see DecodeUpgradeSettings. ServeUpgrade answers 101 Switching Protocols,
+// serves req as stream 1 and then the connection as HTTP/2.
+func (c *Conn) ServeUpgrade(req *request.Request, settings []Setting) error {
+	defer c.close()
+	// the settings count as the client's first SETTINGS frame, with no ACK
+	for _, s := range settings {
+		if err := c.applySetting(s); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{"connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection"} {
+		req.Headers.Delete(name)
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	st := &stream{
+		id:             1,
+		req:            req.WithContext(ctx),
+		declaredLength: -1,
+		ctx:            ctx,
+		cancel:         cancel,
+		state:          stateHalfClosedRemote,
+		sendWindow:     c.peerInitialWindow,
+	}
+	c.mu.Lock()
+	c.streams[1] = st
+	c.maxStreamID = 1
+	c.mu.Unlock()
+
+	if err := c.write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")); err != nil {
+		return err
+	}
+	if err := c.sendPreface(); err != nil {
+		return err
+	}
+	c.startHandler(st, c.handler)
+	if err := c.readPreface(); err != nil {
+		return err
+	}
+	return c.serveFrames()
+}
+
+func (c *Conn) readPreface() error {
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(c.br, preface); err != nil {
+		return c.readError(err)
+	}
+	if string(preface) != ClientPreface {
+		return fmt.Errorf("http2: bad client preface %q", preface)
+	}
+	return c.conn.SetReadDeadline(time.Time{})
+}
+
+// sendPreface sends the server's connection preface: its SETTINGS.
+func (c *Conn) sendPreface() error {
+	settings := appendSettings(nil,
+		Setting{ID: SettingMaxConcurrentStreams, Value: c.config.MaxConcurrentStreams},
+		Setting{ID: SettingInitialWindowSize, Value: initialWindowSize},
+		Setting{ID: SettingMaxHeaderListSize, Value: c.config.MaxHeaderListSize},
+	)
+	// the connection window can only be raised with WINDOW_UPDATE
+	settings = appendWindowUpdate(settings, 0, initialWindowSize-defaultWindowSize)
+	if err := c.write(settings); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.started = true
+	goingAway := c.goingAway
+	if c.config.IdleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(c.config.IdleTimeout, c.idleExpired)
+		if len(c.streams) > 0 {
+			c.idleTimer.Stop()
+		}
+	}
+	c.mu.Unlock()
+	if goingAway {
+		c.sendGoAway()
+	}
+	return nil
+}
+
+// serveFrames is the read loop.
+func (c *Conn) serveFrames() error {
+	for first := true; ; first = false {
+		f, buf, err := ReadFrame(c.br, c.readBuf, defaultMaxFrameSize)
+		c.readBuf = buf
+		if err == nil {
+			if first && (f.Type != FrameSettings || f.Flags.Has(FlagAck)) {
+				err = connError(ErrCodeProtocol, "expected SETTINGS, got %s", f.Type)
+			} else {
+				err = c.processFrame(f)
+			}
+		}
+		var se StreamError
+		var ce ConnectionError
+		switch {
+		case err == nil:
+		case errors.As(err, &se):
+			c.resetStream(se.StreamID, se.Code)
+		case errors.As(err, &ce):
+			c.abort(ce)
+			return ce
+		default:
+			return c.readError(err)
+		}
+	}
+}
+
+// readError turns the error that ended the read loop into Serve's result.
+func (c *Conn) readError(err error) error {
+	c.mu.Lock()
+	closing := c.goingAway
+	c.mu.Unlock()
+	if errors.Is(err, io.EOF) || (closing && errors.Is(err, net.ErrClosed)) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully ends the connection: it sends GOAWAY so the client
+// opens no more streams, and closes the connection once the open ones are
+// answered.
+func (c *Conn) Shutdown() {
+	c.mu.Lock()
+	if c.goingAway || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.goingAway = true
+	started := c.started
+	c.mu.Unlock()
+	// before our SETTINGS are out, Serve sends the GOAWAY after them
+	if started {
+		c.sendGoAway()
+	}
+}
+
+func (c *Conn) sendGoAway() {
+	c.mu.Lock()
+	last := c.maxStreamID
+	c.mu.Unlock()
+	if err := c.write(appendGoAway(nil, last, ErrCodeNo, "")); err != nil {
+		c.config.Logger.Error("sending GOAWAY", "err", err)
+	}
+	c.closeIfDone()
+}
+
+// abort ends the connection after a connection error.
+func (c *Conn) abort(err ConnectionError) {
+	c.mu.Lock()
+	c.goingAway = true
+	last := c.maxStreamID
+	c.mu.Unlock()
+	c.config.Logger.Warn("HTTP/2 connection error", "err", err)
+	if werr := c.write(appendGoAway(nil, last, err.Code, err.Reason)); werr != nil {
+		c.config.Logger.Error("sending GOAWAY", "err", werr)
+	}
+}
+
+// closeIfDone closes the connection if it is going away and no stream is
+// left, which ends the read loop.
+func (c *Conn) closeIfDone() {
+	c.mu.Lock()
+	done := c.goingAway && len(c.streams) == 0
+	c.mu.Unlock()
+	if done {
+		if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			c.config.Logger.Error("closing connection", "err", err)
+		}
+	}
+}
+
+func (c *Conn) idleExpired() {
+	c.mu.Lock()
+	idle := len(c.streams) == 0
+	c.mu.Unlock()
+	if idle {
+		c.Shutdown()
+	}
+}
+
+func (c *Conn) close() {
+	c.mu.Lock()
+	c.closed = true
+	for _, st := range c.streams {
+		c.closeStreamLocked(st)
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.cancel()
+	if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.config.Logger.Error("closing connection", "err", err)
+	}
+	c.handlers.Wait()
+}
+
+// write sends already framed bytes.
+func (c *Conn) write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.writeLocked(b)
+	return err
+}
+
+// writeLocked writes b to the connection within WriteTimeout. Once a write
+// times out nothing more can be framed after it, so the connection is
+// closed, which also ends the read loop. c.wmu must be held.
+func (c *Conn) writeLocked(b []byte) (int, error) {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.conn.Write(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.config.Logger.Warn("HTTP/2 write timed out, closing connection")
+		if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			c.config.Logger.Error("closing connection", "err", err)
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) processFrame(f Frame) error {
+	if c.contStream != 0 && (f.Type != FrameContinuation || f.StreamID != c.contStream) {
+		return connError(ErrCodeProtocol, "%s frame in the middle of a header block", f.Type)
+	}
+	switch f.Type {
+	case FrameData:
+		return c.processData(f)
+	case FrameHeaders:
+		return c.processHeaders(f)
+	case FrameContinuation:
+		return c.processContinuation(f)
+	case FramePriority:
+		return c.processPriority(f)
+	case FrameRSTStream:
+		return c.processRSTStream(f)
+	case FrameSettings:
+		return c.processSettings(f)
+	case FramePing:
+		return c.processPing(f)
+	case FrameGoAway:
+		return c.processGoAway(f)
+	case FrameWindowUpdate:
+		return c.processWindowUpdate(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "clients cannot push")
+	default:
+		// unknown frame types are ignored
+		return nil
+	}
+}
+
+func (c *Conn) processHeaders(f Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream 0")
+	}
+	block, dependsOn, err := headersPayload(f)
+	if err != nil {
+		return err
+	}
+	c.headerBlock = append(c.headerBlock[:0], block...)
+	c.headerEndStream = f.Flags.Has(FlagEndStream)
+	// the block must still be decoded to keep HPACK in step, so the stream
+	// fails once it is
+	c.headerSelfDep = f.Flags.Has(FlagPriority) && dependsOn == f.StreamID
+	if !f.Flags.Has(FlagEndHeaders) {
+		c.contStream = f.StreamID
+		return c.checkHeaderBlockSize()
+	}
+	return c.processHeaderBlock(f.StreamID)
+}
+
+func (c *Conn) processContinuation(f Frame) error {
+	if c.contStream == 0 {
+		return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+	}
+	c.headerBlock = append(c.headerBlock, f.Payload...)
+	if !f.Flags.Has(FlagEndHeaders) {
+		return c.checkHeaderBlockSize()
+	}
+	c.contStream = 0
+	return c.processHeaderBlock(f.StreamID)
+}
+
+// checkHeaderBlockSize stops a client sending CONTINUATION frames forever.
+// Decoding can only shrink a block so much, so one far beyond the header
+// list limit is refused without being decoded.
+func (c *Conn) checkHeaderBlockSize() error {
+	if len(c.headerBlock) > 4*int(c.config.MaxHeaderListSize) {
+		return connError(ErrCodeEnhanceYourCalm, "header block of more than %d bytes", len(c.headerBlock))
+	}
+	return nil
+}
+
+func (c *Conn) processHeaderBlock(id uint32) error {
+	fields, err := c.decoder.Decode(c.headerBlock)
+	tooLarge := errors.Is(err, hpack.ErrHeaderListSize)
+	if err != nil && !tooLarge {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	c.mu.Lock()
+	st := c.streams[id]
+	if st != nil {
+		c.mu.Unlock()
+		if c.headerSelfDep {
+			return streamError(id, ErrCodeProtocol, "stream depends on itself")
+		}
+		return c.processTrailers(st, fields, tooLarge)
+	}
+	if id%2 == 0 {
+		c.mu.Unlock()
+		return connError(ErrCodeProtocol, "client opened even stream %d", id)
+	}
+	if id <= c.maxStreamID {
+		c.mu.Unlock()
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", id)
+	}
+	c.maxStreamID = id
+	if c.goingAway {
+		// streams past the GOAWAY are ignored
+		c.mu.Unlock()
+		return nil
+	}
+	if c.headerSelfDep {
+		c.mu.Unlock()
+		return streamError(id, ErrCodeProtocol, "stream depends on itself")
+	}
+	if len(c.streams) >= int(c.config.MaxConcurrentStreams) || c.running >= int(c.config.MaxConcurrentStreams) {
+		c.mu.Unlock()
+		return streamError(id, ErrCodeRefusedStream, "too many concurrent streams")
+	}
+	c.mu.Unlock()
+
+	req, declaredLength, handler, err := c.newRequest(id, fields, tooLarge)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	st = &stream{
+		id:             id,
+		req:            req.WithContext(ctx),
+		declaredLength: declaredLength,
+		ctx:            ctx,
+		cancel:         cancel,
+		recvWindow:     initialWindowSize,
+	}
+
+	c.mu.Lock()
+	st.sendWindow = c.peerInitialWindow
+	c.streams[id] = st
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	if c.headerEndStream {
+		return c.endRequest(st, handler)
+	}
+	if handler != nil {
+		// a request that is refused outright is answered without waiting
+		// for its body
+		c.startHandler(st, handler)
+	}
+	return nil
+}
+
+func (c *Conn) processTrailers(st *stream, fields []hpack.HeaderField, tooLarge bool) error {
+	c.mu.Lock()
+	state := st.state
+	c.mu.Unlock()
+	if state != stateOpen {
+		return streamError(st.id, ErrCodeStreamClosed, "HEADERS on half-closed stream")
+	}
+	if !c.headerEndStream {
+		return streamError(st.id, ErrCodeProtocol, "trailers without END_STREAM")
+	}
+	if tooLarge {
+		return streamError(st.id, ErrCodeEnhanceYourCalm, "trailers over the header list limit")
+	}
+	trailers, err := trailerFields(st.id, fields)
+	if err != nil {
+		return err
+	}
+	st.req.Trailers = trailers
+	return c.endRequest(st, nil)
+}
+
+// endRequest checks a complete request and starts its handler.
+func (c *Conn) endRequest(st *stream, handler Handler) error {
+	if st.declaredLength >= 0 && int64(len(st.req.Body)) != st.declaredLength {
+		return streamError(st.id, ErrCodeProtocol, "body of %d bytes, content-length %d", len(st.req.Body), st.declaredLength)
+	}
+	c.mu.Lock()
+	st.state = stateHalfClosedRemote
+	c.mu.Unlock()
+	if handler == nil {
+		handler = c.handler
+	}
+	c.startHandler(st, handler)
+	return nil
+}
+
+func (c *Conn) processData(f Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	data, err := dataPayload(f)
+	if err != nil {
+		return err
+	}
+	// padding counts against the window too
+	n := int64(len(f.Payload))
+	if n > c.connRecvWindow {
+		return connError(ErrCodeFlowControl, "DATA beyond the connection window")
+	}
+	c.connRecvWindow -= n
+
+	c.mu.Lock()
+	st := c.streams[f.StreamID]
+	idle := f.StreamID > c.maxStreamID
+	open := st != nil && st.state == stateOpen
+	c.mu.Unlock()
+	if idle {
+		return connError(ErrCodeProtocol, "DATA on idle stream %d", f.StreamID)
+	}
+	if !open {
+		// the data is dropped, but the connection window must not shrink
+		if err := c.sendWindowUpdates(nil, n); err != nil {
+			return err
+		}
+		return streamError(f.StreamID, ErrCodeStreamClosed, "DATA on closed stream")
+	}
+	if n > st.recvWindow {
+		if err := c.sendWindowUpdates(nil, n); err != nil {
+			return err
+		}
+		return streamError(f.StreamID, ErrCodeFlowControl, "DATA beyond the stream window")
+	}
+	st.recvWindow -= n
+
+	st.req.Body = append(st.req.Body, data...)
+	if st.declaredLength >= 0 && int64(len(st.req.Body)) > st.declaredLength {
+		if err := c.sendWindowUpdates(nil, n); err != nil {
+			return err
+		}
+		return streamError(f.StreamID, ErrCodeProtocol, "body longer than content-length %d", st.declaredLength)
+	}
+	if int64(len(st.req.Body)) > c.config.MaxBodySize {
+		if err := c.sendWindowUpdates(nil, n); err != nil {
+			return err
+		}
+		return streamError(f.StreamID, ErrCodeEnhanceYourCalm, "body over %d bytes", c.config.MaxBodySize)
+	}
+	// the data is buffered, so it is acknowledged at once; the stream's
+	// window is only given back while more may follow
+	endStream := f.Flags.Has(FlagEndStream)
+	refund := st
+	if endStream {
+		refund = nil
+	}
+	if err := c.sendWindowUpdates(refund, n); err != nil {
+		return err
+	}
+	if endStream {
+		return c.endRequest(st, nil)
+	}
+	return nil
+}
+
+// sendWindowUpdates gives back n bytes of window to the connection, and to
+// st unless it is nil.
+func (c *Conn) sendWindowUpdates(st *stream, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	c.connRecvWindow += n
+	b := appendWindowUpdate(nil, 0, uint32(n))
+	if st != nil {
+		st.recvWindow += n
+		b = appendWindowUpdate(b, st.id, uint32(n))
+	}
+	return c.write(b)
+}
+
+func (c *Conn) processPriority(f Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+	}
+	if len(f.Payload) != 5 {
+		return streamError(f.StreamID, ErrCodeFrameSize, "PRIORITY of %d bytes", len(f.Payload))
+	}
+	if binary.BigEndian.Uint32(f.Payload)&(1<<31-1) == f.StreamID {
+		return streamError(f.StreamID, ErrCodeProtocol, "stream depends on itself")
+	}
+	// priorities are advisory and not acted on
+	return nil
+}
+
+func (c *Conn) processRSTStream(f Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM of %d bytes", len(f.Payload))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.StreamID > c.maxStreamID {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.StreamID)
+	}
+	st := c.streams[f.StreamID]
+	if st == nil {
+		return nil
+	}
+	c.closeStreamLocked(st)
+	if now := time.Now(); now.Sub(c.resetsSince) > time.Second {
+		c.resets, c.resetsSince = 0, now
+	}
+	if c.resets++; c.resets > maxResetsPerSecond {
+		return connError(ErrCodeEnhanceYourCalm, "more than %d streams reset in a second", maxResetsPerSecond)
+	}
+	return nil
+}
+
+func (c *Conn) processSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.StreamID)
+	}
+	if f.Flags.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return nil
+	}
+	settings, err := parseSettings(f)
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		if err := c.applySetting(s); err != nil {
+			return err
+		}
+	}
+	return c.write(appendFrame(nil, FrameSettings, FlagAck, 0, nil))
+}
+
+// checkSetting rejects values outside what RFC 9113 allows.
+func checkSetting(s Setting) error {
+	switch {
+	case s.ID == SettingEnablePush && s.Value > 1:
+		return connError(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH of %d", s.Value)
+	case s.ID == SettingInitialWindowSize && s.Value > maxWindowSize:
+		return connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE of %d", s.Value)
+	case s.ID == SettingMaxFrameSize && (s.Value < defaultMaxFrameSize || s.Value > maxMaxFrameSize):
+		return connError(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE of %d", s.Value)
+	}
+	return nil
+}
+
+func (c *Conn) applySetting(s Setting) error {
+	if err := checkSetting(s); err != nil {
+		return err
+	}
+	switch s.ID {
+	case SettingHeaderTableSize:
+		c.wmu.Lock()
+		c.encoder.SetMaxTableSize(int(s.Value))
+		c.wmu.Unlock()
+	case SettingInitialWindowSize:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// the change applies to the windows of open streams, which may go
+		// negative
+		delta := int64(s.Value) - c.peerInitialWindow
+		c.peerInitialWindow = int64(s.Value)
+		for _, st := range c.streams {
+			st.sendWindow += delta
+			if st.sendWindow > maxWindowSize {
+				return connError(ErrCodeFlowControl, "stream %d window overflows", st.id)
+			}
+		}
+		c.cond.Broadcast()
+	case SettingMaxFrameSize:
+		c.mu.Lock()
+		c.peerMaxFrameSize = int(s.Value)
+		c.mu.Unlock()
+	}
+	// SETTINGS_MAX_CONCURRENT_STREAMS only limits pushes, which are never
+	// sent, and unknown settings are ignored
+	return nil
+}
+
+func (c *Conn) processPing(f Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "PING on stream %d", f.StreamID)
+	}
+	if len(f.Payload) != 8 {
+		return connError(ErrCodeFrameSize, "PING of %d bytes", len(f.Payload))
+	}
+	if f.Flags.Has(FlagAck) {
+		return nil
+	}
+	return c.write(appendFrame(nil, FramePing, FlagAck, 0, f.Payload))
+}
+
+func (c *Conn) processGoAway(f Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.StreamID)
+	}
+	if len(f.Payload) < 8 {
+		return connError(ErrCodeFrameSize, "GOAWAY of %d bytes", len(f.Payload))
+	}
+	if code := ErrCode(binary.BigEndian.Uint32(f.Payload[4:])); code != ErrCodeNo {
+		c.config.Logger.Warn("client sent GOAWAY", "code", code.String(), "debug", string(f.Payload[8:]))
+	}
+	// the client opens no more streams; finish the ones it has
+	c.mu.Lock()
+	c.goingAway = true
+	c.mu.Unlock()
+	c.closeIfDone()
+	return nil
+}
+
+func (c *Conn) processWindowUpdate(f Frame) error {
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE of %d bytes", len(f.Payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		c.connSendWindow += increment
+		if c.connSendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window overflows")
+		}
+		c.cond.Broadcast()
+		return nil
+	}
+	if f.StreamID > c.maxStreamID {
+		return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.StreamID)
+	}
+	st := c.streams[f.StreamID]
+	if st == nil {
+		return nil
+	}
+	if increment == 0 {
+		return streamError(f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError(f.StreamID, ErrCodeFlowControl, "stream window overflows")
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// resetStream sends RST_STREAM and forgets the stream.
+func (c *Conn) resetStream(id uint32, code ErrCode) {
+	c.mu.Lock()
+	if st := c.streams[id]; st != nil {
+		c.closeStreamLocked(st)
+	}
+	c.mu.Unlock()
+	if err := c.write(appendRSTStream(nil, id, code)); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.config.Logger.Error("sending RST_STREAM", "stream", id, "err", err)
+	}
+	c.closeIfDone()
+}
+
+// closeStreamLocked moves st to closed, cancelling its context and waking
+// writers waiting on its window. c.mu must be held.
+func (c *Conn) closeStreamLocked(st *stream) {
+	if st.state == stateClosed {
+		return
+	}
+	st.state = stateClosed
+	st.cancel()
+	delete(c.streams, st.id)
+	if len(c.streams) == 0 && c.idleTimer != nil && !c.closed {
+		c.idleTimer.Reset(c.config.IdleTimeout)
+	}
+	c.cond.Broadcast()
+}
+
+func (c *Conn) startHandler(st *stream, handler Handler) {
+	c.mu.Lock()
+	c.running++
+	c.mu.Unlock()
+	c.handlers.Add(1)
+	go c.runHandler(st, handler)
+}
+
+func (c *Conn) runHandler(st *stream, handler Handler) {
+	defer c.handlers.Done()
+	defer func() {
+		c.mu.Lock()
+		c.running--
+		c.mu.Unlock()
+	}()
+	w := newResponseWriter(c, st)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if recovered != ErrAbortStream {
+				c.config.Logger.Error("panic serving stream", "stream", st.id, "panic", recovered)
+			}
+			c.resetStream(st.id, ErrCodeInternal)
+			return
+		}
+		c.mu.Lock()
+		reset := st.state == stateClosed
+		c.mu.Unlock()
+		if reset {
+			// the client gave up on the stream; there is nobody to answer
+			return
+		}
+		if err := w.Finish(); err != nil {
+			if !errors.Is(err, errStreamClosed) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				c.config.Logger.Error("finishing stream", "stream", st.id, "err", err)
+			}
+			c.resetStream(st.id, ErrCodeInternal)
+			return
+		}
+		c.mu.Lock()
+		c.closeStreamLocked(st)
+		c.mu.Unlock()
+		c.closeIfDone()
+	}()
+	handler(w, st.req)
+}
+
+// writeHeaders sends a header block on st.
+func (c *Conn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) (int, error) {
+	c.mu.Lock()
+	if st.state == stateClosed || c.closed {
+		c.mu.Unlock()
+		return 0, errStreamClosed
+	}
+	maxFrameSize := c.peerMaxFrameSize
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// encoding and writing happen together, so blocks reach the client in
+	// the order the encoder's table saw them
+	block := c.encoder.Encode(nil, fields)
+	b := appendHeaderBlock(nil, st.id, block, endStream, maxFrameSize)
+	return c.writeLocked(b)
+}
+
+// writeData sends p on st as DATA frames, waiting for flow-control window
+// as needed, and ends the stream if endStream is set. It returns the bytes
+// written to the connection.
+func (c *Conn) writeData(st *stream, p []byte, endStream bool) (int, error) {
+	written := 0
+	for {
+		c.mu.Lock()
+		n := 0
+		for len(p) > 0 {
+			if st.state == stateClosed || c.closed {
+				break
+			}
+			n = min(len(p), c.peerMaxFrameSize, int(min(c.connSendWindow, st.sendWindow)))
+			if n > 0 {
+				break
+			}
+			c.cond.Wait()
+		}
+		if st.state == stateClosed || c.closed {
+			c.mu.Unlock()
+			return written, errStreamClosed
+		}
+		c.connSendWindow -= int64(n)
+		st.sendWindow -= int64(n)
+		c.mu.Unlock()
+
+		chunk := p[:n]
+		p = p[n:]
+		var flags Flags
+		if endStream && len(p) == 0 {
+			flags = FlagEndStream
+		}
+		if n == 0 && flags == 0 {
+			return written, nil
+		}
+		m, err := c.writeFrame(FrameData, flags, st.id, chunk)
+		written += m
+		if err != nil || len(p) == 0 {
+			return written, err
+		}
+	}
+}
+
+func (c *Conn) writeFrame(typ FrameType, flags Flags, id uint32, payload []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeLocked(appendFrame(nil, typ, flags, id, payload))
+}
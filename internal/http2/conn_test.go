@@ -0,0 +1,778 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/http2/hpack"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// echoHandler answers with the method, target and body of the request.
+func echoHandler(w response.ResponseWriter, req *request.Request) {
+	body := fmt.Sprintf("%s %s %s", req.RequestLine.Method, req.RequestLine.RequestTarget, req.Body)
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody([]byte(body))
+}
+
+// startConns serves HTTP/2 on a local listener, one Conn per connection,
+// and returns its address and the Conns served so far.
+func startConns(t *testing.T, handler Handler, config Config) (string, func() []*Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var mu sync.Mutex
+	var conns []*Conn
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = listener.Close()
+		mu.Lock()
+		for _, c := range conns {
+			_ = c.conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c := NewConn(conn, bufio.NewReader(conn), handler, config)
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = c.Serve()
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() []*Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*Conn(nil), conns...)
+	}
+}
+
+// h2cClient speaks HTTP/2 without TLS, with prior knowledge.
+func h2cClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Transport: &http.Transport{Protocols: &protocols},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func TestNetHTTPClient(t *testing.T) {
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		switch req.Path() {
+		case "/big":
+			// larger than the initial windows, so it takes WINDOW_UPDATEs
+			body := strings.Repeat("0123456789abcdef", 20000)
+			_ = w.WriteStatusLine(response.StatusOK)
+			_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			_, _ = w.WriteBody([]byte(body))
+		case "/trailers":
+			_ = w.WriteStatusLine(response.StatusOK)
+			_ = w.WriteHeaders(headers.Headers{"trailer": "x-checksum", "transfer-encoding": "chunked"})
+			_, _ = w.WriteChunkedBody([]byte("part one, "))
+			_ = response.Flush(w)
+			_, _ = w.WriteChunkedBody([]byte("part two"))
+			_, _ = w.WriteChunkedBodyDone()
+			_ = w.WriteTrailers(headers.Headers{"x-checksum": "abc"})
+		case "/headers":
+			cookie, _ := req.Headers.Get("cookie")
+			host, _ := req.Headers.Get("host")
+			body := cookie + "|" + host
+			_ = w.WriteStatusLine(response.StatusOK)
+			_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			_, _ = w.WriteBody([]byte(body))
+		default:
+			echoHandler(w, req)
+		}
+	}, Config{})
+	client := h2cClient()
+	base := "http://" + addr
+
+	resp, err := client.Post(base+"/echo?x=1", "text/plain", strings.NewReader("ping"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "POST /echo?x=1 ping", string(body))
+	// the Connection header of the default headers is dropped
+	assert.Empty(t, resp.Header.Get("Connection"))
+
+	resp, err = client.Get(base + "/big")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, strings.Repeat("0123456789abcdef", 20000), string(body))
+
+	resp, err = client.Get(base + "/trailers")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "part one, part two", string(body))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+
+	req, err := http.NewRequest("GET", base+"/headers", nil)
+	require.NoError(t, err)
+	req.Header.Add("Cookie", "a=1")
+	req.AddCookie(&http.Cookie{Name: "b", Value: "2"})
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "a=1; b=2|"+addr, string(body))
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	// every handler waits until all of them are running, which only works
+	// if the streams are served concurrently
+	const n = 10
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	addr, conns := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		if req.Path() != "/warmup" {
+			arrived.Done()
+			arrived.Wait()
+		}
+		echoHandler(w, req)
+	}, Config{})
+	client := h2cClient()
+	// with a connection already up the client sends every request on it
+	resp, err := client.Get("http://" + addr + "/warmup")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(fmt.Sprintf("http://%s/%d", addr, i))
+			if !assert.NoError(t, err) {
+				arrived.Done()
+				return
+			}
+			b, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			bodies[i] = string(b)
+		}()
+	}
+	wg.Wait()
+	for i, b := range bodies {
+		assert.Equal(t, fmt.Sprintf("GET /%d ", i), b)
+	}
+	assert.Len(t, conns(), 1)
+}
+
+// rawClient drives a connection frame by frame.
+type rawClient struct {
+	t       *testing.T
+	conn    net.Conn
+	br      *bufio.Reader
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+}
+
+// dialRaw connects, sends the preface with settings, and reads the server's
+// SETTINGS and connection WINDOW_UPDATE.
+func dialRaw(t *testing.T, addr string, settings ...Setting) *rawClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := &rawClient{t: t, conn: conn, br: bufio.NewReader(conn), encoder: hpack.NewEncoder(), decoder: hpack.NewDecoder(hpack.DefaultTableSize)}
+	c.write(append([]byte(ClientPreface), appendSettings(nil, settings...)...))
+
+	f := c.read()
+	require.Equal(t, FrameSettings, f.Type)
+	require.False(t, f.Flags.Has(FlagAck))
+	require.Equal(t, FrameWindowUpdate, c.read().Type)
+	// the ACK of our settings
+	f = c.read()
+	require.Equal(t, FrameSettings, f.Type)
+	require.True(t, f.Flags.Has(FlagAck))
+	return c
+}
+
+func (c *rawClient) write(b []byte) {
+	_, err := c.conn.Write(b)
+	require.NoError(c.t, err)
+}
+
+func (c *rawClient) read() Frame {
+	c.t.Helper()
+	f, _, err := ReadFrame(c.br, nil, maxMaxFrameSize)
+	require.NoError(c.t, err)
+	return f
+}
+
+// readSkipping reads the next frame that is not a WINDOW_UPDATE.
+func (c *rawClient) readSkipping() Frame {
+	c.t.Helper()
+	for {
+		if f := c.read(); f.Type != FrameWindowUpdate {
+			return f
+		}
+	}
+}
+
+func (c *rawClient) headers(id uint32, endStream bool, fields ...string) {
+	var list []hpack.HeaderField
+	for i := 0; i < len(fields); i += 2 {
+		list = append(list, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	c.write(appendHeaderBlock(nil, id, c.encoder.Encode(nil, list), endStream, defaultMaxFrameSize))
+}
+
+func (c *rawClient) get(id uint32, path string) {
+	c.headers(id, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "example.com")
+}
+
+func (c *rawClient) decode(f Frame) map[string]string {
+	c.t.Helper()
+	fields, err := c.decoder.Decode(f.Payload)
+	require.NoError(c.t, err)
+	m := make(map[string]string)
+	for _, f := range fields {
+		m[f.Name] = f.Value
+	}
+	return m
+}
+
+func (c *rawClient) expectRST(id uint32, code ErrCode) {
+	c.t.Helper()
+	f := c.readSkipping()
+	require.Equal(c.t, FrameRSTStream, f.Type, "got %s", f.Type)
+	assert.Equal(c.t, id, f.StreamID)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+}
+
+func (c *rawClient) expectGoAway(code ErrCode) {
+	c.t.Helper()
+	f := c.readSkipping()
+	require.Equal(c.t, FrameGoAway, f.Type, "got %s", f.Type)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+}
+
+func TestPing(t *testing.T) {
+	addr, _ := startConns(t, echoHandler, Config{})
+	c := dialRaw(t, addr)
+	c.write(appendFrame(nil, FramePing, 0, 0, []byte("12345678")))
+	f := c.read()
+	assert.Equal(t, FramePing, f.Type)
+	assert.True(t, f.Flags.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+}
+
+func TestSmallResponseFrames(t *testing.T) {
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusNoContent)
+		_ = w.WriteHeaders(headers.Headers{"X-Kind": "empty"})
+	}, Config{})
+	c := dialRaw(t, addr)
+	c.get(1, "/")
+
+	// an empty response is a single HEADERS frame with END_STREAM
+	f := c.read()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.True(t, f.Flags.Has(FlagEndStream|FlagEndHeaders))
+	assert.Equal(t, map[string]string{":status": "204", "x-kind": "empty"}, c.decode(f))
+}
+
+func TestFlowControl(t *testing.T) {
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(headers.NewHeaders())
+		_, _ = w.WriteBody([]byte("0123456789abcdef"))
+	}, Config{})
+	c := dialRaw(t, addr, Setting{ID: SettingInitialWindowSize, Value: 10})
+	c.get(1, "/")
+
+	require.Equal(t, FrameHeaders, c.read().Type)
+	f := c.read()
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, "0123456789", string(f.Payload))
+	assert.False(t, f.Flags.Has(FlagEndStream))
+
+	// nothing more until the window opens
+	require.NoError(t, c.conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err := c.br.Peek(1)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	c.write(appendWindowUpdate(nil, 1, 100))
+	f = c.read()
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, "abcdef", string(f.Payload))
+	assert.True(t, f.Flags.Has(FlagEndStream))
+}
+
+func TestRequestBody(t *testing.T) {
+	addr, _ := startConns(t, echoHandler, Config{})
+	c := dialRaw(t, addr)
+	c.headers(1, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "5")
+	c.write(appendFrame(nil, FrameData, 0, 1, []byte("he")))
+	// the data is acknowledged for the connection and the stream
+	for _, id := range []uint32{0, 1} {
+		f := c.read()
+		require.Equal(t, FrameWindowUpdate, f.Type)
+		assert.Equal(t, id, f.StreamID)
+		assert.Equal(t, uint32(2), binary.BigEndian.Uint32(f.Payload))
+	}
+	// trailers end the request
+	c.write(appendFrame(nil, FrameData, 0, 1, []byte("llo")))
+	c.headers(1, true, "x-trailer", "yes")
+
+	f := c.readSkipping()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, "200", c.decode(f)[":status"])
+	f = c.readSkipping()
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, "POST / hello", string(f.Payload))
+}
+
+func TestRequestBodyTooLarge(t *testing.T) {
+	addr, _ := startConns(t, echoHandler, Config{MaxBodySize: 10})
+	c := dialRaw(t, addr)
+
+	// Test: A body past the limit resets its stream
+	c.headers(1, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	c.write(appendFrame(nil, FrameData, 0, 1, []byte("012345")))
+	c.write(appendFrame(nil, FrameData, 0, 1, []byte("6789ab")))
+	c.expectRST(1, ErrCodeEnhanceYourCalm)
+
+	// Test: One declared past it is answered 413 without waiting for it
+	c.headers(3, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "11")
+	f := c.readSkipping()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, uint32(3), f.StreamID)
+	assert.Equal(t, "413", c.decode(f)[":status"])
+}
+
+func TestStreamErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+	}{
+		{"uppercase name", []string{":method", "GET", ":scheme", "http", ":path", "/", "X-Upper", "1"}},
+		{"missing path", []string{":method", "GET", ":scheme", "http"}},
+		{"unknown pseudo-header", []string{":method", "GET", ":scheme", "http", ":path", "/", ":protocol", "x"}},
+		{"pseudo-header after field", []string{":method", "GET", ":scheme", "http", "accept", "*/*", ":path", "/"}},
+		{"connection header", []string{":method", "GET", ":scheme", "http", ":path", "/", "connection", "close"}},
+		{"te", []string{":method", "GET", ":scheme", "http", ":path", "/", "te", "gzip"}},
+		{"content-length mismatch", []string{":method", "GET", ":scheme", "http", ":path", "/", "content-length", "3"}},
+	}
+	addr, _ := startConns(t, echoHandler, Config{})
+	c := dialRaw(t, addr)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.t = t
+			id := uint32(2*i + 1)
+			c.headers(id, true, tt.fields...)
+			c.expectRST(id, ErrCodeProtocol)
+		})
+	}
+
+	// the connection is still usable
+	c.t = t
+	c.get(101, "/ok")
+	f := c.readSkipping()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, "200", c.decode(f)[":status"])
+}
+
+func TestConnectionErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		code  ErrCode
+	}{
+		{"DATA on stream 0", appendFrame(nil, FrameData, 0, 0, []byte("x")), ErrCodeProtocol},
+		{"DATA on idle stream", appendFrame(nil, FrameData, 0, 7, []byte("x")), ErrCodeProtocol},
+		{"even stream", appendFrame(nil, FrameHeaders, FlagEndHeaders|FlagEndStream, 2, []byte{0x82}), ErrCodeProtocol},
+		{"bad HPACK", appendFrame(nil, FrameHeaders, FlagEndHeaders|FlagEndStream, 1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}), ErrCodeCompression},
+		{"short PING", appendFrame(nil, FramePing, 0, 0, []byte("1234")), ErrCodeFrameSize},
+		{"zero WINDOW_UPDATE", appendWindowUpdate(nil, 0, 0), ErrCodeProtocol},
+		{"window overflow", appendWindowUpdate(nil, 0, maxWindowSize), ErrCodeFlowControl},
+		{"small max frame size", appendSettings(nil, Setting{ID: SettingMaxFrameSize, Value: 100}), ErrCodeProtocol},
+		{"PUSH_PROMISE", appendFrame(nil, FramePushPromise, FlagEndHeaders, 1, []byte{0, 0, 0, 2}), ErrCodeProtocol},
+		{"interrupted header block", append(
+			appendFrame(nil, FrameHeaders, 0, 1, []byte{0x82}),
+			appendFrame(nil, FramePing, 0, 0, []byte("12345678"))...), ErrCodeProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := startConns(t, echoHandler, Config{})
+			c := dialRaw(t, addr)
+			c.write(tt.frame)
+			c.expectGoAway(tt.code)
+			_, err := c.br.ReadByte()
+			assert.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	addr, _ := startConns(t, echoHandler, Config{MaxConcurrentStreams: 1})
+	c := dialRaw(t, addr)
+	// stream 1 stays open waiting for its body
+	c.headers(1, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	c.get(3, "/")
+	c.expectRST(3, ErrCodeRefusedStream)
+
+	c.write(appendFrame(nil, FrameData, FlagEndStream, 1, nil))
+	f := c.readSkipping()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, uint32(1), f.StreamID)
+}
+
+func TestResetStreamsCount(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	called := 0
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		mu.Lock()
+		called++
+		mu.Unlock()
+		if req.RequestLine.RequestTarget == "/block" {
+			// takes no notice of the reset
+			<-release
+		}
+		echoHandler(w, req)
+	}, Config{MaxConcurrentStreams: 2})
+	c := dialRaw(t, addr)
+
+	// Test: Streams the client reset still count while their handlers run
+	c.get(1, "/block")
+	c.write(appendRSTStream(nil, 1, ErrCodeCancel))
+	c.get(3, "/block")
+	c.write(appendRSTStream(nil, 3, ErrCodeCancel))
+	c.get(5, "/block")
+	c.expectRST(5, ErrCodeRefusedStream)
+	mu.Lock()
+	assert.Equal(t, 2, called)
+	mu.Unlock()
+
+	// Test: And stop counting once they return
+	close(release)
+	for id := uint32(7); ; id += 2 {
+		require.Less(t, id, uint32(1000), "streams still refused")
+		c.get(id, "/")
+		if f := c.readSkipping(); f.Type == FrameHeaders {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRapidReset(t *testing.T) {
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		<-req.Context().Done()
+	}, Config{MaxConcurrentStreams: 1000})
+	c := dialRaw(t, addr)
+
+	// Test: A client resetting streams as fast as it opens them is told to
+	// calm down and cut off
+	var b []byte
+	for id := uint32(1); id <= 2*maxResetsPerSecond+1; id += 2 {
+		b = appendHeaderBlock(b, id, c.encoder.Encode(nil, []hpack.HeaderField{
+			{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"},
+		}), true, defaultMaxFrameSize)
+		b = appendRSTStream(b, id, ErrCodeCancel)
+	}
+	c.write(b)
+	c.expectGoAway(ErrCodeEnhanceYourCalm)
+}
+
+func TestHeaderListTooLarge(t *testing.T) {
+	addr, _ := startConns(t, echoHandler, Config{MaxHeaderListSize: 100})
+	c := dialRaw(t, addr)
+	c.headers(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-big", strings.Repeat("a", 100))
+	f := c.readSkipping()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, "431", c.decode(f)[":status"])
+
+	// Test: A block of many one-byte fields is cut short while decoding,
+	// rather than merged field by field
+	block := c.encoder.Encode(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"},
+	})
+	// accept-encoding: gzip, deflate, from the static table
+	block = append(block, bytes.Repeat([]byte{0x90}, 300)...)
+	c.write(appendHeaderBlock(nil, 3, block, true, defaultMaxFrameSize))
+	// past the rest of the first answer
+	for f = c.readSkipping(); f.StreamID != 3; f = c.readSkipping() {
+	}
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, "431", c.decode(f)[":status"])
+}
+
+func TestHeaderListRepeatedFields(t *testing.T) {
+	addr, _ := startConns(t, echoHandler, Config{})
+	c := dialRaw(t, addr)
+	block := c.encoder.Encode(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"},
+	})
+	block = append(block, bytes.Repeat([]byte{0x90}, 200<<10)...)
+
+	// Test: A block as large as the server takes, of fields that cost a
+	// byte each, is answered promptly
+	start := time.Now()
+	c.write(appendHeaderBlock(nil, 1, block, true, defaultMaxFrameSize))
+	f := c.readSkipping()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, "431", c.decode(f)[":status"])
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSelfDependency(t *testing.T) {
+	called := make(chan struct{}, 2)
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		called <- struct{}{}
+		echoHandler(w, req)
+	}, Config{})
+	c := dialRaw(t, addr)
+	block := c.encoder.Encode(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"},
+	})
+	priority := func(id uint32) []byte {
+		return binary.BigEndian.AppendUint32(nil, id)[:4:4]
+	}
+
+	// Test: A stream that depends on itself is reset without being served
+	payload := append(append(priority(1), 16), block...)
+	c.write(appendFrame(nil, FrameHeaders, FlagPriority|FlagEndHeaders|FlagEndStream, 1, payload))
+	c.expectRST(1, ErrCodeProtocol)
+
+	// Test: Also when its block continues in CONTINUATION frames, which
+	// are decoded first
+	payload = append(append(priority(3), 16), block[:1]...)
+	c.write(appendFrame(nil, FrameHeaders, FlagPriority|FlagEndStream, 3, payload))
+	c.write(appendFrame(nil, FrameContinuation, FlagEndHeaders, 3, block[1:]))
+	c.expectRST(3, ErrCodeProtocol)
+
+	// the connection is still usable, and HPACK in step
+	c.get(5, "/ok")
+	f := c.readSkipping()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, uint32(5), f.StreamID)
+	assert.Len(t, called, 1)
+}
+
+func TestRSTStreamCancelsHandler(t *testing.T) {
+	cancelled := make(chan struct{})
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		<-req.Context().Done()
+		close(cancelled)
+	}, Config{})
+	c := dialRaw(t, addr)
+	c.get(1, "/")
+	c.write(appendRSTStream(nil, 1, ErrCodeCancel))
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context not cancelled")
+	}
+}
+
+func TestHandlerPanicResetsStream(t *testing.T) {
+	addr, _ := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(headers.NewHeaders())
+		_ = response.Flush(w)
+		panic(ErrAbortStream)
+	}, Config{})
+	c := dialRaw(t, addr)
+	c.get(1, "/")
+	f := c.read()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.False(t, f.Flags.Has(FlagEndStream))
+	c.expectRST(1, ErrCodeInternal)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	addr, conns := startConns(t, func(w response.ResponseWriter, req *request.Request) {
+		close(started)
+		<-release
+		echoHandler(w, req)
+	}, Config{})
+	c := dialRaw(t, addr)
+	c.get(1, "/slow")
+	<-started
+
+	conns()[0].Shutdown()
+	f := c.read()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.Payload))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+
+	// the open stream is still answered, then the connection closes
+	close(release)
+	f = c.read()
+	require.Equal(t, FrameHeaders, f.Type)
+	f = c.read()
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, "GET /slow ", string(f.Payload))
+	_, err := c.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr, _ := startConns(t, echoHandler, Config{IdleTimeout: 50 * time.Millisecond})
+	c := dialRaw(t, addr)
+	c.expectGoAway(ErrCodeNo)
+	_, err := c.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeEndsOnClose(t *testing.T) {
+	client, server := net.Pipe()
+	c := NewConn(server, bufio.NewReader(server), echoHandler, Config{})
+	done := make(chan error, 1)
+	go func() { done <- c.Serve() }()
+
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	_, err := client.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	_, err = client.Write(appendSettings(nil))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	select {
+	case err := <-done:
+		assert.True(t, err == nil || errors.Is(err, io.ErrClosedPipe), "unexpected error %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewConn(server, bufio.NewReader(server), echoHandler, Config{WriteTimeout: 50 * time.Millisecond})
+	served := make(chan error, 1)
+	go func() { served <- c.Serve() }()
+
+	go func() {
+		_, _ = client.Write(append([]byte(ClientPreface), appendSettings(nil)...))
+	}()
+	br := bufio.NewReader(client)
+	// SETTINGS, WINDOW_UPDATE and the ACK of ours
+	for range 3 {
+		_, _, err := ReadFrame(br, nil, maxMaxFrameSize)
+		require.NoError(t, err)
+	}
+
+	// Test: A client that stops reading has its connection closed rather
+	// than holding up the read loop, here on a PING ACK
+	_, err := client.Write(appendFrame(nil, FramePing, 0, 0, []byte("12345678")))
+	require.NoError(t, err)
+	select {
+	case err := <-served:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestDecodeUpgradeSettings(t *testing.T) {
+	// MAX_FRAME_SIZE 32768, ENABLE_PUSH 0
+	settings, err := DecodeUpgradeSettings("AAUAAIAAAAIAAAAA")
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{SettingMaxFrameSize, 1 << 15}, {SettingEnablePush, 0}}, settings)
+
+	settings, err = DecodeUpgradeSettings("")
+	require.NoError(t, err)
+	assert.Empty(t, settings)
+
+	for _, v := range []string{"not base64!", "AAUAAIA", "AAUAAABk"} {
+		_, err := DecodeUpgradeSettings(v)
+		assert.ErrorIs(t, err, ErrUpgradeSettings, v)
+	}
+}
+
+func TestServeUpgrade(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	c := NewConn(server, bufio.NewReader(server), echoHandler, Config{})
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "POST", RequestTarget: "/up", HttpVersion: "1.1"},
+		Headers:     headers.Headers{"connection": "Upgrade, HTTP2-Settings", "upgrade": "h2c", "host": "example.com"},
+		Body:        []byte("body"),
+	}
+	settings, err := DecodeUpgradeSettings("AAUAAIAA")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- c.ServeUpgrade(req, settings) }()
+
+	rc := &rawClient{t: t, conn: client, br: bufio.NewReader(client), decoder: hpack.NewDecoder(hpack.DefaultTableSize)}
+	status, err := rc.br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for line := ""; line != "\r\n"; {
+		line, err = rc.br.ReadString('\n')
+		require.NoError(t, err)
+	}
+	// the server's preface comes first, then the answer to the request
+	require.Equal(t, FrameSettings, rc.read().Type)
+	go func() {
+		_, _ = client.Write(append([]byte(ClientPreface), appendSettings(nil)...))
+	}()
+	// our SETTINGS may be acknowledged at any point
+	f := rc.readSkipping()
+	for f.Type == FrameSettings {
+		f = rc.readSkipping()
+	}
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, uint32(1), f.StreamID)
+	assert.Equal(t, "200", rc.decode(f)[":status"])
+	f = rc.readSkipping()
+	for f.Type == FrameSettings {
+		f = rc.readSkipping()
+	}
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, "POST /up body", string(f.Payload))
+
+	require.NoError(t, client.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeUpgrade did not return")
+	}
+}
@@ -0,0 +1,245 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frameHeaderLen is the size of the fixed header every frame starts with.
+const frameHeaderLen = 9
+
+// FrameType identifies the kind of a frame (RFC 9113, section 6).
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+var frameTypeNames = map[FrameType]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRSTStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+// Flags are the frame flags. Their meaning depends on the frame type.
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+// FrameHeader is the fixed header of a frame.
+type FrameHeader struct {
+	Length   uint32
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+}
+
+// Frame is a frame with its payload still encoded. Payload is only valid
+// until the next ReadFrame on the same buffer.
+type Frame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// SettingID identifies a setting (RFC 9113, section 6.5.2).
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+const (
+	// defaultMaxFrameSize is the SETTINGS_MAX_FRAME_SIZE both sides start
+	// with, and the smallest allowed.
+	defaultMaxFrameSize = 1 << 14
+	maxMaxFrameSize     = 1<<24 - 1
+	// defaultWindowSize is the initial flow-control window of the
+	// connection and of every stream until settings change it.
+	defaultWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+)
+
+// ReadFrame reads one frame from r into buf, growing it as needed, and
+// returns the frame and the buffer to pass to the next call. A frame longer
+// than maxSize is a connection error.
+func ReadFrame(r io.Reader, buf []byte, maxSize uint32) (Frame, []byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, buf, err
+	}
+	fh := FrameHeader{
+		Length:   uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2]),
+		Type:     FrameType(hdr[3]),
+		Flags:    Flags(hdr[4]),
+		StreamID: binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1),
+	}
+	if fh.Length > maxSize {
+		return Frame{}, buf, connError(ErrCodeFrameSize, "%s frame of %d bytes exceeds %d", fh.Type, fh.Length, maxSize)
+	}
+	if cap(buf) < int(fh.Length) {
+		buf = make([]byte, fh.Length)
+	}
+	payload := buf[:fh.Length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, buf, err
+	}
+	return Frame{FrameHeader: fh, Payload: payload}, buf, nil
+}
+
+// appendFrame appends a frame with the given header fields and payload to
+// dst.
+func appendFrame(dst []byte, typ FrameType, flags Flags, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), byte(flags))
+	dst = binary.BigEndian.AppendUint32(dst, streamID&(1<<31-1))
+	return append(dst, payload...)
+}
+
+// padded strips the padding of a DATA or HEADERS frame, whose payload then
+// starts at skip.
+func padded(f Frame, skip int) ([]byte, error) {
+	p := f.Payload
+	if !f.Flags.Has(FlagPadded) {
+		if len(p) < skip {
+			return nil, connError(ErrCodeFrameSize, "%s frame too short", f.Type)
+		}
+		return p[skip:], nil
+	}
+	if len(p) < 1+skip {
+		return nil, connError(ErrCodeFrameSize, "%s frame too short", f.Type)
+	}
+	padLen := int(p[0])
+	p = p[1:]
+	if padLen > len(p)-skip {
+		return nil, connError(ErrCodeProtocol, "%s padding longer than payload", f.Type)
+	}
+	return p[skip : len(p)-padLen], nil
+}
+
+// dataPayload returns the data of a DATA frame.
+func dataPayload(f Frame) ([]byte, error) {
+	return padded(f, 0)
+}
+
+// headersPayload returns the header block fragment of a HEADERS frame, and
+// the stream it depends on if it carries priority information.
+func headersPayload(f Frame) (block []byte, dependsOn uint32, err error) {
+	if !f.Flags.Has(FlagPriority) {
+		block, err = padded(f, 0)
+		return block, 0, err
+	}
+	p, err := padded(f, 5)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the priority fields sit between the pad length and the block
+	start := 0
+	if f.Flags.Has(FlagPadded) {
+		start = 1
+	}
+	dependsOn = binary.BigEndian.Uint32(f.Payload[start:]) & (1<<31 - 1)
+	return p, dependsOn, nil
+}
+
+func parseSettings(f Frame) ([]Setting, error) {
+	if len(f.Payload)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS length %d is not a multiple of 6", len(f.Payload))
+	}
+	settings := make([]Setting, 0, len(f.Payload)/6)
+	for p := f.Payload; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(p)),
+			Value: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...Setting) []byte {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	return appendFrame(dst, FrameSettings, 0, 0, payload)
+}
+
+func appendWindowUpdate(dst []byte, streamID, increment uint32) []byte {
+	return appendFrame(dst, FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+func appendRSTStream(dst []byte, streamID uint32, code ErrCode) []byte {
+	return appendFrame(dst, FrameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func appendGoAway(dst []byte, lastStreamID uint32, code ErrCode, debug string) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return appendFrame(dst, FrameGoAway, 0, 0, append(payload, debug...))
+}
+
+// appendHeaderBlock appends block as a HEADERS frame followed by as many
+// CONTINUATION frames as it takes to stay within maxFrameSize.
+func appendHeaderBlock(dst []byte, streamID uint32, block []byte, endStream bool, maxFrameSize int) []byte {
+	typ, flags := FrameHeaders, Flags(0)
+	if endStream {
+		flags |= FlagEndStream
+	}
+	for first := true; first || len(block) > 0; first = false {
+		n := min(len(block), maxFrameSize)
+		if n == len(block) {
+			flags |= FlagEndHeaders
+		}
+		dst = appendFrame(dst, typ, flags, streamID, block[:n])
+		block = block[n:]
+		typ, flags = FrameContinuation, 0
+	}
+	return dst
+}
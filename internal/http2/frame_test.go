@@ -0,0 +1,91 @@
+package http2
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrame(t *testing.T) {
+	b := appendFrame(nil, FrameData, FlagEndStream, 3, []byte("hello"))
+	b = appendWindowUpdate(b, 0, 100)
+
+	r := bytes.NewReader(b)
+	f, buf, err := ReadFrame(r, nil, defaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, FrameHeader{Length: 5, Type: FrameData, Flags: FlagEndStream, StreamID: 3}, f.FrameHeader)
+	assert.Equal(t, "hello", string(f.Payload))
+
+	f, _, err = ReadFrame(r, buf, defaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, FrameWindowUpdate, f.Type)
+	assert.Equal(t, []byte{0, 0, 0, 100}, f.Payload)
+
+	// frames over the limit are refused before their payload is read
+	big := appendFrame(nil, FrameData, 0, 1, make([]byte, defaultMaxFrameSize+1))
+	_, _, err = ReadFrame(bytes.NewReader(big), nil, defaultMaxFrameSize)
+	var ce ConnectionError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, ErrCodeFrameSize, ce.Code)
+}
+
+func TestPadding(t *testing.T) {
+	// pad length 2, then the data, then two bytes of padding
+	f := Frame{FrameHeader: FrameHeader{Type: FrameData, Flags: FlagPadded}, Payload: []byte("\x02abc\x00\x00")}
+	data, err := dataPayload(f)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(data))
+
+	f.Payload = []byte("\x05abc")
+	_, err = dataPayload(f)
+	var ce ConnectionError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, ErrCodeProtocol, ce.Code)
+
+	// padded HEADERS with priority: pad length, dependency, weight, block
+	f = Frame{
+		FrameHeader: FrameHeader{Type: FrameHeaders, Flags: FlagPadded | FlagPriority},
+		Payload:     []byte("\x01\x00\x00\x00\x07\x10block\x00"),
+	}
+	block, dependsOn, err := headersPayload(f)
+	require.NoError(t, err)
+	assert.Equal(t, "block", string(block))
+	assert.Equal(t, uint32(7), dependsOn)
+}
+
+func TestAppendHeaderBlock(t *testing.T) {
+	block := bytes.Repeat([]byte("x"), 2*defaultMaxFrameSize+10)
+	r := bytes.NewReader(appendHeaderBlock(nil, 5, block, true, defaultMaxFrameSize))
+
+	var got []byte
+	var frames []FrameHeader
+	for r.Len() > 0 {
+		f, _, err := ReadFrame(r, nil, defaultMaxFrameSize)
+		require.NoError(t, err)
+		frames = append(frames, f.FrameHeader)
+		got = append(got, f.Payload...)
+	}
+	assert.Equal(t, block, got)
+	assert.Equal(t, []FrameHeader{
+		{Length: defaultMaxFrameSize, Type: FrameHeaders, Flags: FlagEndStream, StreamID: 5},
+		{Length: defaultMaxFrameSize, Type: FrameContinuation, StreamID: 5},
+		{Length: 10, Type: FrameContinuation, Flags: FlagEndHeaders, StreamID: 5},
+	}, frames)
+}
+
+func TestSettings(t *testing.T) {
+	b := appendSettings(nil, Setting{ID: SettingMaxFrameSize, Value: 1 << 20}, Setting{ID: SettingEnablePush, Value: 0})
+	f, _, err := ReadFrame(bytes.NewReader(b), nil, defaultMaxFrameSize)
+	require.NoError(t, err)
+	settings, err := parseSettings(f)
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{SettingMaxFrameSize, 1 << 20}, {SettingEnablePush, 0}}, settings)
+
+	f.Payload = f.Payload[:5]
+	_, err = parseSettings(f)
+	var ce ConnectionError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, ErrCodeFrameSize, ce.Code)
+}
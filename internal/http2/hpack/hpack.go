@@ -0,0 +1,453 @@
+// Package hpack implements HPACK, the header compression of HTTP/2
+// (RFC 7541): the static and dynamic tables, integer and string literals,
+// and the Huffman code.
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrIndex         = errors.New("hpack: invalid table index")
+	ErrIntegerLength = errors.New("hpack: integer too large")
+	ErrTruncated     = errors.New("hpack: truncated header block")
+	ErrTableSize     = errors.New("hpack: invalid dynamic table size update")
+	ErrStringLength  = errors.New("hpack: string literal too long")
+	// ErrHeaderListSize is returned, with the fields that fit, for a block
+	// over Decoder.MaxHeaderListSize. The decoder is still usable.
+	ErrHeaderListSize = errors.New("hpack: header list too large")
+)
+
+// DefaultTableSize is the dynamic table size both sides start with.
+const DefaultTableSize = 4096
+
+// HeaderField is one name-value pair. A Sensitive field is never added to
+// a dynamic table, by this encoder or by intermediaries.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is the size the field counts for in a dynamic table, and towards
+// HTTP/2's header list size limit.
+func (f HeaderField) Size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// staticTable is RFC 7541, Appendix A. Index 1 is staticTable[0].
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+type nameValue struct{ name, value string }
+
+// staticIndex finds static entries by name and value, and by name alone
+// (the lowest index with that name).
+var staticIndex, staticNameIndex = func() (map[nameValue]int, map[string]int) {
+	byPair := make(map[nameValue]int)
+	byName := make(map[string]int)
+	for i, f := range staticTable {
+		byPair[nameValue{f.Name, f.Value}] = i + 1
+		if _, ok := byName[f.Name]; !ok {
+			byName[f.Name] = i + 1
+		}
+	}
+	return byPair, byName
+}()
+
+// dynamicTable is a FIFO of fields, newest last. Its indices continue after
+// the static table's, newest first.
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits. An entry larger than
+// the whole table empties it.
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize {
+		t.size -= t.entries[drop].Size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+// field returns the field at a combined static and dynamic index.
+func (t *dynamicTable) field(index uint64) (HeaderField, error) {
+	if index == 0 {
+		return HeaderField{}, ErrIndex
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+	i := index - uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, fmt.Errorf("%w: %d", ErrIndex, index)
+	}
+	return t.entries[uint64(len(t.entries))-i], nil
+}
+
+// search returns the index of an entry matching f exactly, or else of one
+// matching its name, or 0.
+func (t *dynamicTable) search(f HeaderField) (index int, exact bool) {
+	if i, ok := staticIndex[nameValue{f.Name, f.Value}]; ok {
+		return i, true
+	}
+	nameIndex := staticNameIndex[f.Name]
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		index := len(staticTable) + len(t.entries) - i
+		if e.Value == f.Value {
+			return index, true
+		}
+		if nameIndex == 0 {
+			nameIndex = index
+		}
+	}
+	return nameIndex, false
+}
+
+// Decoder decodes header blocks from one peer. Blocks must be decoded in
+// the order they were sent, since they share the dynamic table.
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the limit the peer's size updates must respect: the
+	// SETTINGS_HEADER_TABLE_SIZE we announced.
+	maxTableSize int
+	// MaxStringLength bounds each decoded name and value; zero means no
+	// limit.
+	MaxStringLength int
+	// MaxHeaderListSize bounds the total Size of a block's fields; zero
+	// means no limit. Fields past it are dropped, though the block is still
+	// decoded to keep the dynamic table in step.
+	MaxHeaderListSize int
+}
+
+// NewDecoder returns a decoder allowing the peer a dynamic table of up to
+// maxTableSize bytes.
+func NewDecoder(maxTableSize int) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+// Decode decodes a complete header block. A block over MaxHeaderListSize
+// returns the fields that fit with ErrHeaderListSize.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	count, size := 0, 0
+	emit := func(f HeaderField) {
+		count++
+		size += f.Size()
+		if d.MaxHeaderListSize == 0 || size <= d.MaxHeaderListSize {
+			fields = append(fields, f)
+		}
+	}
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed field
+			index, n, err := readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f, err := d.table.field(index)
+			if err != nil {
+				return nil, err
+			}
+			emit(f)
+		case b&0xc0 == 0x40: // literal with incremental indexing
+			f, n, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			d.table.add(f)
+			emit(f)
+		case b&0xe0 == 0x20: // dynamic table size update
+			// only allowed before the first field of a block
+			if count > 0 {
+				return nil, ErrTableSize
+			}
+			size, n, err := readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: %d", ErrTableSize, size)
+			}
+			block = block[n:]
+			d.table.setMaxSize(int(size))
+		default: // literal without indexing (0000), or never indexed (0001)
+			f, n, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f.Sensitive = b&0x10 != 0
+			emit(f)
+		}
+	}
+	if d.MaxHeaderListSize > 0 && size > d.MaxHeaderListSize {
+		return fields, ErrHeaderListSize
+	}
+	return fields, nil
+}
+
+// readLiteral reads a literal field whose name index has the given prefix
+// size; index 0 means the name follows as a string.
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, int, error) {
+	index, n, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	var f HeaderField
+	if index == 0 {
+		name, m, err := d.readString(block[n:])
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = name
+		n += m
+	} else {
+		named, err := d.table.field(index)
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = named.Name
+	}
+	value, m, err := d.readString(block[n:])
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	f.Value = value
+	return f, n + m, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, int, error) {
+	if len(block) == 0 {
+		return "", 0, ErrTruncated
+	}
+	huffman := block[0]&0x80 != 0
+	length, n, err := readInt(block, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(block)-n) < length {
+		return "", 0, ErrTruncated
+	}
+	raw := block[n : n+int(length)]
+	value := string(raw)
+	if huffman {
+		decoded, err := HuffmanDecode(nil, raw)
+		if err != nil {
+			return "", 0, err
+		}
+		value = string(decoded)
+	}
+	if d.MaxStringLength > 0 && len(value) > d.MaxStringLength {
+		return "", 0, ErrStringLength
+	}
+	return value, n + len(raw), nil
+}
+
+// Encoder encodes header blocks for one peer.
+type Encoder struct {
+	table dynamicTable
+	// pendingUpdate is set when the table size changed since the last
+	// block; pendingMin is the smallest it has been since then.
+	pendingUpdate bool
+	pendingMin    int
+}
+
+// NewEncoder returns an encoder using a dynamic table of the default size.
+func NewEncoder() *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: DefaultTableSize}}
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The
+// encoder never uses more than DefaultTableSize, however much is allowed.
+func (e *Encoder) SetMaxTableSize(n int) {
+	n = min(n, DefaultTableSize)
+	if n == e.table.maxSize {
+		return
+	}
+	if !e.pendingUpdate || n < e.pendingMin {
+		e.pendingMin = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode appends a header block holding fields to dst.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		// a shrink followed by a growth must announce both, so the peer
+		// evicts what the smaller size would have
+		if e.pendingMin < e.table.maxSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.pendingMin))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+	for _, f := range fields {
+		dst = e.encodeField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) encodeField(dst []byte, f HeaderField) []byte {
+	index, exact := e.table.search(f)
+	if exact && !f.Sensitive {
+		return appendInt(dst, 0x80, 7, uint64(index))
+	}
+	switch {
+	case f.Sensitive:
+		dst = appendInt(dst, 0x10, 4, uint64(index))
+	case f.Size() <= e.table.maxSize:
+		dst = appendInt(dst, 0x40, 6, uint64(index))
+		e.table.add(f)
+	default:
+		dst = appendInt(dst, 0x00, 4, uint64(index))
+	}
+	if index == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
+
+// appendInt appends v as an integer with an n-bit prefix, the other bits
+// of the first byte set to flags.
+func appendInt(dst []byte, flags byte, n uint8, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(dst, flags|byte(v))
+	}
+	dst = append(dst, flags|byte(max))
+	v -= max
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// readInt reads an integer with an n-bit prefix from the start of block and
+// returns it and the bytes it took.
+func readInt(block []byte, n uint8) (uint64, int, error) {
+	if len(block) == 0 {
+		return 0, 0, ErrTruncated
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(block[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+	var shift uint
+	for i := 1; i < len(block); i++ {
+		b := block[i]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, i + 1, nil
+		}
+		shift += 7
+		// no sane header block needs more than 2^28
+		if shift > 21 {
+			return 0, 0, ErrIntegerLength
+		}
+	}
+	return 0, 0, ErrTruncated
+}
+
+// appendString appends s as a string literal, Huffman encoded when that is
+// shorter.
+func appendString(dst []byte, s string) []byte {
+	if hl := HuffmanEncodedLen(s); hl < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(hl))
+		return AppendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,186 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+// requestExamples are RFC 7541, Appendix C.3 and C.4: three requests on one
+// connection, without and with Huffman coding.
+var requestExamples = []struct {
+	fields  []HeaderField
+	plain   string
+	huffman string
+	// tableSize is the dynamic table size after the block
+	tableSize int
+}{
+	{
+		fields: []HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "www.example.com"},
+		},
+		plain:     "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		huffman:   "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		tableSize: 57,
+	},
+	{
+		fields: []HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "www.example.com"},
+			{Name: "cache-control", Value: "no-cache"},
+		},
+		plain:     "8286 84be 5808 6e6f 2d63 6163 6865",
+		huffman:   "8286 84be 5886 a8eb 1064 9cbf",
+		tableSize: 110,
+	},
+	{
+		fields: []HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":path", Value: "/index.html"},
+			{Name: ":authority", Value: "www.example.com"},
+			{Name: "custom-key", Value: "custom-value"},
+		},
+		plain:     "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		huffman:   "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		tableSize: 164,
+	},
+}
+
+func TestDecoder(t *testing.T) {
+	for _, variant := range []string{"plain", "huffman"} {
+		t.Run(variant, func(t *testing.T) {
+			d := NewDecoder(DefaultTableSize)
+			for _, ex := range requestExamples {
+				block := ex.plain
+				if variant == "huffman" {
+					block = ex.huffman
+				}
+				fields, err := d.Decode(unhex(t, block))
+				require.NoError(t, err)
+				assert.Equal(t, ex.fields, fields)
+				assert.Equal(t, ex.tableSize, d.table.size)
+			}
+		})
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	// Test: The encoder produces the RFC's Huffman examples exactly
+	e := NewEncoder()
+	for _, ex := range requestExamples {
+		assert.Equal(t, unhex(t, ex.huffman), e.Encode(nil, ex.fields))
+		assert.Equal(t, ex.tableSize, e.table.size)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	e := NewEncoder()
+	e.SetMaxTableSize(256)
+	d := NewDecoder(DefaultTableSize)
+
+	responses := [][]HeaderField{
+		{{Name: ":status", Value: "302"}, {Name: "cache-control", Value: "private"}, {Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"}, {Name: "location", Value: "https://www.example.com"}},
+		{{Name: ":status", Value: "307"}, {Name: "cache-control", Value: "private"}, {Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"}, {Name: "location", Value: "https://www.example.com"}},
+		{{Name: ":status", Value: "200"}, {Name: "cache-control", Value: "private"}, {Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"}, {Name: "location", Value: "https://www.example.com"}, {Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1", Sensitive: true}},
+	}
+	for i, fields := range responses {
+		block := e.Encode(nil, fields)
+		if i == 0 {
+			// the smaller table is announced first
+			assert.Equal(t, byte(0x3f), block[0])
+		}
+		got, err := d.Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, fields, got)
+		// Test: Both tables agree and stay within the limit
+		assert.Equal(t, e.table.entries, d.table.entries)
+		assert.LessOrEqual(t, d.table.size, 256)
+	}
+	// the sensitive cookie was not indexed
+	for _, f := range d.table.entries {
+		assert.NotEqual(t, "set-cookie", f.Name)
+	}
+}
+
+func TestTableSizeUpdates(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+	fields := []HeaderField{{Name: "x-a", Value: "1"}}
+	_, err := d.Decode(e.Encode(nil, fields))
+	require.NoError(t, err)
+	require.Len(t, d.table.entries, 1)
+
+	// Test: Shrinking then growing between blocks announces both sizes
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(1024)
+	block := e.Encode(nil, nil)
+	assert.Equal(t, []byte{0x20, 0x3f, 0xe1, 0x07}, block)
+	_, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Empty(t, d.table.entries)
+	assert.Equal(t, 1024, d.table.maxSize)
+
+	// Test: Updates beyond the announced limit, or after a field, fail
+	_, err = NewDecoder(100).Decode([]byte{0x3f, 0xe1, 0x07})
+	assert.ErrorIs(t, err, ErrTableSize)
+	_, err = d.Decode([]byte{0x82, 0x20})
+	assert.ErrorIs(t, err, ErrTableSize)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for name, block := range map[string][]byte{
+		"index zero":           {0x80},
+		"index past tables":    {0xbe},
+		"truncated integer":    {0xff, 0x80},
+		"integer too large":    {0xff, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		"truncated string":     {0x40, 0x05, 'a'},
+		"bad huffman":          {0x40, 0x81, 0x18, 0x00},
+		"missing value":        {0x40, 0x01, 'a'},
+		"truncated name index": {0x0f},
+	} {
+		_, err := NewDecoder(DefaultTableSize).Decode(block)
+		assert.Error(t, err, name)
+	}
+
+	// Test: Strings longer than the limit are refused
+	d := NewDecoder(DefaultTableSize)
+	d.MaxStringLength = 4
+	_, err := d.Decode(append([]byte{0x40, 0x01, 'a', 0x05}, "hello"...))
+	assert.ErrorIs(t, err, ErrStringLength)
+}
+
+func TestHeaderListSize(t *testing.T) {
+	// accept-encoding: gzip, deflate, from the static table, is 1 byte
+	// and counts for 60
+	block := bytes.Repeat([]byte{0x90}, 1<<15)
+	d := NewDecoder(DefaultTableSize)
+	d.MaxHeaderListSize = 600
+
+	// Test: Fields past the limit are dropped, not returned
+	fields, err := d.Decode(append(block, 0x41, 0x01, 'x'))
+	assert.ErrorIs(t, err, ErrHeaderListSize)
+	assert.Len(t, fields, 10)
+
+	// Test: The rest of the block was still decoded, keeping the dynamic
+	// table in step
+	fields, err = d.Decode([]byte{0xbe})
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: ":authority", Value: "x"}}, fields)
+}
@@ -0,0 +1,95 @@
+package hpack
+
+import "errors"
+
+var ErrInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+
+type huffmanCode struct {
+	code uint32
+	bits uint8
+}
+
+// huffmanNode is a node of the decoding tree. Internal nodes have children;
+// leaves have sym set.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, c := range huffmanCodes {
+		n := root
+		for i := int(c.bits) - 1; i >= 0; i-- {
+			bit := (c.code >> i) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym, n.leaf = byte(sym), true
+	}
+	return root
+}
+
+// HuffmanEncodedLen returns how many bytes s takes Huffman encoded.
+func HuffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffman appends the Huffman encoding of s to dst.
+func AppendHuffman(dst []byte, s string) []byte {
+	var acc uint64 // pending bits, right-aligned
+	var n uint     // number of pending bits
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		n += uint(c.bits)
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		// pad with the most significant bits of the end-of-string code,
+		// which are all ones
+		dst = append(dst, byte(acc<<(8-n))|byte(0xff>>n))
+	}
+	return dst
+}
+
+// HuffmanDecode appends the decoding of src to dst. Padding longer than
+// seven bits, padding that is not a prefix of the end-of-string code, and
+// the end-of-string code itself are errors.
+func HuffmanDecode(dst, src []byte) ([]byte, error) {
+	n := huffmanRoot
+	pending := 0    // bits read since the last symbol
+	allOnes := true // whether those bits were all ones
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			n = n.children[bit]
+			if n == nil {
+				// only the end-of-string code runs off the tree
+				return dst, ErrInvalidHuffman
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if n.leaf {
+				dst = append(dst, n.sym)
+				n, pending, allOnes = huffmanRoot, 0, true
+			}
+		}
+	}
+	if pending > 7 || !allOnes {
+		return dst, ErrInvalidHuffman
+	}
+	return dst, nil
+}
@@ -0,0 +1,60 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHuffman(t *testing.T) {
+	// RFC 7541, Appendix C.4 and C.6
+	tests := []struct {
+		text string
+		hex  string
+	}{
+		{text: "www.example.com", hex: "f1e3c2e5f23a6ba0ab90f4ff"},
+		{text: "no-cache", hex: "a8eb10649cbf"},
+		{text: "custom-key", hex: "25a849e95ba97d7f"},
+		{text: "custom-value", hex: "25a849e95bb8e8b4bf"},
+		{text: "302", hex: "6402"},
+		{text: "private", hex: "aec3771a4b"},
+		{text: "Mon, 21 Oct 2013 20:13:21 GMT", hex: "d07abe941054d444a8200595040b8166e082a62d1bff"},
+		{text: "https://www.example.com", hex: "9d29ad171863c78f0b97c8e9ae82ae43d3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			want, err := hex.DecodeString(tt.hex)
+			require.NoError(t, err)
+			assert.Equal(t, want, AppendHuffman(nil, tt.text))
+			assert.Equal(t, len(want), HuffmanEncodedLen(tt.text))
+			got, err := HuffmanDecode(nil, want)
+			require.NoError(t, err)
+			assert.Equal(t, tt.text, string(got))
+		})
+	}
+
+	// Test: Every byte value round-trips
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	got, err := HuffmanDecode(nil, AppendHuffman(nil, string(all)))
+	require.NoError(t, err)
+	assert.Equal(t, all, got)
+}
+
+func TestHuffmanDecodeErrors(t *testing.T) {
+	for name, src := range map[string][]byte{
+		// 'a' is 00011, then padding with a zero bit
+		"padding not ones": {0x18},
+		// a whole byte of padding after '0' (00000) and three bits
+		"padding too long": {0x07, 0xff},
+		// the 30-bit end-of-string code
+		"end of string": {0xff, 0xff, 0xff, 0xfc},
+	} {
+		_, err := HuffmanDecode(nil, src)
+		assert.ErrorIs(t, err, ErrInvalidHuffman, name)
+	}
+}
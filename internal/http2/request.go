@@ -0,0 +1,167 @@
+package http2
+
+import (
+	"strconv"
+	"strings"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/http2/hpack"
+	"httpfromtcp.haonguyen.tech/internal/problem"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// connectionHeaders are the HTTP/1.1 fields that have no meaning in
+// HTTP/2 (RFC 9113, section 8.2.2).
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// newRequest builds the request of stream id from its decoded header block.
+// It also returns the declared Content-Length, -1 if there is none. A
+// malformed request is a stream error; one whose headers were over the limit,
+// and so cut short by the decoder, gets a handler that answers 431 in place
+// of the server's, and one declaring a body over the limit 413.
+func (c *Conn) newRequest(id uint32, fields []hpack.HeaderField, tooLarge bool) (*request.Request, int64, Handler, error) {
+	r := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2"},
+		Headers:     headers.NewHeaders(),
+		Body:        make([]byte, 0),
+		Trailers:    headers.NewHeaders(),
+	}
+	var scheme, authority string
+	var cookies []string
+	pseudo := true
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, 0, nil, streamError(id, ErrCodeProtocol, "%v", err)
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			if !pseudo {
+				return nil, 0, nil, streamError(id, ErrCodeProtocol, "pseudo-header %s after regular fields", f.Name)
+			}
+			var dst *string
+			switch f.Name {
+			case ":method":
+				dst = &r.RequestLine.Method
+			case ":path":
+				dst = &r.RequestLine.RequestTarget
+			case ":scheme":
+				dst = &scheme
+			case ":authority":
+				dst = &authority
+			default:
+				return nil, 0, nil, streamError(id, ErrCodeProtocol, "unknown pseudo-header %s", f.Name)
+			}
+			if *dst != "" {
+				return nil, 0, nil, streamError(id, ErrCodeProtocol, "repeated pseudo-header %s", f.Name)
+			}
+			*dst = f.Value
+			continue
+		}
+		pseudo = false
+		switch {
+		case connectionHeaders[f.Name]:
+			return nil, 0, nil, streamError(id, ErrCodeProtocol, "connection-specific field %s", f.Name)
+		case f.Name == "te" && f.Value != "trailers":
+			return nil, 0, nil, streamError(id, ErrCodeProtocol, "te other than trailers")
+		case f.Name == "cookie":
+			// cookies may be split across fields to compress better
+			cookies = append(cookies, f.Value)
+		default:
+			r.Headers.Set(f.Name, f.Value)
+		}
+	}
+	if len(cookies) > 0 {
+		r.Headers.Override("cookie", strings.Join(cookies, "; "))
+	}
+	if tooLarge {
+		// the fields that fit may not even include the pseudo-headers,
+		// which the answer does not need
+		return r, -1, func(w response.ResponseWriter, r *request.Request) {
+			_ = problem.Write(w, r, problem.New(response.StatusRequestHeaderFieldsTooLarge, ""))
+		}, nil
+	}
+
+	switch {
+	case r.RequestLine.Method == "":
+		return nil, 0, nil, streamError(id, ErrCodeProtocol, "missing :method")
+	case r.RequestLine.Method == "CONNECT":
+		if r.RequestLine.RequestTarget != "" || scheme != "" || authority == "" {
+			return nil, 0, nil, streamError(id, ErrCodeProtocol, "malformed CONNECT request")
+		}
+		r.RequestLine.RequestTarget = authority
+	case r.RequestLine.RequestTarget == "" || scheme == "":
+		return nil, 0, nil, streamError(id, ErrCodeProtocol, "missing :path or :scheme")
+	}
+	if authority != "" {
+		// :authority stands in for Host, and wins over it
+		r.Headers.Override("host", authority)
+	}
+
+	declaredLength := int64(-1)
+	if v, ok := r.Headers.Get("content-length"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, 0, nil, streamError(id, ErrCodeProtocol, "invalid content-length %q", v)
+		}
+		declaredLength = n
+	}
+	if declaredLength > c.config.MaxBodySize {
+		return r, declaredLength, func(w response.ResponseWriter, r *request.Request) {
+			_ = problem.Write(w, r, problem.New(response.StatusContentTooLarge, ""))
+		}, nil
+	}
+	return r, declaredLength, nil, nil
+}
+
+// trailerFields checks the trailer section of stream id.
+func trailerFields(id uint32, fields []hpack.HeaderField) (headers.Headers, error) {
+	trailers := headers.NewHeaders()
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, streamError(id, ErrCodeProtocol, "%v", err)
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			return nil, streamError(id, ErrCodeProtocol, "pseudo-header %s in trailers", f.Name)
+		}
+		trailers.Set(f.Name, f.Value)
+	}
+	return trailers, nil
+}
+
+type fieldError string
+
+func (e fieldError) Error() string {
+	return string(e)
+}
+
+// checkField rejects names that are empty, upper case or not tokens, and
+// values with NUL, CR, LF or surrounding whitespace.
+func checkField(f hpack.HeaderField) error {
+	name := strings.TrimPrefix(f.Name, ":")
+	if name == "" {
+		return fieldError("empty field name")
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) || ('A' <= name[i] && name[i] <= 'Z') {
+			return fieldError("invalid field name " + strconv.Quote(f.Name))
+		}
+	}
+	if strings.ContainsAny(f.Value, "\x00\r\n") || strings.TrimSpace(f.Value) != f.Value {
+		return fieldError("invalid value of field " + f.Name)
+	}
+	return nil
+}
+
+func isTokenChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", b) >= 0
+}
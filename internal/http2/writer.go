@@ -0,0 +1,275 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/http2/hpack"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// errNoResponse is returned by Finish when the handler sent no status, so
+// the stream is reset rather than left without an answer.
+var errNoResponse = errors.New("http2: handler sent no response")
+
+type writerState int
+
+const (
+	writerStateStatus writerState = iota
+	writerStateHeaders
+	writerStateBody
+	writerStateTrailers
+	writerStateDone
+)
+
+// responseWriter answers one stream. It implements the same
+// response.ResponseWriter as HTTP/1.1 responses, so handlers need not know
+// which protocol they serve: chunked bodies become plain DATA frames, and
+// trailers a final HEADERS frame.
+//
+// Body bytes are buffered and sent on Flush, when the buffer fills, or when
+// the handler returns, so a short response goes out as one HEADERS frame
+// with END_STREAM or one HEADERS and one DATA frame.
+type responseWriter struct {
+	conn  *Conn
+	st    *stream
+	state writerState
+
+	status  response.StatusCode
+	headers headers.Headers
+	// headersSent is set once the HEADERS frame with the status is out
+	headersSent bool
+	buf         []byte
+	// finishErr is what finishing the stream returned, for later calls
+	finishErr error
+
+	start       time.Time
+	bodyBytes   int64
+	unencoded   int64
+	coded       bool
+	wireBytes   int64
+	first, last time.Time
+}
+
+// writeBufferSize is how much body is buffered before it is sent.
+const writeBufferSize = 16 << 10
+
+func newResponseWriter(c *Conn, st *stream) *responseWriter {
+	return &responseWriter{conn: c, st: st, start: time.Now()}
+}
+
+func (w *responseWriter) WriteInformational(statusCode response.StatusCode, h headers.Headers) error {
+	if w.state != writerStateStatus {
+		return fmt.Errorf("cannot write informational response in state: %d", w.state)
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == response.StatusSwitchingProtocols {
+		return fmt.Errorf("not an informational status code: %d", statusCode)
+	}
+	n, err := w.conn.writeHeaders(w.st, responseFields(statusCode, h), false)
+	w.count(n)
+	return err
+}
+
+func (w *responseWriter) WriteStatusLine(statusCode response.StatusCode) error {
+	if w.state != writerStateStatus {
+		return fmt.Errorf("cannot write status line in state: %d", w.state)
+	}
+	w.status = statusCode
+	w.state = writerStateHeaders
+	return nil
+}
+
+func (w *responseWriter) WriteHeaders(h headers.Headers) error {
+	if w.state != writerStateHeaders {
+		return fmt.Errorf("cannot write header in state: %d", w.state)
+	}
+	w.headers = headers.NewHeaders()
+	for k, v := range h {
+		w.headers.Override(k, v)
+	}
+	w.state = writerStateBody
+	return nil
+}
+
+func (w *responseWriter) WriteBody(p []byte) (int, error) {
+	if w.state != writerStateBody {
+		return 0, fmt.Errorf("cannot write body in state: %d", w.state)
+	}
+	w.buf = append(w.buf, p...)
+	w.bodyBytes += int64(len(p))
+	if len(w.buf) >= writeBufferSize {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ReadFrom copies r into the body.
+func (w *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{writerFunc(w.WriteBody)}, r)
+}
+
+// WriteChunkedBody writes p as body: HTTP/2 frames bodies itself.
+func (w *responseWriter) WriteChunkedBody(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
+func (w *responseWriter) WriteChunkedBodyDone() (int, error) {
+	if w.state != writerStateBody {
+		return 0, fmt.Errorf("cannot end body in state: %d", w.state)
+	}
+	w.state = writerStateTrailers
+	return 0, nil
+}
+
+// WriteTrailers sends the body still buffered and then h, ending the
+// stream.
+func (w *responseWriter) WriteTrailers(h headers.Headers) error {
+	if w.state != writerStateTrailers {
+		return fmt.Errorf("cannot write trailers in state %d", w.state)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.state = writerStateDone
+	n, err := w.conn.writeHeaders(w.st, headerFields(h), true)
+	w.count(n)
+	return err
+}
+
+// Flush sends the headers, if they are not out yet, and the buffered body.
+func (w *responseWriter) Flush() error {
+	if w.state < writerStateBody || w.state == writerStateDone {
+		return nil
+	}
+	if err := w.sendHeaders(false); err != nil {
+		return err
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.conn.writeData(w.st, w.buf, false)
+	w.count(n)
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *responseWriter) sendHeaders(endStream bool) error {
+	if w.headersSent {
+		return nil
+	}
+	w.headersSent = true
+	n, err := w.conn.writeHeaders(w.st, responseFields(w.status, w.headers), endStream)
+	w.count(n)
+	return err
+}
+
+// Finish ends the stream, sending what is left of the response. Conn calls
+// it once the handler has returned; whoever reports on the response, such
+// as the server's access log, calls it first so the report covers all of
+// it. Later calls return what the first did.
+func (w *responseWriter) Finish() error {
+	if w.state == writerStateDone {
+		return w.finishErr
+	}
+	w.finishErr = w.finish()
+	return w.finishErr
+}
+
+func (w *responseWriter) finish() error {
+	switch w.state {
+	case writerStateStatus:
+		return errNoResponse
+	case writerStateHeaders:
+		// a status without headers
+		w.headers = headers.NewHeaders()
+	}
+	w.state = writerStateDone
+	if !w.headersSent && len(w.buf) == 0 {
+		return w.sendHeaders(true)
+	}
+	if err := w.sendHeaders(false); err != nil {
+		return err
+	}
+	n, err := w.conn.writeData(w.st, w.buf, true)
+	w.count(n)
+	return err
+}
+
+// Stats reports the response like response.Writer.Stats does. WireBytes
+// counts frame headers and HPACK-encoded fields.
+func (w *responseWriter) Stats() response.Stats {
+	st := response.Stats{
+		StatusCode:       w.status,
+		Headers:          w.headers,
+		BodyBytes:        w.bodyBytes,
+		EncodedBodyBytes: w.bodyBytes,
+		WireBytes:        w.wireBytes,
+		Start:            w.start,
+	}
+	if w.coded {
+		st.BodyBytes = w.unencoded
+	}
+	if !w.first.IsZero() {
+		st.TimeToFirstByte = w.first.Sub(w.start)
+		st.Duration = w.last.Sub(w.start)
+	}
+	return st
+}
+
+// CountUnencodedBody records n body bytes written above a content coding,
+// see response.CountUnencodedBody.
+func (w *responseWriter) CountUnencodedBody(n int64) {
+	w.unencoded += n
+	w.coded = true
+}
+
+func (w *responseWriter) count(n int) {
+	if n > 0 {
+		now := time.Now()
+		if w.first.IsZero() {
+			w.first = now
+		}
+		w.last = now
+		w.wireBytes += int64(n)
+	}
+}
+
+// responseFields turns a status and its headers into a header list, leaving
+// out the fields HTTP/2 forbids.
+func responseFields(status response.StatusCode, h headers.Headers) []hpack.HeaderField {
+	fields := make([]hpack.HeaderField, 0, len(h)+1)
+	fields = append(fields, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(int(status))})
+	for _, f := range headerFields(h) {
+		if !connectionHeaders[f.Name] {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// headerFields returns h as header fields with lower-cased names, in
+// order, so the same headers always encode the same way.
+func headerFields(h headers.Headers) []hpack.HeaderField {
+	fields := make([]hpack.HeaderField, 0, len(h))
+	for k, v := range h {
+		fields = append(fields, hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+	}
+	slices.SortFunc(fields, func(a, b hpack.HeaderField) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return fields
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext(t *testing.T) {
+	// Test: Without a logger in the context, the default is used
+	assert.Same(t, slog.Default(), FromContext(context.Background()))
+
+	// Test: NewContext carries a logger to FromContext
+	logger := slog.New(slog.DiscardHandler)
+	assert.Same(t, logger, FromContext(NewContext(context.Background(), logger)))
+}
+
+func TestNewHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, "json", slog.LevelWarn)
+	require.NoError(t, err)
+	logger := slog.New(h)
+
+	// Test: Records below the level are dropped
+	logger.Info("quiet")
+	assert.Zero(t, buf.Len())
+
+	// Test: The rest are written in the format asked for
+	logger.Warn("loud", "remote", "192.0.2.7:51234")
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, "loud", got["msg"])
+	assert.Equal(t, "192.0.2.7:51234", got["remote"])
+
+	buf.Reset()
+	h, err = NewHandler(&buf, "text", slog.LevelInfo)
+	require.NoError(t, err)
+	slog.New(h).Info("hello", "n", 1)
+	assert.Contains(t, buf.String(), "msg=hello n=1")
+
+	_, err = NewHandler(&buf, "xml", slog.LevelInfo)
+	assert.Error(t, err)
+}
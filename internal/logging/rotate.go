@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// RotatingFile appends to a file until a write would take it past MaxSize
+// bytes. The file is then renamed path.1, older ones shift to path.2 and so
+// on, keeping MaxBackups of them, and a new file is started. Each Write
+// lands in one file whole, so lines are never split. It is safe for
+// concurrent use.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed. A
+// maxSize of zero or less never rotates.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+	var rerr error
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if rerr = f.rotate(); f.file == nil {
+			return 0, rerr
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, errors.Join(rerr, err)
+}
+
+// rotate moves the current file out of the way and starts a new one. If
+// the file cannot be moved, writing carries on in it and the error is
+// reported with the write.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err == nil {
+		err = f.shift()
+	}
+	if oerr := f.open(); oerr != nil {
+		f.file = nil
+		return errors.Join(err, oerr)
+	}
+	return err
+}
+
+// shift renames the file and its backups one number up, dropping the oldest.
+func (f *RotatingFile) shift() error {
+	if f.maxBackups <= 0 {
+		return os.Remove(f.path)
+	}
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(backupName(f.path, i), backupName(f.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(f.path, backupName(f.path, 1))
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Close closes the current file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return fs.ErrClosed
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0o644))
+	f, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+
+	// Test: Writes append to what is there until the next would go past
+	// maxSize
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		n, err := f.Write([]byte(line))
+		require.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.Equal(t, "four\nfive\n", readFile(t, path))
+	assert.Equal(t, "two\nthree\n", readFile(t, path+".1"))
+	assert.Equal(t, "old\none\n", readFile(t, path+".2"))
+
+	// Test: A write larger than maxSize still goes in whole, and only
+	// maxBackups old files are kept
+	_, err = f.Write([]byte("a long line\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "a long line\n", readFile(t, path))
+	assert.Equal(t, "four\nfive\n", readFile(t, path+".1"))
+	assert.Equal(t, "two\nthree\n", readFile(t, path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	require.NoError(t, f.Close())
+	_, err = f.Write([]byte("late\n"))
+	assert.ErrorIs(t, err, fs.ErrClosed)
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := OpenRotatingFile(path, 4, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Test: Without backups the file starts over
+	_, _ = f.Write([]byte("one\n"))
+	_, _ = f.Write([]byte("two\n"))
+	assert.Equal(t, "two\n", readFile(t, path))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,307 @@
+// Package metrics keeps counters, gauges and histograms and renders them in
+// the Prometheus text exposition format, for Prometheus to scrape.
+//
+// Metrics live in a Registry, which creates each one on first use and hands
+// back the same one afterwards, so independent parts of a program, such as
+// several servers, can share a metric. A metric may have labels, such as
+// the method of a request; it then holds one value per combination of label
+// values, picked with With.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// DefBuckets are the histogram buckets Prometheus uses by default, suited to
+// request durations in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns count buckets, the first at start and each
+// factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+type kind int
+
+const (
+	kindCounter kind = iota
+	kindGauge
+	kindHistogram
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindCounter:
+		return "counter"
+	case kindGauge:
+		return "gauge"
+	}
+	return "histogram"
+}
+
+// Registry holds a program's metrics. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// Default is the registry servers record their metrics in unless told
+// otherwise.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is a metric with all its label combinations.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is one combination of label values and what was recorded for it.
+type series struct {
+	values []string
+	// value holds the float64 bits of a counter or gauge, or the sum of a
+	// histogram's observations
+	value atomic.Uint64
+	// counts holds a histogram's observations per bucket, not cumulated,
+	// with a last one for those above every bucket
+	counts []atomic.Uint64
+}
+
+// register returns the family named name, creating it if needed. It panics
+// if name or a label is invalid, or name is taken by a different metric,
+// since that is a programming error.
+func (r *Registry) register(name, help string, k kind, buckets []float64, labels []string) *family {
+	if !metricName.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	for _, l := range labels {
+		if !labelName.MatchString(l) || strings.HasPrefix(l, "__") || (k == kindHistogram && l == "le") {
+			panic(fmt.Sprintf("metrics: %s: invalid label name %q", name, l))
+		}
+	}
+	if k == kindHistogram && (len(buckets) == 0 || !slices.IsSorted(buckets)) {
+		panic(fmt.Sprintf("metrics: %s: buckets must be given in increasing order", name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != k || !slices.Equal(f.labels, labels) || !slices.Equal(f.buckets, buckets) {
+			panic(fmt.Sprintf("metrics: %s is already registered as a different %s", name, f.kind))
+		}
+		return f
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    k,
+		labels:  slices.Clone(labels),
+		buckets: slices.Clone(buckets),
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// with returns the series for values, creating it if needed.
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if f.kind == kindHistogram {
+			s.counts = make([]atomic.Uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *series) load() float64 {
+	return math.Float64frombits(s.value.Load())
+}
+
+func (s *series) add(delta float64) {
+	for {
+		old := s.value.Load()
+		if s.value.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Counter is a value that only goes up, such as the number of requests
+// served.
+type Counter struct {
+	s *series
+}
+
+// Inc adds one to c.
+func (c *Counter) Inc() {
+	c.s.add(1)
+}
+
+// Add adds delta to c. It panics if delta is negative.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.s.add(delta)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 {
+	return c.s.load()
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter for the label values, given in the order the
+// labels were registered in.
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{v.f.with(values)}
+}
+
+// Counter returns the counter named name, registering it with help first if
+// needed.
+func (r *Registry) Counter(name, help string) *Counter {
+	return &Counter{r.register(name, help, kindCounter, nil, nil).with(nil)}
+}
+
+// CounterVec returns the counter named name with labels, registering it
+// with help first if needed.
+func (r *Registry) CounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, kindCounter, nil, labels)}
+}
+
+// Gauge is a value that goes up and down, such as the number of open
+// connections.
+type Gauge struct {
+	s *series
+}
+
+// Set sets g to v.
+func (g *Gauge) Set(v float64) {
+	g.s.value.Store(math.Float64bits(v))
+}
+
+// Add adds delta, which may be negative, to g.
+func (g *Gauge) Add(delta float64) {
+	g.s.add(delta)
+}
+
+func (g *Gauge) Inc() { g.s.add(1) }
+func (g *Gauge) Dec() { g.s.add(-1) }
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 {
+	return g.s.load()
+}
+
+// GaugeVec is a gauge with labels.
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the gauge for the label values, given in the order the
+// labels were registered in.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{v.f.with(values)}
+}
+
+// Gauge returns the gauge named name, registering it with help first if
+// needed.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	return &Gauge{r.register(name, help, kindGauge, nil, nil).with(nil)}
+}
+
+// GaugeVec returns the gauge named name with labels, registering it with
+// help first if needed.
+func (r *Registry) GaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, kindGauge, nil, labels)}
+}
+
+// Histogram counts observations, such as request durations, in buckets by
+// their upper bound, and keeps their sum.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.s.counts[i].Add(1)
+	h.s.add(v)
+}
+
+// Count returns the number of observations, and Sum their sum.
+func (h *Histogram) Count() uint64 {
+	var n uint64
+	for i := range h.s.counts {
+		n += h.s.counts[i].Load()
+	}
+	return n
+}
+
+func (h *Histogram) Sum() float64 {
+	return h.s.load()
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the histogram for the label values, given in the order the
+// labels were registered in.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{v.f.with(values), v.f.buckets}
+}
+
+// Histogram returns the histogram named name, registering it with help and
+// buckets first if needed. buckets are the upper bounds, in increasing
+// order; a bucket for everything above them is always added.
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	f := r.register(name, help, kindHistogram, buckets, nil)
+	return &Histogram{f.with(nil), f.buckets}
+}
+
+// HistogramVec returns the histogram named name with labels, registering it
+// with help and buckets first if needed.
+func (r *Registry) HistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.register(name, help, kindHistogram, buckets, labels)}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	return buf.String()
+}
+
+func TestTextFormat(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge("open_files", "Files open.").Set(3)
+	requests := r.CounterVec("requests_total", "Requests served.", "method", "code")
+	requests.With("GET", "200").Inc()
+	requests.With("GET", "200").Add(2)
+	requests.With("POST", "500").Inc()
+	h := r.Histogram("latency_seconds", "How long it took.", []float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+
+	// Test: Families come sorted by name and series by label values, with
+	// cumulative histogram buckets
+	assert.Equal(t, `# HELP latency_seconds How long it took.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+# HELP open_files Files open.
+# TYPE open_files gauge
+open_files 3
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 3
+requests_total{method="POST",code="500"} 1
+`, render(t, r))
+}
+
+func TestLabelledHistogram(t *testing.T) {
+	r := NewRegistry()
+	r.HistogramVec("size_bytes", "Sizes.", []float64{10}, "route").With(`/a"b\c`).Observe(4)
+
+	// Test: le follows the other labels, whose values are escaped
+	out := render(t, r)
+	assert.Contains(t, out, `size_bytes_bucket{route="/a\"b\\c",le="10"} 1`+"\n")
+	assert.Contains(t, out, `size_bytes_count{route="/a\"b\\c"} 1`+"\n")
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+
+	// Test: Asking again for a metric returns the same one
+	r.Counter("hits_total", "Hits.").Inc()
+	r.Counter("hits_total", "Hits.").Inc()
+	assert.Equal(t, 2.0, r.Counter("hits_total", "Hits.").Value())
+
+	// Test: Conflicting or invalid definitions are programming errors
+	assert.Panics(t, func() { r.Gauge("hits_total", "Hits.") })
+	assert.Panics(t, func() { r.CounterVec("hits_total", "Hits.", "code") })
+	assert.Panics(t, func() { r.Counter("hits-total", "Hits.") })
+	assert.Panics(t, func() { r.HistogramVec("h", "H.", DefBuckets, "le") })
+	assert.Panics(t, func() { r.Histogram("h", "H.", []float64{1, 0.5}) })
+	assert.Panics(t, func() { r.CounterVec("c", "C.", "a", "b").With("x") })
+	assert.Panics(t, func() { r.Counter("hits_total", "Hits.").Add(-1) })
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				r.CounterVec("c_total", "C.", "l").With("x").Inc()
+				r.Gauge("g", "G.").Add(0.5)
+				r.Histogram("h", "H.", DefBuckets).Observe(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Test: No update is lost
+	assert.Equal(t, 8000.0, r.CounterVec("c_total", "C.", "l").With("x").Value())
+	assert.Equal(t, 4000.0, r.Gauge("g", "G.").Value())
+	assert.Equal(t, uint64(8000), r.Histogram("h", "H.", DefBuckets).Count())
+	assert.Equal(t, 8000.0, r.Histogram("h", "H.", DefBuckets).Sum())
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	assert.Equal(t, []float64{100, 1000, 10000}, ExponentialBuckets(100, 10, 3))
+}
+
+func TestServe(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("up_total", "Up.").Inc()
+	req, err := request.RequestFromReader(strings.NewReader("GET /metrics HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	r.Serve(w, req)
+	require.NoError(t, w.Flush())
+
+	// Test: The metrics are served as text, keeping the connection open
+	res := buf.String()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+	assert.Contains(t, res, "content-type: "+ContentType+"\r\n")
+	assert.NotContains(t, res, "connection: close")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n# HELP up_total Up.\n# TYPE up_total counter\nup_total 1\n"), res)
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteTo writes every metric to w in the text exposition format, sorted by
+// name and label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := slices.Collect(maps.Values(r.families))
+	r.mu.Unlock()
+	slices.SortFunc(families, func(a, b *family) int { return strings.Compare(a.name, b.name) })
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	all := slices.Collect(maps.Values(f.series))
+	f.mu.Unlock()
+	slices.SortFunc(all, func(a, b *series) int { return slices.Compare(a.values, b.values) })
+
+	w.WriteString("# HELP " + f.name + " ")
+	w.WriteString(escape(f.help, false))
+	w.WriteString("\n# TYPE " + f.name + " " + f.kind.String() + "\n")
+	for _, s := range all {
+		if f.kind != kindHistogram {
+			f.writeSample(w, "", s.values, "", s.load())
+			continue
+		}
+		var cumulative uint64
+		for i := range s.counts {
+			cumulative += s.counts[i].Load()
+			le := math.Inf(1)
+			if i < len(f.buckets) {
+				le = f.buckets[i]
+			}
+			f.writeSample(w, "_bucket", s.values, formatFloat(le), float64(cumulative))
+		}
+		f.writeSample(w, "_sum", s.values, "", s.load())
+		f.writeSample(w, "_count", s.values, "", float64(cumulative))
+	}
+}
+
+// writeSample writes one line, with the le label of a histogram bucket if
+// le is set.
+func (f *family) writeSample(w *bufio.Writer, suffix string, values []string, le string, v float64) {
+	w.WriteString(f.name + suffix)
+	if len(values) > 0 || le != "" {
+		w.WriteByte('{')
+		for i, l := range f.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escape(values[i], true) + `"`)
+		}
+		if le != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(`le="` + le + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+// escape escapes backslashes and line feeds, and in label values double
+// quotes.
+func escape(s string, quotes bool) string {
+	if !strings.ContainsAny(s, "\\\n\"") {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '"' && quotes:
+			b.WriteString(`\"`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Serve is a handler answering with every metric in r, for Prometheus to
+// scrape.
+func (r *Registry) Serve(w response.ResponseWriter, req *request.Request) {
+	logger := logging.FromContext(req.Context())
+	var body bytes.Buffer
+	if _, err := r.WriteTo(&body); err != nil {
+		logger.Error("rendering metrics", "err", err)
+		return
+	}
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		logger.Error("writing status line", "err", err)
+		return
+	}
+	h := response.GetDefaultHeaders(body.Len())
+	h.Override("Content-Type", ContentType)
+	if err := w.WriteHeaders(h); err != nil {
+		logger.Error("writing headers", "err", err)
+		return
+	}
+	if _, err := w.WriteBody(body.Bytes()); err != nil {
+		logger.Error("writing body", "err", err)
+	}
+}
@@ -0,0 +1,234 @@
+// Package problem renders error responses as RFC 9457 problem details,
+// negotiating between application/problem+json, HTML and plain text based on
+// the request's Accept header.
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+const (
+	mediaProblemJSON = "application/problem+json"
+	mediaJSON        = "application/json"
+	mediaHTML        = "text/html"
+	mediaText        = "text/plain"
+)
+
+// offers are the representations Write can produce, in order of preference
+// when the client has none.
+var offers = []string{mediaProblemJSON, mediaJSON, mediaHTML, mediaText}
+
+// Problem is an RFC 9457 problem details object. It implements error so
+// handlers can return or pass it around like any other error.
+type Problem struct {
+	// Type is a URI reference identifying the problem type. Empty means
+	// "about:blank", i.e. the problem is just the HTTP status.
+	Type     string
+	Title    string
+	Status   response.StatusCode
+	Detail   string
+	Instance string
+	// Extensions are extra members serialized alongside the standard ones.
+	Extensions map[string]any
+	// Headers are added to the response, e.g. Allow for a 405.
+	Headers headers.Headers
+}
+
+// New returns a problem for status with the status' reason phrase as title.
+func New(status response.StatusCode, detail string) *Problem {
+	return &Problem{
+		Title:  response.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%d %s", p.Status, p.Title)
+	}
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Title, p.Detail)
+}
+
+// MarshalJSON flattens Extensions into the top-level object. Standard members
+// win over extensions with the same name.
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	if p.Type != "" {
+		m["type"] = p.Type
+	}
+	if p.Title != "" {
+		m["title"] = p.Title
+	}
+	if p.Status != 0 {
+		m["status"] = int(p.Status)
+	}
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// Write sends err as a complete error response. A *Problem anywhere in err's
+// chain is rendered as is; any other error becomes a 500 whose detail is only
+// logged, so internal error strings don't leak to clients. req may be nil, or
+// partially parsed, when the request itself could not be read.
+func Write(w response.ResponseWriter, req *request.Request, err error) error {
+	var p *Problem
+	if !errors.As(err, &p) {
+		ctx := context.Background()
+		if req != nil {
+			ctx = req.Context()
+		}
+		logging.FromContext(ctx).Error("internal error", "err", err)
+		p = New(response.StatusServerInternalError, "")
+	}
+	cp := *p
+	p = &cp
+	if p.Status == 0 {
+		p.Status = response.StatusServerInternalError
+	}
+	if p.Title == "" {
+		p.Title = response.StatusText(p.Status)
+	}
+
+	accept := ""
+	if req != nil && req.Headers != nil {
+		accept, _ = req.Headers.Get("Accept")
+	}
+	contentType, body, err := p.render(Negotiate(accept, offers))
+	if err != nil {
+		return err
+	}
+
+	if err := w.WriteStatusLine(p.Status); err != nil {
+		return err
+	}
+	h := response.GetDefaultHeaders(len(body))
+	for k, v := range p.Headers {
+		h.Override(k, v)
+	}
+	h.Override("Content-Type", contentType)
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
+
+func (p *Problem) render(media string) (string, []byte, error) {
+	switch media {
+	case mediaHTML:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "<html>\n<head>\n<title>%d %s</title>\n</head>\n<body>\n", p.Status, html.EscapeString(p.Title))
+		fmt.Fprintf(&sb, "<h1>%s</h1>\n", html.EscapeString(p.Title))
+		if p.Detail != "" {
+			fmt.Fprintf(&sb, "<p>%s</p>\n", html.EscapeString(p.Detail))
+		}
+		sb.WriteString("</body>\n</html>\n")
+		return mediaHTML, []byte(sb.String()), nil
+	case mediaText:
+		text := fmt.Sprintf("%d %s\n", p.Status, p.Title)
+		if p.Detail != "" {
+			text += p.Detail + "\n"
+		}
+		return mediaText, []byte(text), nil
+	default:
+		b, err := json.Marshal(p)
+		if err != nil {
+			return "", nil, err
+		}
+		// clients that only understand plain JSON get the same document
+		if media != mediaJSON {
+			media = mediaProblemJSON
+		}
+		return media, append(b, '\n'), nil
+	}
+}
+
+// Negotiate picks the entry of offers the Accept header value prefers most,
+// honouring q-values and the specificity of media ranges. It returns the first
+// offer when accept is empty or nothing in it is acceptable, since sending an
+// unrequested format beats answering an error with 406.
+func Negotiate(accept string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	ranges := parseAccept(accept)
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			if s := r.matches(offer); s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// matches reports how specifically r matches media: 2 for an exact match,
+// 1 for type/*, 0 for */* and -1 for no match.
+func (r mediaRange) matches(media string) int {
+	typ, subtype, _ := strings.Cut(media, "/")
+	switch {
+	case r.typ == "*" && r.subtype == "*":
+		return 0
+	case r.typ == typ && r.subtype == "*":
+		return 1
+	case r.typ == typ && r.subtype == subtype:
+		return 2
+	}
+	return -1
+}
+
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok {
+			continue
+		}
+		r := mediaRange{typ: typ, subtype: subtype, q: 1}
+		for _, param := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if q, err := strconv.ParseFloat(v, 64); err == nil && q >= 0 && q <= 1 {
+					r.q = q
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
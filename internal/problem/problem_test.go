@@ -0,0 +1,105 @@
+package problem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{name: "no accept header", accept: "", want: mediaProblemJSON},
+		{name: "anything", accept: "*/*", want: mediaProblemJSON},
+		{name: "browser", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: mediaHTML},
+		{name: "plain json", accept: "application/json", want: mediaJSON},
+		{name: "q-values", accept: "text/html;q=0.5, text/plain", want: mediaText},
+		{name: "type wildcard", accept: "text/*", want: mediaHTML},
+		{name: "specific range beats wildcard", accept: "text/*;q=0.9, text/html;q=0.1", want: mediaText},
+		{name: "excluded by q=0", accept: "application/*;q=0, */*", want: mediaHTML},
+		{name: "nothing acceptable", accept: "image/png", want: mediaProblemJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Negotiate(tt.accept, offers))
+		})
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	p := &Problem{
+		Type:       "https://example.com/probs/out-of-credit",
+		Title:      "You do not have enough credit.",
+		Status:     response.StatusForbidden,
+		Detail:     "Your current balance is 30, but that costs 50.",
+		Instance:   "/account/12345/msgs/abc",
+		Extensions: map[string]any{"balance": 30, "status": "ignored"},
+	}
+	b, err := json.Marshal(p)
+	require.NoError(t, err)
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, map[string]any{
+		"type":     "https://example.com/probs/out-of-credit",
+		"title":    "You do not have enough credit.",
+		"status":   float64(403),
+		"detail":   "Your current balance is 30, but that costs 50.",
+		"instance": "/account/12345/msgs/abc",
+		"balance":  float64(30),
+	}, got)
+}
+
+func TestWrite(t *testing.T) {
+	newRequest := func(accept string) *request.Request {
+		h := headers.NewHeaders()
+		if accept != "" {
+			h.Set("Accept", accept)
+		}
+		return &request.Request{Headers: h}
+	}
+	write := func(req *request.Request, err error) string {
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		require.NoError(t, Write(w, req, err))
+		require.NoError(t, w.Flush())
+		return buf.String()
+	}
+
+	// Test: problem+json by default
+	out := write(newRequest(""), New(response.StatusNotFound, "no such thing"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "content-type: application/problem+json\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n{\"detail\":\"no such thing\",\"status\":404,\"title\":\"Not Found\"}\n"))
+
+	// Test: HTML is escaped
+	out = write(newRequest("text/html"), New(response.StatusBadRequest, "<script>"))
+	assert.Contains(t, out, "content-type: text/html\r\n")
+	assert.Contains(t, out, "<h1>Bad Request</h1>\n<p>&lt;script&gt;</p>\n")
+
+	// Test: plain text, with a nil request
+	out = write(nil, New(response.StatusBadRequest, "bad"))
+	assert.Contains(t, out, "content-type: application/problem+json\r\n")
+	out = write(newRequest("text/plain"), New(response.StatusBadRequest, "bad"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n400 Bad Request\nbad\n"))
+
+	// Test: wrapped problems are found, other errors hide their details
+	out = write(newRequest("text/plain"), fmt.Errorf("loading: %w", New(response.StatusServiceUnavailable, "try later")))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"))
+	out = write(newRequest("text/plain"), errors.New("db password is hunter2"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.NotContains(t, out, "hunter2")
+}
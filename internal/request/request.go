@@ -1,7 +1,10 @@
 package request
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +21,9 @@ const (
 	requestStateInitilized ParseState = iota
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingTrailers
 	requestStateDone
 )
 
@@ -25,8 +31,69 @@ type Request struct {
 	RequestLine    RequestLine
 	Headers        headers.Headers
 	Body           []byte
+	Trailers       headers.Headers
 	bodyReadLength int
+	chunkRemaining int
 	ParseState     ParseState
+
+	// fields and fieldBytes count the header and trailer fields parsed, to
+	// hold them to maxHeaderFields and maxHeaderBytes.
+	fields     int
+	fieldBytes int
+	// maxBodySize bounds the body, if positive
+	maxBodySize int64
+
+	// headerOrder and trailerOrder remember the order field names were first
+	// seen on the wire, so Write can emit them back in the same order.
+	headerOrder  []string
+	trailerOrder []string
+
+	// TLS describes the connection the request arrived on, nil if it was
+	// not TLS.
+	TLS *tls.ConnectionState
+	// RemoteAddr is the address of the client, as the server's connection
+	// reports it, e.g. "192.0.2.1:54321". It is empty for requests that were
+	// not read by the server.
+	RemoteAddr string
+
+	ctx        context.Context
+	pathValues map[string]string
+}
+
+// PathValue returns the value of the named path parameter captured by the
+// router, or "" if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue sets the named path parameter, as returned by PathValue.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
+// Path returns the request target without its query string.
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+// Context returns the request's context. The server cancels it when the
+// client disconnects or the handler returns.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
 }
 
 type RequestLine struct {
@@ -37,41 +104,87 @@ type RequestLine struct {
 
 const crlf = "\r\n"
 
-const bufferSize = 8
+// maxLineSize bounds a single request line, header field or chunk size line:
+// the parser needs a whole line in the read buffer before it can consume it.
+const maxLineSize = 64 << 10
+
+// ErrLineTooLong is returned when a line of the request does not fit in the
+// reader's buffer.
+var ErrLineTooLong = errors.New("request line or header field too long")
+
+// maxHeaderFields and maxHeaderBytes bound the header section, together with
+// the trailers, by field count and by size.
+const (
+	maxHeaderFields = 500
+	maxHeaderBytes  = 1 << 20
+)
+
+// ErrHeaderTooLarge is returned when the header section, or the trailers,
+// have more fields or bytes than the parser accepts.
+var ErrHeaderTooLarge = errors.New("request header section too large")
+
+// ErrBodyTooLarge is returned by ReadRequestLimited when the body is longer
+// than allowed, as soon as its Content-Length or chunks say so.
+var ErrBodyTooLarge = errors.New("request body too large")
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	readToIndex := 0
+	return ReadRequest(bufio.NewReaderSize(reader, maxLineSize), nil)
+}
+
+// ReadRequest reads exactly one request from br, leaving any bytes that
+// follow it (such as a pipelined request) buffered for the next call. If
+// onHeaders is not nil it is called once the header section has been parsed,
+// before the body is read. If br is at EOF before the request starts,
+// ReadRequest returns io.EOF.
+func ReadRequest(br *bufio.Reader, onHeaders func(*Request)) (*Request, error) {
+	return ReadRequestLimited(br, 0, onHeaders)
+}
+
+// ReadRequestLimited is like ReadRequest but fails with ErrBodyTooLarge
+// for a body longer than maxBodySize bytes, if it is positive.
+func ReadRequestLimited(br *bufio.Reader, maxBodySize int64, onHeaders func(*Request)) (*Request, error) {
 	r := &Request{
-		ParseState: requestStateInitilized,
-		Headers:    headers.NewHeaders(),
-		Body:       make([]byte, 0),
+		ParseState:  requestStateInitilized,
+		Headers:     headers.NewHeaders(),
+		Body:        make([]byte, 0),
+		Trailers:    headers.NewHeaders(),
+		maxBodySize: maxBodySize,
 	}
-	buffer := make([]byte, bufferSize)
+	started := false
 	for r.ParseState != requestStateDone {
-		if readToIndex >= len(buffer) {
-			newBuf := make([]byte, len(buffer)*2)
-			copy(newBuf, buffer)
-			buffer = newBuf
-		}
-		numBytesRead, err := reader.Read(buffer[readToIndex:])
+		data, _ := br.Peek(br.Buffered())
+		state := r.ParseState
+		numBytesParsed, err := r.parse(data)
 		if err != nil {
+			return r, err
+		}
+		if _, err := br.Discard(numBytesParsed); err != nil {
+			return nil, err
+		}
+		if state <= requestStateParsingHeaders && r.ParseState > requestStateParsingHeaders && onHeaders != nil {
+			onHeaders(r)
+		}
+		if numBytesParsed > 0 || r.ParseState != state {
+			// parse whatever is still buffered before reading more
+			started = true
+			continue
+		}
+
+		// The parser needs more than is buffered: read at least one more byte.
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return r, ErrLineTooLong
+			}
 			if errors.Is(err, io.EOF) {
-				// if we "Read" to EOF and the parse state is not Done, an actual error happens
-				if r.ParseState != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", r.ParseState, numBytesRead)
+				if !started && br.Buffered() == 0 {
+					return nil, io.EOF
 				}
-				break
+				// if we "Read" to EOF and the parse state is not Done, an actual error happens
+				return nil, fmt.Errorf("incomplete request, in state: %d, unparsed bytes on EOF: %d", r.ParseState, br.Buffered())
 			}
 			return nil, err
 		}
-		readToIndex += numBytesRead
-
-		numBytesParsed, err := r.parse(buffer[:readToIndex])
-		if err != nil {
-			return r, err
-		}
-		copy(buffer, buffer[numBytesParsed:])
-		readToIndex -= numBytesParsed
+		started = true
 	}
 	return r, nil
 }
@@ -79,12 +192,19 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.ParseState != requestStateDone {
+		state := r.ParseState
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
 		}
 		totalBytesParsed += n
-		if n == 0 {
+		// stop once no progress is made, i.e. more data is needed
+		if n == 0 && r.ParseState == state {
+			break
+		}
+		// pause after the headers so the caller can act on them before
+		// the body is read
+		if state == requestStateParsingHeaders && r.ParseState != state {
 			break
 		}
 	}
@@ -107,7 +227,7 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		r.ParseState = requestStateParsingHeaders // Once request line is parse change state to start parse header
 		return n, nil
 	case requestStateParsingHeaders:
-		n, done, err := r.Headers.Parse(data)
+		n, key, done, err := r.Headers.ParseField(data)
 		if err != nil {
 			return 0, err
 		}
@@ -115,11 +235,25 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			// just need more data
 			return 0, nil
 		}
+		if err := r.countField(n, key); err != nil {
+			return 0, err
+		}
+		r.headerOrder = appendNewKey(r.headerOrder, r.Headers, key)
 		if done {
 			r.ParseState = requestStateParsingBody
 		}
 		return n, nil
 	case requestStateParsingBody:
+		// Transfer-Encoding takes precedence over Content-Length (RFC 9112
+		// section 6.3), and a request body can only be framed by it if
+		// chunked is the final coding
+		if _, ok := r.Headers.Get("Transfer-Encoding"); ok {
+			if !r.IsChunked() {
+				return 0, errors.New("invalid Transfer-Encoding: chunked is not the final coding")
+			}
+			r.ParseState = requestStateParsingChunkSize
+			return 0, nil
+		}
 		// If header doesn't contain Content-Length, don't parse the body
 		contentLengthVal, ok := r.Headers.Get("Content-Length")
 		if !ok {
@@ -130,18 +264,78 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
-
-		// Append the data to the r.Body
-		r.Body = append(r.Body, data...)
-		r.bodyReadLength += len(data)
-		if r.bodyReadLength > contentLengthValInt {
-			return 0, fmt.Errorf("Content-Length too large")
+		if contentLengthValInt < 0 {
+			return 0, fmt.Errorf("invalid Content-Length: %d", contentLengthValInt)
 		}
+		if r.maxBodySize > 0 && int64(contentLengthValInt) > r.maxBodySize {
+			return 0, ErrBodyTooLarge
+		}
+
+		// Append the data to the r.Body, leaving whatever follows the body
+		// for the next request on the connection
+		n := min(len(data), contentLengthValInt-r.bodyReadLength)
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyReadLength += n
 		if r.bodyReadLength == contentLengthValInt {
 			r.ParseState = requestStateDone
 		}
 
-		return len(data), nil
+		return n, nil
+
+	case requestStateParsingChunkSize:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			return 0, nil
+		}
+		size, err := parseChunkSize(data[:idx])
+		if err != nil {
+			return 0, err
+		}
+		if r.maxBodySize > 0 && int64(r.bodyReadLength)+int64(size) > r.maxBodySize {
+			return 0, ErrBodyTooLarge
+		}
+		if size == 0 {
+			r.ParseState = requestStateParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.ParseState = requestStateParsingChunkData
+		}
+		return idx + 2, nil
+
+	case requestStateParsingChunkData:
+		if r.chunkRemaining == 0 {
+			// every chunk's data is followed by a CRLF
+			if len(data) < len(crlf) {
+				return 0, nil
+			}
+			if !bytes.HasPrefix(data, []byte(crlf)) {
+				return 0, errors.New("invalid chunk: missing CRLF after chunk data")
+			}
+			r.ParseState = requestStateParsingChunkSize
+			return len(crlf), nil
+		}
+		n := min(len(data), r.chunkRemaining)
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyReadLength += n
+		r.chunkRemaining -= n
+		return n, nil
+
+	case requestStateParsingTrailers:
+		n, key, done, err := r.Trailers.ParseField(data)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		if err := r.countField(n, key); err != nil {
+			return 0, err
+		}
+		r.trailerOrder = appendNewKey(r.trailerOrder, r.Trailers, key)
+		if done {
+			r.ParseState = requestStateDone
+		}
+		return n, nil
 
 	case requestStateDone:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
@@ -150,6 +344,50 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
+// IsChunked reports whether the request body uses the chunked transfer coding,
+// which must be the final coding listed in Transfer-Encoding.
+func (r *Request) IsChunked() bool {
+	te, ok := r.Headers.Get("Transfer-Encoding")
+	if !ok {
+		return false
+	}
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// parseChunkSize parses the hex chunk size, ignoring any chunk extensions.
+func parseChunkSize(line []byte) (int, error) {
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(line)), 16, 32)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid chunk size: %q", line)
+	}
+	return int(size), nil
+}
+
+// countField counts a header or trailer line of n bytes against the limits.
+func (r *Request) countField(n int, key string) error {
+	if key != "" {
+		r.fields++
+	}
+	r.fieldBytes += n
+	if r.fields > maxHeaderFields || r.fieldBytes > maxHeaderBytes {
+		return ErrHeaderTooLarge
+	}
+	return nil
+}
+
+// appendNewKey appends key, the field name just parsed into h, if it is the
+// first with that name: then h has gained an entry that order lacks.
+func appendNewKey(order []string, h headers.Headers, key string) []string {
+	if key == "" || len(h) == len(order) {
+		return order
+	}
+	return append(order, key)
+}
+
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	idx := bytes.Index(data, []byte(crlf))
 	// If it cannot find the \r\n, it means we need more data before we process
@@ -1,8 +1,12 @@
 package request
 
 import (
+	"bufio"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -222,3 +226,172 @@ func TestParseBody(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
 }
+
+func TestParseChunkedBody(t *testing.T) {
+	// Test: Chunked body with trailers
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7;ext=1\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers["x-checksum"])
+
+	// Test: Chunked takes precedence over Content-Length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 100\r\n" +
+			"Transfer-Encoding: gzip, chunked\r\n" +
+			"\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+	assert.Empty(t, r.Trailers)
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"2\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Missing last chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nabc\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: A Transfer-Encoding without chunked last cannot frame the body,
+	// and is not left to Content-Length to do so
+	for _, te := range []string{"gzip", "chunked, gzip"} {
+		_, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 3\r\n" +
+			"Transfer-Encoding: " + te + "\r\n" +
+			"\r\nabc"))
+		require.Error(t, err, te)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	read := func(raw string) (*Request, error) {
+		return ReadRequestLimited(bufio.NewReader(strings.NewReader(raw)), 5, nil)
+	}
+
+	// Test: A body up to the limit is read
+	r, err := read("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	r, err = read("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhe\r\n3\r\nllo\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: A longer one fails as soon as its length is known
+	_, err = read("POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\n")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	_, err = read("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n3\r\n")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestReadRequest(t *testing.T) {
+	// Test: Pipelined requests are read one at a time
+	br := bufio.NewReader(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+			"GET /two HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 4,
+	})
+	headersSeen := 0
+	r, err := ReadRequest(br, func(r *Request) {
+		headersSeen++
+		assert.Equal(t, "3", r.Headers["content-length"])
+		assert.Empty(t, r.Body)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, headersSeen)
+	assert.Equal(t, "/one", r.RequestLine.RequestTarget)
+	assert.Equal(t, "abc", string(r.Body))
+
+	r, err = ReadRequest(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", r.Headers["host"])
+
+	// Test: EOF between requests
+	_, err = ReadRequest(br, nil)
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A line longer than the buffer
+	br = bufio.NewReaderSize(strings.NewReader("GET /"+strings.Repeat("a", 100)+" HTTP/1.1\r\n\r\n"), 16)
+	_, err = ReadRequest(br, nil)
+	require.ErrorIs(t, err, ErrLineTooLong)
+}
+
+func TestHeaderLimits(t *testing.T) {
+	// Test: Many fields are parsed in linear time, and keep their order
+	var sb strings.Builder
+	sb.WriteString("GET / HTTP/1.1\r\n")
+	for i := range maxHeaderFields {
+		fmt.Fprintf(&sb, "X-Field-%d: %d\r\nX-Field-0: again\r\n", i, i)
+	}
+	sb.WriteString("\r\n")
+	start := time.Now()
+	_, err := RequestFromReader(strings.NewReader(sb.String()))
+	// the repeats count too, so this is twice over the limit
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.Less(t, time.Since(start), time.Second)
+
+	sb.Reset()
+	sb.WriteString("GET / HTTP/1.1\r\n")
+	for i := range maxHeaderFields {
+		fmt.Fprintf(&sb, "X-Field-%d: %d\r\n", i, i)
+	}
+	sb.WriteString("\r\n")
+	r, err := RequestFromReader(strings.NewReader(sb.String()))
+	require.NoError(t, err)
+	require.Len(t, r.headerOrder, maxHeaderFields)
+	assert.Equal(t, "x-field-0", r.headerOrder[0])
+	assert.Equal(t, fmt.Sprintf("x-field-%d", maxHeaderFields-1), r.headerOrder[maxHeaderFields-1])
+
+	// Test: So is the size of the header section, though each line fits
+	line := "X-Big: " + strings.Repeat("a", 60<<10) + "\r\n"
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n" + strings.Repeat(line, 20) + "\r\n"))
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Trailers count against the same limits
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n" +
+		strings.Repeat("X-T: b\r\n", maxHeaderFields+1) + "\r\n"))
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+}
@@ -0,0 +1,41 @@
+package request
+
+import (
+	"crypto/x509"
+	"net"
+	"net/url"
+)
+
+// SANs are the subject alternative names of a certificate.
+type SANs struct {
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+}
+
+// PeerCertificates returns the client certificate chain the server
+// verified, leaf first. It is nil if the client sent no certificate or the
+// server did not verify it.
+func (r *Request) PeerCertificates() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0]
+}
+
+// PeerSANs returns the subject alternative names of the verified client
+// certificate, if there is one.
+func (r *Request) PeerSANs() SANs {
+	chain := r.PeerCertificates()
+	if chain == nil {
+		return SANs{}
+	}
+	leaf := chain[0]
+	return SANs{
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+	}
+}
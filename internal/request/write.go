@@ -0,0 +1,94 @@
+package request
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+)
+
+// Write serializes the request onto w in HTTP/1.1 wire format: the request
+// line, the headers, then the body framed either with chunked transfer coding
+// (followed by the trailers) or with a Content-Length matching len(r.Body).
+//
+// Headers parsed by RequestFromReader are written in the order they were
+// received; headers added afterwards follow in lexical order. Writing a
+// request, parsing the output and writing it again yields identical bytes.
+func (r *Request) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	if _, err := fmt.Fprintf(bw, "%s %s HTTP/%s\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget, version); err != nil {
+		return err
+	}
+
+	chunked := r.IsChunked()
+	h := headers.NewHeaders()
+	for k, v := range r.Headers {
+		h.Override(k, v)
+	}
+	if chunked {
+		// a sender must not send Content-Length alongside Transfer-Encoding
+		h.Delete("Content-Length")
+	} else {
+		if len(r.Trailers) > 0 {
+			return errors.New("trailers require chunked transfer coding")
+		}
+		if _, ok := h.Get("Content-Length"); ok || len(r.Body) > 0 {
+			h.Override("Content-Length", strconv.Itoa(len(r.Body)))
+		}
+	}
+	if err := writeFields(bw, h, r.headerOrder); err != nil {
+		return err
+	}
+
+	if chunked {
+		if len(r.Body) > 0 {
+			if _, err := fmt.Fprintf(bw, "%x\r\n%s\r\n", len(r.Body), r.Body); err != nil {
+				return err
+			}
+		}
+		if _, err := bw.WriteString("0\r\n"); err != nil {
+			return err
+		}
+		if err := writeFields(bw, r.Trailers, r.trailerOrder); err != nil {
+			return err
+		}
+	} else if _, err := bw.Write(r.Body); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeFields writes h as a field section terminated by an empty line, using
+// order for the names it contains and lexical order for the rest.
+func writeFields(w io.Writer, h headers.Headers, order []string) error {
+	keys := make([]string, 0, len(h))
+	for _, k := range order {
+		if _, ok := h[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	rest := make([]string, 0, len(h)-len(keys))
+	for k := range h {
+		if !slices.Contains(keys, k) {
+			rest = append(rest, k)
+		}
+	}
+	slices.Sort(rest)
+
+	for _, k := range append(keys, rest...) {
+		if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, h[k]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, crlf)
+	return err
+}
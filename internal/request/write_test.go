@@ -0,0 +1,87 @@
+package request
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		wire string
+	}{
+		{
+			name: "no body",
+			wire: "GET / HTTP/1.1\r\nhost: localhost:42069\r\nuser-agent: curl/7.81.0\r\naccept: */*\r\n\r\n",
+		},
+		{
+			name: "content-length body",
+			wire: "POST /submit HTTP/1.1\r\nhost: localhost:42069\r\ncontent-length: 13\r\n\r\nhello world!\n",
+		},
+		{
+			name: "empty content-length body",
+			wire: "POST /submit HTTP/1.1\r\ncontent-length: 0\r\nhost: localhost:42069\r\n\r\n",
+		},
+		{
+			name: "chunked body with trailers",
+			wire: "POST /submit HTTP/1.1\r\nhost: localhost:42069\r\ntransfer-encoding: chunked\r\ntrailer: x-checksum, x-length\r\n\r\n" +
+				"d\r\nhello world!\n\r\n0\r\nx-length: 13\r\nx-checksum: abc123\r\n\r\n",
+		},
+		{
+			name: "empty chunked body",
+			wire: "PUT /empty HTTP/1.1\r\ntransfer-encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := RequestFromReader(&chunkReader{data: tt.wire, numBytesPerRead: 3})
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			require.NoError(t, r.Write(&buf))
+			assert.Equal(t, tt.wire, buf.String())
+
+			r2, err := RequestFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 7})
+			require.NoError(t, err)
+			assert.Equal(t, r.RequestLine, r2.RequestLine)
+			assert.Equal(t, r.Headers, r2.Headers)
+			assert.Equal(t, r.Body, r2.Body)
+			assert.Equal(t, r.Trailers, r2.Trailers)
+		})
+	}
+}
+
+func TestRequestWriteNormalizesFraming(t *testing.T) {
+	// Test: Merged duplicate and multi-chunk input settle into a stable form
+	r, err := RequestFromReader(strings.NewReader(
+		"POST /submit HTTP/1.1\r\nHost: a\r\nHost: b\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n" +
+			"2\r\nab\r\n1\r\nc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	var first bytes.Buffer
+	require.NoError(t, r.Write(&first))
+	assert.Equal(t, "POST /submit HTTP/1.1\r\nhost: a, b\r\ntransfer-encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", first.String())
+
+	r2, err := RequestFromReader(bytes.NewReader(first.Bytes()))
+	require.NoError(t, err)
+	var second bytes.Buffer
+	require.NoError(t, r2.Write(&second))
+	assert.Equal(t, first.String(), second.String())
+
+	// Test: Programmatic request gets a Content-Length and sorted headers
+	r = &Request{
+		RequestLine: RequestLine{Method: "PUT", RequestTarget: "/item", HttpVersion: "1.1"},
+		Headers:     map[string]string{"x-b": "2", "x-a": "1"},
+		Body:        []byte("data"),
+	}
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "PUT /item HTTP/1.1\r\ncontent-length: 4\r\nx-a: 1\r\nx-b: 2\r\n\r\ndata", buf.String())
+
+	// Test: Trailers without chunked framing cannot be written
+	r.Trailers = map[string]string{"x-sum": "1"}
+	require.Error(t, r.Write(&buf))
+}
@@ -9,22 +9,68 @@ import (
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusServerInternalError StatusCode = 500
+	StatusContinue                    StatusCode = 100
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusProcessing                  StatusCode = 102
+	StatusEarlyHints                  StatusCode = 103
+	StatusOK                          StatusCode = 200
+	StatusNoContent                   StatusCode = 204
+	StatusBadRequest                  StatusCode = 400
+	StatusUnauthorized                StatusCode = 401
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusNotAcceptable               StatusCode = 406
+	StatusRequestTimeout              StatusCode = 408
+	StatusContentTooLarge             StatusCode = 413
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusUpgradeRequired             StatusCode = 426
+	StatusTooManyRequests             StatusCode = 429
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusServerInternalError         StatusCode = 500
+	StatusNotImplemented              StatusCode = 501
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
+	StatusHTTPVersionNotSupported     StatusCode = 505
 )
 
 var statusCodeMap = map[StatusCode]string{
-	StatusOK:                  "HTTP/1.1 200 OK\r\n",
-	StatusBadRequest:          "HTTP/1.1 400 Bad Request\r\n",
-	StatusServerInternalError: "HTTP/1.1 500 Internal Server Error\r\n",
+	StatusContinue:                    "Continue",
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusProcessing:                  "Processing",
+	StatusEarlyHints:                  "Early Hints",
+	StatusOK:                          "OK",
+	StatusNoContent:                   "No Content",
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusNotAcceptable:               "Not Acceptable",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusContentTooLarge:             "Content Too Large",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusServerInternalError:         "Internal Server Error",
+	StatusNotImplemented:              "Not Implemented",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+	StatusHTTPVersionNotSupported:     "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for statusCode, or "" if unknown.
+func StatusText(statusCode StatusCode) string {
+	return statusCodeMap[statusCode]
 }
 
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 	defaultHeaders := map[string]string{
 		"Content-Length": fmt.Sprintf("%d", contentLen),
-		"Connection":     "close",
 		"Content-Type":   "text/plain",
 	}
 
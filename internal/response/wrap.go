@@ -0,0 +1,153 @@
+package response
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+)
+
+// ResponseWriter is what handlers write their response through. *Writer is
+// the implementation the server hands out; middleware may wrap it.
+type ResponseWriter interface {
+	WriteInformational(statusCode StatusCode, h headers.Headers) error
+	WriteStatusLine(statusCode StatusCode) error
+	WriteHeaders(h headers.Headers) error
+	WriteBody(p []byte) (int, error)
+	WriteChunkedBody(p []byte) (int, error)
+	WriteChunkedBodyDone() (int, error)
+	WriteTrailers(h headers.Headers) error
+}
+
+// Flusher is implemented by writers that buffer, to push buffered bytes to
+// the client.
+type Flusher interface {
+	Flush() error
+}
+
+// Hijacker is implemented by writers whose connection a handler may take
+// over, e.g. to speak WebSocket on it. After Hijack the server no longer
+// reads, writes or closes the connection: the caller owns it. The returned
+// reader holds whatever the client sent after the request.
+type Hijacker interface {
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
+}
+
+// ErrNotSupported is returned when no writer in a chain of wrappers has the
+// requested capability.
+var ErrNotSupported = errors.New("response: feature not supported by writer")
+
+// Wrapper is meant to be embedded by middleware that wraps a ResponseWriter.
+// It forwards every method to the wrapped writer, so the middleware only
+// overrides what it needs, and it keeps the optional capabilities of the
+// writers underneath reachable through Unwrap.
+//
+// A wrapper that overrides WriteBody must also override ReadFrom, otherwise
+// bodies copied with ReadFrom would bypass it.
+type Wrapper struct {
+	ResponseWriter
+}
+
+// Unwrap returns the wrapped writer.
+func (w Wrapper) Unwrap() ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush flushes the first writer down the chain that buffers.
+func (w Wrapper) Flush() error {
+	return Flush(w.ResponseWriter)
+}
+
+// ReadFrom copies r into the wrapped writer's body.
+func (w Wrapper) ReadFrom(r io.Reader) (int64, error) {
+	return ReadFrom(w.ResponseWriter, r)
+}
+
+// Flush flushes w, or the first writer it wraps that implements Flusher.
+func Flush(w ResponseWriter) error {
+	for w != nil {
+		if f, ok := w.(Flusher); ok {
+			return f.Flush()
+		}
+		w = unwrap(w)
+	}
+	return ErrNotSupported
+}
+
+// ReadFrom copies r into w's body, using w's own ReadFrom when it has one so
+// the copy can skip intermediate buffers.
+func ReadFrom(w ResponseWriter, r io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(bodyWriter{w}, r)
+}
+
+// Hijack takes over the connection of w, or of the first writer it wraps
+// that implements Hijacker. Only HTTP/1.1 connections can be hijacked.
+func Hijack(w ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	for w != nil {
+		if h, ok := w.(Hijacker); ok {
+			return h.Hijack()
+		}
+		w = unwrap(w)
+	}
+	return nil, nil, ErrNotSupported
+}
+
+// WriteSwitchingProtocols sends 101 Switching Protocols with h through w, or
+// the first writer it wraps that can send one, such as *Writer. Only
+// HTTP/1.1 responses can switch protocols.
+func WriteSwitchingProtocols(w ResponseWriter, h headers.Headers) error {
+	for w != nil {
+		if s, ok := w.(interface{ WriteSwitchingProtocols(h headers.Headers) error }); ok {
+			return s.WriteSwitchingProtocols(h)
+		}
+		w = unwrap(w)
+	}
+	return ErrNotSupported
+}
+
+// StatsOf returns the stats of the first writer in w's chain of wrappers
+// that reports them, such as *Writer, if there is one.
+func StatsOf(w ResponseWriter) (Stats, bool) {
+	for w != nil {
+		if base, ok := w.(interface{ Stats() Stats }); ok {
+			return base.Stats(), true
+		}
+		w = unwrap(w)
+	}
+	return Stats{}, false
+}
+
+// CountUnencodedBody tells the first writer in w's chain that keeps stats
+// that n bytes of body were written before a content coding. A wrapper that
+// compresses the body calls it with each write it is handed, and passes the
+// compressed bytes down as usual, so Stats reports both sizes.
+func CountUnencodedBody(w ResponseWriter, n int64) {
+	for w != nil {
+		if c, ok := w.(interface{ CountUnencodedBody(n int64) }); ok {
+			c.CountUnencodedBody(n)
+			return
+		}
+		w = unwrap(w)
+	}
+}
+
+func unwrap(w ResponseWriter) ResponseWriter {
+	if u, ok := w.(interface{ Unwrap() ResponseWriter }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
+
+// bodyWriter adapts a ResponseWriter's body to io.Writer.
+type bodyWriter struct {
+	w ResponseWriter
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.WriteBody(p)
+}
@@ -0,0 +1,184 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+)
+
+// upperWriter upper-cases the body, overriding ReadFrom as Wrapper asks.
+type upperWriter struct {
+	Wrapper
+}
+
+func (w upperWriter) WriteBody(p []byte) (int, error) {
+	return w.Wrapper.WriteBody(bytes.ToUpper(p))
+}
+
+func (w upperWriter) ReadFrom(r io.Reader) (int64, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+	_, err = w.WriteBody(buf.Bytes())
+	return n, err
+}
+
+// gzipWriter compresses a chunked body, reporting what it was handed with
+// CountUnencodedBody.
+type gzipWriter struct {
+	Wrapper
+	zw *gzip.Writer
+}
+
+func newGzipWriter(w ResponseWriter) *gzipWriter {
+	g := &gzipWriter{Wrapper: Wrapper{ResponseWriter: w}}
+	g.zw = gzip.NewWriter(chunkWriter{w})
+	return g
+}
+
+func (g *gzipWriter) WriteChunkedBody(p []byte) (int, error) {
+	CountUnencodedBody(g.ResponseWriter, int64(len(p)))
+	return g.zw.Write(p)
+}
+
+func (g *gzipWriter) WriteChunkedBodyDone() (int, error) {
+	if err := g.zw.Close(); err != nil {
+		return 0, err
+	}
+	return g.ResponseWriter.WriteChunkedBodyDone()
+}
+
+// chunkWriter writes to w's chunked body.
+type chunkWriter struct {
+	w ResponseWriter
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	return c.w.WriteChunkedBody(p)
+}
+
+// connWriter can hand over its connection.
+type connWriter struct {
+	*Writer
+	conn net.Conn
+}
+
+func (w connWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// plainWriter has no optional capabilities of its own.
+type plainWriter struct {
+	ResponseWriter
+}
+
+func TestWrapper(t *testing.T) {
+	var buf bytes.Buffer
+	base := NewWriter(&buf)
+	w := Wrapper{ResponseWriter: Wrapper{ResponseWriter: base}}
+
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	// Test: ReadFrom reaches the Writer through two wrappers
+	n, err := ReadFrom(w, strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	// Test: Nothing is sent until Flush reaches the Writer
+	assert.Empty(t, buf.String())
+	require.NoError(t, Flush(w))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"), buf.String())
+
+	// Test: StatsOf finds the Writer's stats
+	stats, ok := StatsOf(w)
+	require.True(t, ok)
+	assert.Equal(t, StatusOK, stats.StatusCode)
+	assert.Equal(t, int64(5), stats.BodyBytes)
+}
+
+func TestWrapperOverride(t *testing.T) {
+	var buf bytes.Buffer
+	w := upperWriter{Wrapper{ResponseWriter: NewWriter(&buf)}}
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := ReadFrom(w, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NoError(t, Flush(w))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nHELLO"), buf.String())
+
+	// Test: A writer that does not unwrap hides the capabilities beneath it
+	buf.Reset()
+	p := plainWriter{NewWriter(&buf)}
+	assert.ErrorIs(t, Flush(p), ErrNotSupported)
+	_, ok := StatsOf(p)
+	assert.False(t, ok)
+	// but ReadFrom still works by falling back to WriteBody
+	require.NoError(t, p.WriteStatusLine(StatusOK))
+	require.NoError(t, p.WriteHeaders(GetDefaultHeaders(2)))
+	n, err := ReadFrom(p, strings.NewReader("hi"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestCountUnencodedBody(t *testing.T) {
+	var buf bytes.Buffer
+	w := newGzipWriter(NewWriter(&buf))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	body := bytes.Repeat([]byte("a"), 10240)
+	for i := 0; i < 10; i++ {
+		_, err := w.WriteChunkedBody(body[i*1024 : (i+1)*1024])
+		require.NoError(t, err)
+	}
+	_, err := w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(nil))
+	require.NoError(t, Flush(w))
+
+	// Test: A coding wrapper's writes count as the body, and what it passed
+	// down as the body sent
+	stats, ok := StatsOf(w)
+	require.True(t, ok)
+	assert.Equal(t, int64(10240), stats.BodyBytes)
+	assert.Positive(t, stats.EncodedBodyBytes)
+	assert.Less(t, stats.EncodedBodyBytes, int64(200))
+
+	// and the sent bytes are the compressed body
+	_, rest, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+rest)), nil)
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	got, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+}
+
+func TestHijack(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Test: Hijack reaches the connection through a wrapper
+	w := Wrapper{ResponseWriter: connWriter{NewWriter(server), server}}
+	conn, rw, err := Hijack(w)
+	require.NoError(t, err)
+	assert.Equal(t, server, conn)
+	assert.NotNil(t, rw)
+
+	// Test: Writers without a connection cannot be hijacked
+	_, _, err = Hijack(Wrapper{ResponseWriter: NewWriter(io.Discard)})
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
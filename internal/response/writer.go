@@ -1,9 +1,12 @@
 package response
 
 import (
+	"bufio"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"sync/atomic"
+	"time"
 
 	"httpfromtcp.haonguyen.tech/internal/headers"
 )
@@ -15,15 +18,142 @@ const (
 	writerStateHeaders
 	writerStateBody
 	writerStateTrailers
+	// writerStateSwitched follows a 101: the connection no longer speaks
+	// HTTP
+	writerStateSwitched
 )
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	wire := &wireCounter{w: w}
+	return &Writer{
+		writer:         bufio.NewWriter(wire),
+		wire:           wire,
+		requestVersion: "1.1",
+		start:          time.Now(),
+	}
 }
 
 type Writer struct {
-	writer      io.Writer
-	writerState writerState
+	writer         *bufio.Writer
+	writerState    writerState
+	requestVersion string
+	closeConn      atomic.Bool
+
+	// what has been sent so far, reported by Stats
+	wire       *wireCounter
+	start      time.Time
+	statusCode StatusCode
+	headers    headers.Headers
+	bodyBytes  int64
+	// unencoded counts the body above a content coding, if a wrapper
+	// reported one with CountUnencodedBody
+	unencoded int64
+	coded     bool
+}
+
+// Stats describes what a Writer has sent. Read it once the handler has
+// returned and the response has been flushed.
+type Stats struct {
+	// StatusCode is the final status sent, or 0 if none was.
+	StatusCode StatusCode
+	// Headers is a copy of the header section sent with the final status.
+	Headers headers.Headers
+	// BodyBytes counts the body bytes the handler wrote, before any
+	// content coding, and EncodedBodyBytes those sent, after it. They are
+	// the same unless a wrapper, such as a gzip middleware, applied a coding
+	// and said so with CountUnencodedBody.
+	BodyBytes        int64
+	EncodedBodyBytes int64
+	// WireBytes counts every byte written to the connection: status lines,
+	// headers, chunk framing and the (possibly compressed) body.
+	WireBytes int64
+	// Start is when the Writer was created, i.e. when the request was read.
+	Start time.Time
+	// TimeToFirstByte is the time from Start until the first byte reached
+	// the connection, and Duration until the last one did. Both are zero if
+	// nothing was written.
+	TimeToFirstByte time.Duration
+	Duration        time.Duration
+}
+
+// Stats reports the status, headers, byte counts and timings of the response
+// written so far.
+func (w *Writer) Stats() Stats {
+	st := Stats{
+		StatusCode:       w.statusCode,
+		Headers:          w.headers,
+		BodyBytes:        w.bodyBytes,
+		EncodedBodyBytes: w.bodyBytes,
+		WireBytes:        w.wire.n,
+		Start:            w.start,
+	}
+	if w.coded {
+		st.BodyBytes = w.unencoded
+	}
+	if !w.wire.first.IsZero() {
+		st.TimeToFirstByte = w.wire.first.Sub(w.start)
+		st.Duration = w.wire.last.Sub(w.start)
+	}
+	return st
+}
+
+// CountUnencodedBody records n body bytes written above a content coding.
+func (w *Writer) CountUnencodedBody(n int64) {
+	w.unencoded += n
+	w.coded = true
+}
+
+// wireCounter sits below the buffer and records what actually reaches the
+// connection, and when.
+type wireCounter struct {
+	w           io.Writer
+	n           int64
+	first, last time.Time
+}
+
+func (c *wireCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count(int64(n))
+	return n, err
+}
+
+// ReadFrom lets a copy reach the connection's own ReadFrom, which for TCP
+// connections can use sendfile.
+func (c *wireCounter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.w.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(r)
+		c.count(n)
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{c}, r)
+}
+
+func (c *wireCounter) count(n int64) {
+	if n > 0 {
+		now := time.Now()
+		if c.first.IsZero() {
+			c.first = now
+		}
+		c.last = now
+		c.n += n
+	}
+}
+
+// CloseAfterResponse makes the response announce "Connection: close" if its
+// headers have not been written yet. It may be called from any goroutine.
+func (w *Writer) CloseAfterResponse() {
+	w.closeConn.Store(true)
+}
+
+// SetRequestVersion records the HTTP version of the request being answered,
+// e.g. "1.1". It decides whether interim responses may be sent.
+func (w *Writer) SetRequestVersion(version string) {
+	w.requestVersion = version
+}
+
+// Flush sends any buffered response bytes to the underlying connection.
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
@@ -32,26 +162,81 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	}
 	// Set the next state after write status line
 	defer func() { w.writerState = writerStateHeaders }()
+	w.statusCode = statusCode
 
-	statusLine, ok := statusCodeMap[statusCode]
+	reason, ok := statusCodeMap[statusCode]
 	if !ok {
-		log.Println("cannot find default reason phrase status")
-		statusLine = fmt.Sprintf("HTTP/1.1 %d \r\n", statusCode)
+		slog.Warn("no reason phrase for status", "status", int(statusCode))
 	}
 
-	if _, err := w.writer.Write([]byte(statusLine)); err != nil {
+	if _, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", statusCode, reason); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+// WriteInformational sends an interim 1xx response, such as 103 Early Hints,
+// and flushes it straight away. Any number of them may precede the final
+// status line, but only HTTP/1.1 clients understand them. 101 Switching
+// Protocols ends the HTTP conversation, so it is not accepted here.
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
+	if w.writerState != writerStateStatusLine {
+		return fmt.Errorf("cannot write informational response in state: %d", w.writerState)
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == StatusSwitchingProtocols {
+		return fmt.Errorf("not an informational status code: %d", statusCode)
+	}
+	if w.requestVersion != "1.1" {
+		return fmt.Errorf("cannot send informational response to HTTP/%s client", w.requestVersion)
+	}
+
+	if _, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", statusCode, statusCodeMap[statusCode]); err != nil {
+		return err
+	}
+	if err := w.writeFields(h); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// WriteSwitchingProtocols sends 101 Switching Protocols with h, the last
+// thing written in HTTP before the connection is hijacked to speak another
+// protocol. Stats report it as the final status.
+func (w *Writer) WriteSwitchingProtocols(h headers.Headers) error {
+	if w.writerState != writerStateStatusLine {
+		return fmt.Errorf("cannot switch protocols in state: %d", w.writerState)
+	}
+	w.writerState = writerStateSwitched
+	w.statusCode = StatusSwitchingProtocols
+	w.headers = headers.NewHeaders()
+	for k, v := range h {
+		w.headers.Override(k, v)
+	}
+	if _, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", StatusSwitchingProtocols, statusCodeMap[StatusSwitchingProtocols]); err != nil {
+		return err
+	}
+	return w.writeFields(w.headers)
+}
+
+func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.writerState != writerStateHeaders {
 		return fmt.Errorf("cannot write header in state: %d", w.writerState)
 	}
 	defer func() { w.writerState = writerStateBody }()
 
-	for k, v := range headers {
+	w.headers = headers.NewHeaders()
+	for k, v := range h {
+		w.headers.Override(k, v)
+	}
+	if w.closeConn.Load() {
+		w.headers.Override("Connection", "close")
+	}
+	return w.writeFields(w.headers)
+}
+
+// writeFields writes h followed by the empty line that ends a field section.
+func (w *Writer) writeFields(h headers.Headers) error {
+	for k, v := range h {
 		if _, err := fmt.Fprintf(w.writer, "%s: %s\r\n", k, v); err != nil {
 			return err
 		}
@@ -67,7 +252,20 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.writerState != writerStateBody {
 		return 0, fmt.Errorf("cannot write body in state: %d", w.writerState)
 	}
-	return w.writer.Write(p)
+	n, err := w.writer.Write(p)
+	w.bodyBytes += int64(n)
+	return n, err
+}
+
+// ReadFrom copies r into a body framed by Content-Length, i.e. like
+// WriteBody.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.writerState != writerStateBody {
+		return 0, fmt.Errorf("cannot write body in state: %d", w.writerState)
+	}
+	n, err := w.writer.ReadFrom(r)
+	w.bodyBytes += n
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
@@ -84,7 +282,14 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	}
 	nTotal += n
 
-	n, err = w.writer.Write(append(p, []byte("\r\n")...))
+	n, err = w.writer.Write(p)
+	w.bodyBytes += int64(n)
+	if err != nil {
+		return nTotal, err
+	}
+	nTotal += n
+
+	n, err = w.writer.Write([]byte("\r\n"))
 	if err != nil {
 		return nTotal, err
 	}
@@ -103,12 +308,5 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 		return fmt.Errorf("cannot write trailers in state %d", w.writerState)
 	}
 	defer func() { w.writerState = writerStateBody }()
-	for k, v := range h {
-		_, err := fmt.Fprintf(w.writer, "%s: %s\r\n", k, v)
-		if err != nil {
-			return err
-		}
-	}
-	_, err := w.writer.Write([]byte("\r\n"))
-	return err
+	return w.writeFields(h)
 }
@@ -0,0 +1,107 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+)
+
+func TestWriteInformational(t *testing.T) {
+	// Test: Early hints and processing before the final response
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	hints := headers.NewHeaders()
+	hints.Set("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteInformational(StatusEarlyHints, hints))
+	// interim responses go out immediately, without waiting for Flush
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload; as=style\r\n\r\n", buf.String())
+	require.NoError(t, w.WriteInformational(StatusProcessing, nil))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "\r\n\r\nHTTP/1.1 102 Processing\r\n\r\nHTTP/1.1 200 OK\r\n")
+
+	// Test: Not allowed after the final status line
+	require.Error(t, w.WriteInformational(StatusContinue, nil))
+
+	// Test: Only 1xx codes other than 101
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteInformational(StatusOK, nil))
+	require.Error(t, w.WriteInformational(StatusSwitchingProtocols, nil))
+
+	// Test: Only for HTTP/1.1 clients
+	w = NewWriter(&buf)
+	w.SetRequestVersion("1.0")
+	require.Error(t, w.WriteInformational(StatusContinue, nil))
+}
+
+func TestWriteSwitchingProtocols(t *testing.T) {
+	// Test: The 101 is the final status, and nothing follows it in HTTP
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteSwitchingProtocols(headers.Headers{"Upgrade": "websocket"}))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nupgrade: websocket\r\n\r\n", buf.String())
+	st := w.Stats()
+	assert.Equal(t, StatusSwitchingProtocols, st.StatusCode)
+	assert.Equal(t, int64(buf.Len()), st.WireBytes)
+	require.Error(t, w.WriteStatusLine(StatusOK))
+
+	// Test: Not after the final status line
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.Error(t, w.WriteSwitchingProtocols(nil))
+}
+
+func TestWriterStats(t *testing.T) {
+	// Test: Nothing written yet
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	st := w.Stats()
+	assert.Equal(t, StatusCode(0), st.StatusCode)
+	assert.Zero(t, st.TimeToFirstByte)
+	assert.Zero(t, st.WireBytes)
+
+	// Test: Fixed length body
+	body := []byte("hello")
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	h := GetDefaultHeaders(len(body))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody(body)
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	h.Override("Content-Type", "text/html")
+
+	st = w.Stats()
+	assert.Equal(t, StatusNotFound, st.StatusCode)
+	// the snapshot is not affected by later changes to the handler's map
+	assert.Equal(t, "text/plain", st.Headers["content-type"])
+	assert.Equal(t, int64(5), st.BodyBytes)
+	assert.Equal(t, int64(buf.Len()), st.WireBytes)
+	assert.False(t, st.Start.IsZero())
+	assert.GreaterOrEqual(t, st.Duration, st.TimeToFirstByte)
+
+	// Test: Chunked body counts payload only
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("defg"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(nil))
+	require.NoError(t, w.Flush())
+
+	st = w.Stats()
+	assert.Equal(t, int64(7), st.BodyBytes)
+	// without a content coding the body is sent as written
+	assert.Equal(t, int64(7), st.EncodedBodyBytes)
+	assert.Equal(t, int64(buf.Len()), st.WireBytes)
+}
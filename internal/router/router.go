@@ -0,0 +1,269 @@
+// Package router dispatches requests to handlers by method and path pattern.
+//
+// A pattern is a path made of segments, each of which is either a literal
+// ("users"), a named parameter matching one segment ("{id}"), or, as the last
+// segment only, a wildcard matching the rest of the path ("{rest...}"). The
+// rest may be empty, as in "/files/" for "/files/{rest...}", but "/files"
+// needs a route of its own.
+// When several patterns match a path, the most specific wins: comparing
+// segments left to right, a literal beats a parameter, which beats a
+// wildcard.
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/problem"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/server"
+)
+
+type segmentKind int
+
+// The order matters: a lower kind is more specific.
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the literal text, or the parameter name
+	value string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router is a server.Handler that dispatches to the route matching the
+// request. Routes must all be registered before serving starts.
+type Router struct {
+	routes []*route
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for requests with the given method whose path
+// matches pattern, wrapped in middleware, the first entry outermost. It
+// panics if the pattern is malformed or already registered for method,
+// since that is a programming error.
+func (rt *Router) Handle(method, pattern string, handler server.Handler, middleware ...server.Middleware) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("router: pattern %q: %v", pattern, err))
+	}
+	for _, r := range rt.routes {
+		if r.method == method && equalSegments(r.segments, segments) {
+			panic(fmt.Sprintf("router: %s %s conflicts with %s %s", method, pattern, r.method, r.pattern))
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		pattern:  pattern,
+		segments: segments,
+		handler:  server.Chain(middleware...)(handler),
+	})
+}
+
+// Serve dispatches req to the most specific matching route, with the path
+// parameters set on the request. It answers 404 when no pattern matches the
+// path, 405 with an Allow header when none matches the method, and OPTIONS
+// requests that have no route of their own with 204 and an Allow header.
+func (rt *Router) Serve(w response.ResponseWriter, req *request.Request) {
+	method := req.RequestLine.Method
+	if method == "OPTIONS" && req.RequestLine.RequestTarget == "*" {
+		writeAllow(w, req, rt.methods(nil))
+		return
+	}
+
+	path := req.Path()
+	parts := splitPath(path)
+	var best *route
+	var bestValues map[string]string
+	var matched []*route
+	for _, r := range rt.routes {
+		values, ok := r.match(parts)
+		if !ok {
+			continue
+		}
+		matched = append(matched, r)
+		if r.method == method && (best == nil || moreSpecific(r, best)) {
+			best, bestValues = r, values
+		}
+	}
+
+	if best != nil {
+		for k, v := range bestValues {
+			req.SetPathValue(k, v)
+		}
+		server.SetRoute(req, best.pattern)
+		best.handler(w, req)
+		return
+	}
+	if len(matched) == 0 {
+		writeProblem(w, req, problem.New(response.StatusNotFound, fmt.Sprintf("Nothing matches %s.", path)))
+		return
+	}
+	allowed := rt.methods(matched)
+	if method == "OPTIONS" {
+		writeAllow(w, req, allowed)
+		return
+	}
+	p := problem.New(response.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s.", method, path))
+	p.Headers = headers.NewHeaders()
+	p.Headers.Set("Allow", strings.Join(allowed, ", "))
+	writeProblem(w, req, p)
+}
+
+// methods lists the methods of routes, or of every route if routes is nil,
+// plus OPTIONS which is always answered.
+func (rt *Router) methods(routes []*route) []string {
+	if routes == nil {
+		routes = rt.routes
+	}
+	methods := []string{"OPTIONS"}
+	for _, r := range routes {
+		if !slices.Contains(methods, r.method) {
+			methods = append(methods, r.method)
+		}
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+func (r *route) match(parts []string) (map[string]string, bool) {
+	var values map[string]string
+	for i, seg := range r.segments {
+		if seg.kind == segmentWildcard {
+			if i >= len(parts) {
+				return nil, false
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[seg.value] = strings.Join(parts[i:], "/")
+			return values, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[seg.value] = parts[i]
+		}
+	}
+	return values, len(parts) == len(r.segments)
+}
+
+// moreSpecific reports whether a is more specific than b, for two routes
+// matching the same path.
+func moreSpecific(a, b *route) bool {
+	for i := 0; i < len(a.segments) && i < len(b.segments); i++ {
+		if a.segments[i].kind != b.segments[i].kind {
+			return a.segments[i].kind < b.segments[i].kind
+		}
+	}
+	// a wildcard can match what would otherwise be a longer pattern
+	return len(a.segments) > len(b.segments)
+}
+
+func equalSegments(a, b []segment) bool {
+	return slices.EqualFunc(a, b, func(x, y segment) bool {
+		// parameter names don't make two patterns different
+		return x.kind == y.kind && (x.kind != segmentLiteral || x.value == y.value)
+	})
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("must start with /")
+	}
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	seen := make(map[string]bool)
+	for i, part := range parts {
+		name, isParam := strings.CutPrefix(part, "{")
+		if !isParam {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("parameter must be a whole segment: %q", part)
+			}
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+			continue
+		}
+		name, ok := strings.CutSuffix(name, "}")
+		if !ok {
+			return nil, fmt.Errorf("unterminated parameter: %q", part)
+		}
+		kind := segmentParam
+		if n, ok := strings.CutSuffix(name, "..."); ok {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("wildcard must be the last segment: %q", part)
+			}
+			kind, name = segmentWildcard, n
+		}
+		if name == "" || strings.ContainsAny(name, "{}/.") {
+			return nil, fmt.Errorf("invalid parameter name: %q", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate parameter name: %q", name)
+		}
+		seen[name] = true
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+	return segments, nil
+}
+
+// splitPath splits path into its percent-decoded segments. A segment that
+// is not validly encoded is kept as is.
+func splitPath(path string) []string {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, p := range parts {
+		if unescaped, err := url.PathUnescape(p); err == nil {
+			parts[i] = unescaped
+		}
+	}
+	return parts
+}
+
+func writeAllow(w response.ResponseWriter, req *request.Request, methods []string) {
+	if err := w.WriteStatusLine(response.StatusNoContent); err != nil {
+		logging.FromContext(req.Context()).Error("writing status line", "err", err)
+		return
+	}
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Type")
+	h.Delete("Content-Length")
+	h.Set("Allow", strings.Join(methods, ", "))
+	if err := w.WriteHeaders(h); err != nil {
+		logging.FromContext(req.Context()).Error("writing headers", "err", err)
+	}
+}
+
+func writeProblem(w response.ResponseWriter, req *request.Request, p *problem.Problem) {
+	if err := problem.Write(w, req, p); err != nil {
+		logging.FromContext(req.Context()).Error("writing problem", "err", err)
+	}
+}
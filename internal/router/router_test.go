@@ -0,0 +1,157 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/server"
+)
+
+// named returns a handler that writes its name and the given path values,
+// so tests can see which route was picked.
+func named(name string, params ...string) func(w response.ResponseWriter, req *request.Request) {
+	return func(w response.ResponseWriter, req *request.Request) {
+		body := name
+		for _, p := range params {
+			body += " " + p + "=" + req.PathValue(p)
+		}
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody([]byte(body))
+	}
+}
+
+// serve runs rt on a raw request and returns the raw response.
+func serve(t *testing.T, rt *Router, raw string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	rt.Serve(w, req)
+	require.NoError(t, w.Flush())
+	return buf.String()
+}
+
+func body(res string) string {
+	_, b, _ := strings.Cut(res, "\r\n\r\n")
+	return b
+}
+
+func TestRouterMatch(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/", named("root"))
+	rt.Handle("GET", "/users", named("list"))
+	rt.Handle("GET", "/users/{id}", named("user", "id"))
+	rt.Handle("GET", "/users/me", named("me"))
+	rt.Handle("GET", "/users/{id}/posts/{post}", named("post", "id", "post"))
+	rt.Handle("GET", "/files", named("files root"))
+	rt.Handle("GET", "/files/{path...}", named("files", "path"))
+	rt.Handle("GET", "/files/{dir}/index", named("index", "dir"))
+	rt.Handle("POST", "/users", named("create"))
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "/", want: "root"},
+		{target: "/users", want: "list"},
+		{target: "/users/42", want: "user id=42"},
+		{target: "/users/42?verbose=1", want: "user id=42"},
+		{target: "/users/me", want: "me"},
+		{target: "/users/a%20b", want: "user id=a b"},
+		{target: "/users/7/posts/99", want: "post id=7 post=99"},
+		{target: "/files", want: "files root"},
+		{target: "/files?x=1", want: "files root"},
+		{target: "/files/", want: "files path="},
+		{target: "/files/a/b/c.txt", want: "files path=a/b/c.txt"},
+		{target: "/files/docs/index", want: "index dir=docs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			res := serve(t, rt, "GET "+tt.target+" HTTP/1.1\r\n\r\n")
+			assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+			assert.Equal(t, tt.want, body(res))
+		})
+	}
+
+	res := serve(t, rt, "POST /users HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	assert.Equal(t, "create", body(res))
+}
+
+func TestRouterErrors(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/users/{id}", named("user"))
+	rt.Handle("DELETE", "/users/{id}", named("delete"))
+	rt.Handle("POST", "/users", named("create"))
+
+	// Test: 404 for unknown paths
+	res := serve(t, rt, "GET /nope HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+	res = serve(t, rt, "GET /users/1/extra HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+	// an empty segment is not a parameter value
+	res = serve(t, rt, "GET /users/ HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+
+	// Test: 405 with the methods the path does support
+	res = serve(t, rt, "PUT /users/1 HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"), res)
+	assert.Contains(t, res, "allow: DELETE, GET, OPTIONS\r\n")
+
+	// Test: OPTIONS is answered automatically
+	res = serve(t, rt, "OPTIONS /users HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 204 No Content\r\n"), res)
+	assert.Contains(t, res, "allow: OPTIONS, POST\r\n")
+	res = serve(t, rt, "OPTIONS * HTTP/1.1\r\n\r\n")
+	assert.Contains(t, res, "allow: DELETE, GET, OPTIONS, POST\r\n")
+
+	// Test: An explicit OPTIONS route wins
+	rt.Handle("OPTIONS", "/users", named("options"))
+	res = serve(t, rt, "OPTIONS /users HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "options", body(res))
+}
+
+func TestRouterHandlePanics(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/users/{id}", named("user"))
+
+	for _, pattern := range []string{
+		"users",
+		"/users/{id",
+		"/users/x{id}",
+		"/{rest...}/more",
+		"/{a}/{a}",
+		"/{}",
+	} {
+		assert.Panics(t, func() { rt.Handle("GET", pattern, named("bad")) }, pattern)
+	}
+	// Test: The same pattern with another parameter name conflicts
+	assert.Panics(t, func() { rt.Handle("GET", "/users/{name}", named("dup")) })
+	// but not for another method
+	assert.NotPanics(t, func() { rt.Handle("PUT", "/users/{name}", named("put")) })
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	tag := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w response.ResponseWriter, req *request.Request) {
+				req.SetPathValue("via", req.PathValue("via")+name)
+				next(w, req)
+			}
+		}
+	}
+	rt := New()
+	rt.Handle("GET", "/plain", named("plain", "via"))
+	rt.Handle("GET", "/tagged", named("tagged", "via"), tag("a"), tag("b"))
+
+	// Test: Route middleware runs only for its route, first entry outermost
+	assert.Equal(t, "tagged via=ab", body(serve(t, rt, "GET /tagged HTTP/1.1\r\n\r\n")))
+	assert.Equal(t, "plain via=", body(serve(t, rt, "GET /plain HTTP/1.1\r\n\r\n")))
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/problem"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// ErrHijacked is returned by Hijack when the connection has already been
+// taken over.
+var ErrHijacked = errors.New("server: connection already hijacked")
+
+// connWriter is the writer handlers get on HTTP/1.1 connections: a
+// response.Writer that can also hand the connection over, see
+// response.Hijacker.
+type connWriter struct {
+	*response.Writer
+	s        *Server
+	conn     *trackedConn
+	br       *bufio.Reader
+	watcher  *disconnectWatcher
+	hijacked bool
+}
+
+// Hijack flushes what was written so far and gives up the connection. The
+// server forgets it: Shutdown neither waits for nor closes it. It keeps its
+// place under MaxConns and MaxConnsPerIP until the new owner closes it.
+func (w *connWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if err := w.Writer.Flush(); err != nil {
+		return nil, nil, err
+	}
+	// the watcher must stop peeking before the new owner reads
+	w.watcher.stop()
+	if err := w.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	conn := w.s.release(w.conn)
+	return conn, bufio.NewReadWriter(w.br, bufio.NewWriter(conn)), nil
+}
+
+// release stops tracking a hijacked connection and returns it for the new
+// owner, holding its place under the limits until closed.
+func (s *Server) release(conn *trackedConn) net.Conn {
+	conn.mu.Lock()
+	conn.hijacked = true
+	conn.mu.Unlock()
+	s.forget(conn)
+	s.active.Done()
+	if conn.release == nil {
+		return conn.Conn
+	}
+	return &hijackedConn{Conn: conn.Conn, release: conn.release}
+}
+
+// hijackedConn frees a hijacked connection's place under the limits when it
+// is closed.
+type hijackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *hijackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func (c *trackedConn) isHijacked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hijacked
+}
+
+// IsUpgrade reports whether r asks to switch its connection to protocol,
+// e.g. "websocket": its Upgrade header lists protocol and its Connection
+// header lists upgrade.
+func IsUpgrade(r *request.Request, protocol string) bool {
+	return r.RequestLine.HttpVersion == "1.1" &&
+		hasToken(r.Headers, "Connection", "upgrade") &&
+		hasToken(r.Headers, "Upgrade", protocol)
+}
+
+// Upgrade switches the connection of r to protocol. It answers with 101
+// Switching Protocols, adding the fields of h, and hands the connection over
+// as response.Hijack does: the caller speaks protocol on it from then on and
+// closes it. The returned reader holds whatever the client sent after the
+// request. If r does not ask for protocol, Upgrade answers 426 Upgrade
+// Required instead and returns the problem.
+func Upgrade(w response.ResponseWriter, r *request.Request, protocol string, h headers.Headers) (net.Conn, *bufio.ReadWriter, error) {
+	if !IsUpgrade(r, protocol) {
+		p := problem.New(response.StatusUpgradeRequired, fmt.Sprintf("This endpoint requires an upgrade to %s.", protocol))
+		p.Headers = headers.Headers{"upgrade": protocol, "connection": "Upgrade"}
+		if err := problem.Write(w, r, p); err != nil {
+			return nil, nil, errors.Join(p, err)
+		}
+		return nil, nil, p
+	}
+	if st, ok := response.StatsOf(w); ok && st.StatusCode != 0 {
+		return nil, nil, errors.New("server: cannot upgrade after the response has started")
+	}
+
+	// the 101 goes through the writer, so its stats, and with them the
+	// access log and metrics, record it
+	fields := headers.NewHeaders()
+	for k, v := range h {
+		fields.Override(k, v)
+	}
+	fields.Override("Connection", "Upgrade")
+	fields.Override("Upgrade", protocol)
+	if err := response.WriteSwitchingProtocols(w, fields); err != nil {
+		return nil, nil, err
+	}
+	if err := response.Flush(w); err != nil {
+		return nil, nil, err
+	}
+	return response.Hijack(w)
+}
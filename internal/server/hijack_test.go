@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+func TestHijack(t *testing.T) {
+	hijacked := make(chan net.Conn, 1)
+	s, err := ServeConfig(0, func(w response.ResponseWriter, req *request.Request) {
+		conn, rw, err := response.Hijack(w)
+		if !assert.NoError(t, err) {
+			return
+		}
+		// Test: A second Hijack fails
+		_, _, err = response.Hijack(w)
+		assert.ErrorIs(t, err, ErrHijacked)
+
+		// Test: Bytes the server read past the request are handed over
+		line, err := rw.ReadString('\n')
+		assert.NoError(t, err)
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\nyou said " + line)
+		_ = rw.Flush()
+		hijacked <- conn
+	}, DefaultConfig)
+	require.NoError(t, err)
+	addr := s.Addrs()[0].String()
+
+	conn := dial(t, addr)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\nhello\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for _, want := range []string{"HTTP/1.1 101 Switching Protocols\r\n", "\r\n", "you said hello\n"} {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, want, line)
+	}
+	server := <-hijacked
+
+	// Test: Shutdown neither waits for nor closes a hijacked connection
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	_, err = io.WriteString(server, "still here\n")
+	require.NoError(t, err)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "still here\n", line)
+	_ = server.Close()
+}
+
+func TestHijackHTTP2(t *testing.T) {
+	errs := make(chan error, 1)
+	addr := startServer(t, func(w response.ResponseWriter, req *request.Request) {
+		_, _, err := response.Hijack(w)
+		errs <- err
+		okHandler(w, req)
+	}, DefaultConfig)
+
+	// Test: HTTP/2 streams share the connection, so it cannot be taken over
+	resp, _ := get(t, h2cClient(), "http://"+addr+"/")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.ErrorIs(t, <-errs, response.ErrNotSupported)
+}
+
+// rpcHandler upgrades to a line-based protocol that answers every line
+// upper-cased.
+func rpcHandler(w response.ResponseWriter, req *request.Request) {
+	conn, rw, err := Upgrade(w, req, "linerpc/1", headers.Headers{"X-RPC-Server": "test"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		_, _ = rw.WriteString(strings.ToUpper(line))
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	addr := startServer(t, rpcHandler, DefaultConfig)
+
+	// Test: The 101 names the protocol, and the connection then speaks it,
+	// starting with bytes sent along with the request
+	conn := dial(t, addr)
+	_, err := io.WriteString(conn, "GET /rpc HTTP/1.1\r\nHost: x\r\nConnection: keep-alive, Upgrade\r\nUpgrade: LineRPC/1\r\n\r\nfirst\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	var head []string
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		head = append(head, strings.TrimSpace(line))
+	}
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", head[0])
+	assert.ElementsMatch(t, []string{"connection: Upgrade", "upgrade: linerpc/1", "x-rpc-server: test"}, head[1:])
+	for _, msg := range []string{"first", "second"} {
+		if msg != "first" {
+			_, err = io.WriteString(conn, msg+"\n")
+			require.NoError(t, err)
+		}
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, strings.ToUpper(msg)+"\n", line)
+	}
+
+	// Test: A request that does not ask for the protocol gets 426
+	conn = dial(t, addr)
+	_, err = io.WriteString(conn, "GET /rpc HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 426 Upgrade Required", resp.status)
+	assert.Equal(t, "linerpc/1", resp.headers["upgrade"])
+	assert.Equal(t, "Upgrade", resp.headers["connection"])
+}
+
+func TestUpgradeStats(t *testing.T) {
+	stats := make(chan response.Stats, 1)
+	addr := startServer(t, rpcHandler, Config{
+		OnResponse: func(w response.ResponseWriter, req *request.Request, start time.Time) {
+			st, _ := response.StatsOf(w)
+			stats <- st
+		},
+	})
+
+	// Test: The hooks see the 101 an upgrade answered with
+	conn := dial(t, addr)
+	_, err := io.WriteString(conn, "GET /rpc HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: linerpc/1\r\n\r\n")
+	require.NoError(t, err)
+	_ = conn.Close()
+	st := <-stats
+	assert.Equal(t, response.StatusSwitchingProtocols, st.StatusCode)
+	upgrade, _ := st.Headers.Get("Upgrade")
+	assert.Equal(t, "linerpc/1", upgrade)
+	assert.Greater(t, st.WireBytes, int64(len("HTTP/1.1 101 Switching Protocols\r\n")))
+}
+
+func TestUpgradeAfterResponse(t *testing.T) {
+	errs := make(chan error, 1)
+	addr := startServer(t, func(w response.ResponseWriter, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_, _, err := Upgrade(w, req, "linerpc/1", nil)
+		errs <- err
+		_ = w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, DefaultConfig)
+
+	// Test: Once a status is written it is too late to switch protocols
+	conn := dial(t, addr)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: linerpc/1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK", readResponse(t, bufio.NewReader(conn)).status)
+	assert.Error(t, <-errs)
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		version string
+		headers headers.Headers
+		want    bool
+	}{
+		{"1.1", headers.Headers{"connection": "Upgrade", "upgrade": "websocket"}, true},
+		{"1.1", headers.Headers{"connection": "keep-alive, upgrade", "upgrade": "h2c, WebSocket"}, true},
+		{"1.1", headers.Headers{"upgrade": "websocket"}, false},
+		{"1.1", headers.Headers{"connection": "Upgrade", "upgrade": "h2c"}, false},
+		// HTTP/2 has no Upgrade
+		{"2", headers.Headers{"connection": "Upgrade", "upgrade": "websocket"}, false},
+	}
+	for _, tt := range tests {
+		r := &request.Request{RequestLine: request.RequestLine{HttpVersion: tt.version}, Headers: tt.headers}
+		assert.Equal(t, tt.want, IsUpgrade(r, "websocket"), "%s %v", tt.version, tt.headers)
+	}
+}
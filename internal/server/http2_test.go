@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/http2"
+	"httpfromtcp.haonguyen.tech/internal/http2/hpack"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+func h2cClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Transport: &http.Transport{Protocols: &protocols},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	addr := startServer(t, okHandler, DefaultConfig)
+
+	// Test: A client that starts with the preface speaks HTTP/2
+	resp, body := get(t, h2cClient(), "http://"+addr+"/h2c")
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "/h2c", body)
+
+	// Test: HTTP/1.1 requests shorter than the preface are still answered
+	conn := dial(t, addr)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/", readResponse(t, bufio.NewReader(conn)).body)
+}
+
+func TestHTTP2ALPN(t *testing.T) {
+	dir := t.TempDir()
+	files, cert := writeCert(t, dir, "a", "a.test")
+	_, addr := startTLSServer(t, func(w response.ResponseWriter, req *request.Request) {
+		body := req.TLS.ServerName
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody([]byte(body))
+	}, TLSConfig{Certificates: []CertificateFiles{files}})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: "a.test"},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+	resp, body := get(t, client, "https://"+addr+"/")
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+	// the handler sees the TLS state as over HTTP/1.1
+	assert.Equal(t, "a.test", body)
+}
+
+func TestHTTP2HandlerPanic(t *testing.T) {
+	addr := startServer(t, func(w response.ResponseWriter, req *request.Request) {
+		if req.Path() == "/late" {
+			_ = w.WriteStatusLine(response.StatusOK)
+			_ = w.WriteHeaders(response.GetDefaultHeaders(100))
+			_, _ = w.WriteBody([]byte("partial"))
+			_ = response.Flush(w)
+		}
+		panic("boom")
+	}, DefaultConfig)
+	client := h2cClient()
+
+	// Test: A panic before the status becomes a 500
+	resp, _ := get(t, client, "http://"+addr+"/early")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	// Test: A panic after it resets the stream, so the body is not taken
+	// as complete
+	resp, err := client.Get("http://" + addr + "/late")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+
+	// Test: The connection survives both
+	resp, _ = get(t, client, "http://"+addr+"/early")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestHTTP2Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := ServeConfig(0, func(w response.ResponseWriter, req *request.Request) {
+		close(started)
+		<-release
+		okHandler(w, req)
+	}, DefaultConfig)
+	require.NoError(t, err)
+	addr := s.Addrs()[0].String()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := h2cClient().Get("http://" + addr + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		results <- result{string(b), err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	// the in-flight stream keeps Shutdown waiting
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	r := <-results
+	require.NoError(t, r.err)
+	assert.True(t, strings.HasPrefix(r.body, "/slow"))
+	select {
+	case err := <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	addr := startServer(t, okHandler, DefaultConfig)
+
+	// Test: An Upgrade: h2c request is answered as stream 1 after a 101
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "GET /upgraded HTTP/1.1\r\nHost: x\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	require.NoError(t, err)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for line := ""; line != "\r\n"; {
+		line, err = br.ReadString('\n')
+		require.NoError(t, err)
+	}
+	// the preface, then an empty SETTINGS frame
+	_, err = io.WriteString(conn, http2.ClientPreface+"\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+	require.NoError(t, err)
+
+	decoder := hpack.NewDecoder(hpack.DefaultTableSize)
+	var fields []hpack.HeaderField
+	var body []byte
+	for done := false; !done; {
+		f, _, err := http2.ReadFrame(br, nil, 1<<24-1)
+		require.NoError(t, err)
+		switch f.Type {
+		case http2.FrameHeaders:
+			assert.Equal(t, uint32(1), f.StreamID)
+			fields, err = decoder.Decode(f.Payload)
+			require.NoError(t, err)
+		case http2.FrameData:
+			body = append(body, f.Payload...)
+			done = f.Flags.Has(http2.FlagEndStream)
+		}
+	}
+	assert.Contains(t, fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	assert.Equal(t, "/upgraded", string(body))
+
+	// Test: A malformed HTTP2-Settings header is ignored and the request
+	// answered over HTTP/1.1
+	conn = dial(t, addr)
+	_, err = io.WriteString(conn, "GET /plain HTTP/1.1\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: !!\r\n\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", resp.status)
+	assert.Equal(t, "/plain", resp.body)
+}
+
+func TestHTTP2OnResponseStats(t *testing.T) {
+	stats := make(chan response.Stats, 1)
+	addr := startServer(t, okHandler, Config{
+		OnResponse: func(w response.ResponseWriter, req *request.Request, start time.Time) {
+			st, _ := response.StatsOf(w)
+			stats <- st
+		},
+	})
+
+	// Test: The hooks run once the stream has ended, so they count the
+	// frames that end it too
+	_, body := get(t, h2cClient(), "http://"+addr+"/stats")
+	assert.Equal(t, "/stats", body)
+	st := <-stats
+	assert.Equal(t, response.StatusOK, st.StatusCode)
+	assert.Equal(t, int64(len("/stats")), st.EncodedBodyBytes)
+	// a HEADERS frame and a DATA frame with its 9-byte header at least
+	assert.Greater(t, st.WireBytes, int64(2*9+len("/stats")))
+	assert.False(t, st.Start.IsZero())
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/problem"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// OverloadPolicy is what a Server does with work past its MaxConns and
+// MaxRequests.
+type OverloadPolicy int
+
+const (
+	// OverloadWait holds new work back until there is room: the accept loops
+	// stop accepting, leaving new connections queued in the kernel's backlog,
+	// and requests wait for a handler to finish.
+	OverloadWait OverloadPolicy = iota
+	// OverloadReject answers at once with 503 Service Unavailable and a
+	// Retry-After, and closes connections it turns away.
+	OverloadReject
+)
+
+// rejectTimeout bounds answering a connection that is turned away.
+const rejectTimeout = time.Second
+
+// limits counts connections and requests against a Config's caps.
+type limits struct {
+	overload OverloadPolicy
+	// conns and requests hold a token per connection and request; they are
+	// nil when unlimited
+	conns    chan struct{}
+	requests chan struct{}
+
+	mu       sync.Mutex
+	maxPerIP int
+	perIP    map[string]int
+}
+
+func newLimits(config Config) *limits {
+	l := &limits{overload: config.Overload, maxPerIP: config.MaxConnsPerIP, perIP: make(map[string]int)}
+	if config.MaxConns > 0 {
+		l.conns = make(chan struct{}, config.MaxConns)
+	}
+	if config.MaxRequests > 0 {
+		l.requests = make(chan struct{}, config.MaxRequests)
+	}
+	return l
+}
+
+// waitConn blocks, under OverloadWait, until there is room for another
+// connection, and takes it. It reports false if done is closed first.
+func (l *limits) waitConn(done <-chan struct{}) bool {
+	if l.conns == nil || l.overload != OverloadWait {
+		return true
+	}
+	select {
+	case l.conns <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// unwaitConn gives back the place waitConn took, when no connection came to
+// fill it.
+func (l *limits) unwaitConn() {
+	if l.overload == OverloadWait {
+		l.releaseSlot()
+	}
+}
+
+// admitConn counts a new connection from ip, which is empty for clients
+// without one, such as on Unix sockets. It reports false, holding nothing, if
+// the connection is over a limit.
+func (l *limits) admitConn(ip string) bool {
+	if l.conns != nil && l.overload == OverloadReject {
+		select {
+		case l.conns <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if ip == "" || l.maxPerIP <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP[ip] >= l.maxPerIP {
+		l.releaseSlot()
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+// releaseConn gives back what admitConn took for a connection from ip.
+func (l *limits) releaseConn(ip string) {
+	if ip != "" && l.maxPerIP > 0 {
+		l.mu.Lock()
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	l.releaseSlot()
+}
+
+// releaseSlot gives back a connection's place under MaxConns.
+func (l *limits) releaseSlot() {
+	if l.conns != nil {
+		<-l.conns
+	}
+}
+
+// acquireRequest takes a place for a request, waiting under OverloadWait
+// until there is one or ctx ends. It reports false if the request is not to
+// be handled.
+func (l *limits) acquireRequest(ctx context.Context) bool {
+	if l.requests == nil {
+		return true
+	}
+	if l.overload == OverloadReject {
+		select {
+		case l.requests <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case l.requests <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *limits) releaseRequest() {
+	if l.requests != nil {
+		<-l.requests
+	}
+}
+
+// clientIP returns the IP address conn comes from, or "" if it has none.
+func clientIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// overloaded returns the problem sent to clients turned away.
+func (s *Server) overloaded() *problem.Problem {
+	p := problem.New(response.StatusServiceUnavailable, "The server is too busy right now. Please try again later.")
+	secs := int((s.config.RetryAfter + time.Second - 1) / time.Second)
+	p.Headers = headers.NewHeaders()
+	p.Headers.Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	return p
+}
+
+// reject answers a connection over the limits with 503 and closes it,
+// without waiting for its request. What the client sent is read and dropped
+// for a moment, so closing does not reset the connection before the client
+// has read the answer.
+func (s *Server) reject(conn net.Conn) {
+	s.log.Warn("rejecting connection: over the limits", "remote", conn.RemoteAddr().String())
+	s.metrics.rejectedConns.Inc()
+	defer s.closeConn(conn)
+	if err := conn.SetDeadline(time.Now().Add(rejectTimeout)); err != nil {
+		return
+	}
+	w := response.NewWriter(conn)
+	w.CloseAfterResponse()
+	if err := problem.Write(w, nil, s.overloaded()); err != nil {
+		return
+	}
+	if err := w.Flush(); err != nil {
+		return
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
+
+// rejectRequest answers r with 503 when MaxRequests is reached.
+func (s *Server) rejectRequest(w response.ResponseWriter, r *request.Request) {
+	logger := logging.FromContext(r.Context())
+	logger.Warn("rejecting request: too many in flight")
+	if err := problem.Write(w, r, s.overloaded()); err != nil {
+		logger.Error("writing overload response", "err", err)
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// blockingHandler holds requests for /block until release is closed.
+func blockingHandler(release <-chan struct{}) Handler {
+	return func(w response.ResponseWriter, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-release
+		}
+		okHandler(w, req)
+	}
+}
+
+func startLimited(t *testing.T, handler Handler, config Config) (*Server, string) {
+	t.Helper()
+	s := New(handler, config)
+	t.Cleanup(func() { _ = s.Close() })
+	addr, err := s.Serve(Listener{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	return s, addr.String()
+}
+
+// send writes a GET request for target to conn.
+func send(t *testing.T, conn net.Conn, target string) {
+	t.Helper()
+	_, err := io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+}
+
+// assertNoResponse checks nothing arrives on br for a while.
+func assertNoResponse(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err := br.Peek(1)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+}
+
+func TestMaxConnsWait(t *testing.T) {
+	release := make(chan struct{})
+	s, addr := startLimited(t, blockingHandler(release), Config{MaxConns: 1})
+	first := dial(t, addr)
+	send(t, first, "/block")
+
+	// Test: Past MaxConns, a new connection waits in the backlog
+	second := dial(t, addr)
+	send(t, second, "/second")
+	br := bufio.NewReader(second)
+	assertNoResponse(t, second, br)
+
+	// Test: It is served once the first connection closes
+	close(release)
+	assert.Equal(t, "/block", readResponse(t, bufio.NewReader(first)).body)
+	require.NoError(t, first.Close())
+	assert.Equal(t, "/second", readResponse(t, br).body)
+
+	// Test: Shutdown stops an accept loop waiting for room
+	third := dial(t, addr)
+	send(t, third, "/third")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	_, addr := startLimited(t, okHandler, Config{MaxConns: 1, Overload: OverloadReject, RetryAfter: 2500 * time.Millisecond})
+	first := dial(t, addr)
+	assert.Equal(t, "/first", getOver(t, first, "/first").body)
+
+	// Test: Past MaxConns, a new connection gets a 503 with Retry-After,
+	// in whole seconds, and is closed
+	second := dial(t, addr)
+	send(t, second, "/second")
+	br := bufio.NewReader(second)
+	res := readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", res.status)
+	assert.Equal(t, "3", res.headers["retry-after"])
+	assertClosed(t, second, br)
+
+	// Test: Room is made once the first connection closes
+	require.NoError(t, first.Close())
+	require.Eventually(t, func() bool {
+		conn := dial(t, addr)
+		defer conn.Close()
+		return getOver(t, conn, "/third").body == "/third"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// flakyListener fails its first Accept, as on running out of file
+// descriptors.
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func TestMaxConnsAcceptError(t *testing.T) {
+	for _, overload := range []OverloadPolicy{OverloadWait, OverloadReject} {
+		release := make(chan struct{})
+		s := New(blockingHandler(release), Config{MaxConns: 1, Overload: overload})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr, err := s.Serve(Listener{Listener: &flakyListener{Listener: ln}})
+		require.NoError(t, err)
+
+		// Test: A failed Accept gives back only the place it held, so the
+		// connection after it is served and the one after that is not
+		first := dial(t, addr.String())
+		send(t, first, "/block")
+		second := dial(t, addr.String())
+		send(t, second, "/second")
+		br := bufio.NewReader(second)
+		if overload == OverloadWait {
+			assertNoResponse(t, second, br)
+		} else {
+			assert.Equal(t, "HTTP/1.1 503 Service Unavailable", readResponse(t, br).status)
+		}
+		close(release)
+		assert.Equal(t, "/block", readResponse(t, bufio.NewReader(first)).body, overload)
+
+		// Test: Shutdown does not hang on the accept loop
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		assert.NoError(t, s.Shutdown(ctx), overload)
+		cancel()
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	s, addr := startLimited(t, okHandler, Config{MaxConnsPerIP: 2})
+
+	// Test: A client may open MaxConnsPerIP connections, and no more, even
+	// though the server waits when full
+	for _, target := range []string{"/one", "/two"} {
+		assert.Equal(t, target, getOver(t, dial(t, addr), target).body)
+	}
+	conn := dial(t, addr)
+	send(t, conn, "/three")
+	br := bufio.NewReader(conn)
+	res := readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", res.status)
+	assert.Equal(t, "1", res.headers["retry-after"])
+	assertClosed(t, conn, br)
+
+	// Test: Clients without an IP address, on Unix sockets, are not capped
+	path := filepath.Join(t.TempDir(), "http.sock")
+	_, err := s.Serve(Listener{Network: "unix", Address: path})
+	require.NoError(t, err)
+	for _, target := range []string{"/one", "/two", "/three"} {
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		assert.Equal(t, target, getOver(t, conn, target).body)
+	}
+}
+
+func TestMaxConnsHijacked(t *testing.T) {
+	_, addr := startLimited(t, rpcHandler, Config{MaxConnsPerIP: 1})
+	upgraded := dial(t, addr)
+	_, err := io.WriteString(upgraded, "GET /rpc HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: linerpc/1\r\n\r\nping\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(upgraded)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "PING\n" {
+			break
+		}
+	}
+
+	// Test: A hijacked connection keeps its place under the limits
+	conn := dial(t, addr)
+	send(t, conn, "/second")
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", readResponse(t, bufio.NewReader(conn)).status)
+
+	// Test: Which is given back once its new owner closes it
+	require.NoError(t, upgraded.Close())
+	require.Eventually(t, func() bool {
+		conn := dial(t, addr)
+		defer conn.Close()
+		return getOver(t, conn, "/third").status == "HTTP/1.1 426 Upgrade Required"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMaxRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		overload OverloadPolicy
+	}{
+		{name: "wait", overload: OverloadWait},
+		{name: "reject", overload: OverloadReject},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			_, addr := startLimited(t, blockingHandler(release), Config{MaxRequests: 1, Overload: tc.overload})
+			first := dial(t, addr)
+			send(t, first, "/block")
+			// the first request must be in the handler before the second
+			// arrives
+			time.Sleep(100 * time.Millisecond)
+
+			second := dial(t, addr)
+			send(t, second, "/second")
+			br := bufio.NewReader(second)
+			if tc.overload == OverloadWait {
+				// Test: Past MaxRequests, a request waits for a handler
+				// to finish
+				assertNoResponse(t, second, br)
+				close(release)
+				assert.Equal(t, "/second", readResponse(t, br).body)
+			} else {
+				// Test: Or gets a 503 straight away
+				res := readResponse(t, br)
+				assert.Equal(t, "HTTP/1.1 503 Service Unavailable", res.status)
+				assert.Equal(t, "1", res.headers["retry-after"])
+				close(release)
+			}
+			assert.Equal(t, "/block", readResponse(t, bufio.NewReader(first)).body)
+		})
+	}
+}
+
+func TestMaxRequestsClientGone(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	_, addr := startLimited(t, blockingHandler(release), Config{MaxRequests: 1})
+	send(t, dial(t, addr), "/block")
+	time.Sleep(100 * time.Millisecond)
+
+	// Test: A client that gives up while its request waits is closed
+	// without an answer
+	waiting := dial(t, addr)
+	send(t, waiting, "/waiting")
+	require.NoError(t, waiting.(*net.TCPConn).CloseWrite())
+	b, err := io.ReadAll(waiting)
+	require.NoError(t, err)
+	assert.Empty(t, b)
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"httpfromtcp.haonguyen.tech/internal/metrics"
+)
+
+// ErrServerClosed is returned by Server.Serve and Server.ServeConn after
+// Close or Shutdown.
+var ErrServerClosed = errors.New("server: closed")
+
+// Listener describes one address a Server accepts connections on.
+type Listener struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix". Empty means "tcp".
+	Network string
+	// Address is host:port for TCP, such as ":42069", "127.0.0.1:8080" or
+	// "[::1]:0", where port 0 picks a free port. For "unix" it is the path
+	// of the socket file.
+	Address string
+	// Mode sets the permissions of a Unix socket file, such as 0o660 to
+	// let only the owner and group connect. Zero leaves them to the umask.
+	Mode os.FileMode
+	// Socket tunes the sockets opened for Network and Address.
+	Socket SocketOptions
+	// Listener, if set, is served as is instead of listening on Network
+	// and Address, and Socket is ignored. The Server closes it on Close or
+	// Shutdown.
+	Listener net.Listener
+}
+
+// New returns a Server that answers requests with handler. It accepts no
+// connections until given listeners with Serve.
+func New(handler Handler, config Config) *Server {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	registry := config.Metrics
+	if registry == nil {
+		registry = metrics.Default
+	}
+	return &Server{
+		log:     logger,
+		metrics: newServerMetrics(registry),
+		handler: Chain(config.Middleware...)(handler),
+		config:  config,
+		conns:   make(map[*trackedConn]struct{}),
+		done:    make(chan struct{}),
+		limits:  newLimits(config),
+	}
+}
+
+// Serve starts accepting connections on l in the background and returns the
+// address it is bound to. Call it once per listener to serve on several;
+// Close and Shutdown stop them all.
+func (s *Server) Serve(l Listener) (net.Addr, error) {
+	if s.isClosed.Load() {
+		return nil, ErrServerClosed
+	}
+	listeners, err := l.listen()
+	if err != nil {
+		return nil, err
+	}
+	var socket SocketOptions
+	if l.Listener == nil {
+		socket = l.Socket
+	}
+
+	s.mu.Lock()
+	// Close may have run while listening
+	if s.isClosed.Load() {
+		s.mu.Unlock()
+		closeListeners(listeners)
+		return nil, ErrServerClosed
+	}
+	s.listeners = append(s.listeners, listeners...)
+	s.accepting.Add(len(listeners))
+	s.mu.Unlock()
+
+	for _, listener := range listeners {
+		go s.listen(listener, socket)
+	}
+	return listeners[0].Addr(), nil
+}
+
+// Addrs returns the addresses the server is accepting connections on, one
+// per socket.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// ListenerFiles returns duplicates of the sockets the server listens on, to
+// hand them to another process. Call KeepSocketFiles once that process has
+// taken them over.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []*os.File
+	for _, l := range s.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, fmt.Errorf("server: cannot get the file of a %T listener", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// KeepSocketFiles leaves the server's Unix socket files in place on Close,
+// for a process its listeners were handed to that goes on using them. Until
+// it is called, a failed handoff does not cost the socket files.
+func (s *Server) KeepSocketFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+}
+
+func (s *Server) listen(listener net.Listener, socket SocketOptions) {
+	defer s.accepting.Done()
+	for {
+		// with OverloadWait, new connections queue in the backlog while the
+		// server is full
+		if !s.limits.waitConn(s.done) {
+			return
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			s.limits.unwaitConn()
+			if s.isClosed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.log.Error("accepting connection", "err", err)
+			continue
+		}
+		if err := socket.tune(conn); err != nil {
+			s.log.Error("tuning connection", "remote", conn.RemoteAddr().String(), "err", err)
+		}
+		if s.tlsConfig != nil {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+		ip := clientIP(conn)
+		if !s.limits.admitConn(ip) {
+			go s.reject(conn)
+			continue
+		}
+		c, ok := s.track(conn, func() { s.limits.releaseConn(ip) })
+		if !ok {
+			s.limits.releaseConn(ip)
+			s.closeConn(conn)
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+// ServeConn serves HTTP on conn, which may come from any accept loop or be
+// one end of a net.Pipe, until the conversation ends. It then closes conn,
+// unless a handler hijacked it. TLS servers run the handshake first. Close
+// and Shutdown treat the connection like one the server accepted itself.
+func (s *Server) ServeConn(conn net.Conn) error {
+	if s.tlsConfig != nil {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	c, ok := s.track(conn, nil)
+	if !ok {
+		s.closeConn(conn)
+		return ErrServerClosed
+	}
+	s.handle(c)
+	return nil
+}
+
+// track registers conn with the server, unless it is closed. release, if
+// set, is called once the server is done with conn.
+func (s *Server) track(conn net.Conn, release func()) (*trackedConn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// checked under mu, so Shutdown cannot start waiting on active before
+	// the Add
+	if s.isClosed.Load() {
+		return nil, false
+	}
+	c := &trackedConn{
+		Conn:    conn,
+		log:     s.log.With("remote", conn.RemoteAddr().String()),
+		idle:    true,
+		release: release,
+	}
+	s.conns[c] = struct{}{}
+	s.active.Add(1)
+	s.metrics.acceptedConns.Inc()
+	s.metrics.activeConns.Inc()
+	return c, true
+}
+
+// untrack forgets conn and frees its place under the limits.
+func (s *Server) untrack(c *trackedConn) {
+	s.forget(c)
+	if c.release != nil {
+		c.release()
+	}
+}
+
+// forget stops counting c among the server's connections.
+func (s *Server) forget(c *trackedConn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	s.metrics.activeConns.Dec()
+	s.metrics.closedConns.Inc()
+}
+
+func (l Listener) listen() ([]net.Listener, error) {
+	if l.Listener != nil {
+		return []net.Listener{l.Listener}, nil
+	}
+	network := l.Network
+	if network == "" {
+		network = "tcp"
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return listenTCP(network, l.Address, l.Socket)
+	case "unix":
+		if l.Socket.ReusePort > 0 || l.Socket.DeferAccept > 0 {
+			return nil, errors.New("server: ReusePort and DeferAccept are only for TCP")
+		}
+		listener, err := listenUnix(l.Address, l.Mode, l.Socket)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+	return nil, fmt.Errorf("server: unsupported network %q", network)
+}
+
+// listenTCP opens a socket on address, or socket.ReusePort of them.
+func listenTCP(network, address string, socket SocketOptions) ([]net.Listener, error) {
+	lc := socket.listenConfig()
+	var listeners []net.Listener
+	for range max(socket.ReusePort, 1) {
+		listener, err := lc.Listen(context.Background(), network, address)
+		if err == nil {
+			if err = socket.setBacklog(listener); err != nil {
+				_ = listener.Close()
+			}
+		}
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		// the others take the port the first was given, if it was 0
+		address = listener.Addr().String()
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on the socket file path, replacing one left behind by
+// a process that did not exit cleanly.
+func listenUnix(path string, mode os.FileMode, socket SocketOptions) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := socket.setBacklog(listener); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	// there is a moment before this when the umask applies, so a
+	// restrictive mode needs a directory that is restricted too
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at path unless something is
+// listening on it. Any other kind of file is left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("server: %s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("server: %s is already in use", path)
+	}
+	return os.Remove(path)
+}
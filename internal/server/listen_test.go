@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getOver sends a GET request for target over conn and returns the response.
+func getOver(t *testing.T, conn net.Conn, target string) testResponse {
+	t.Helper()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err := io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	return readResponse(t, bufio.NewReader(conn))
+}
+
+func TestServeListeners(t *testing.T) {
+	s := New(okHandler, DefaultConfig)
+	t.Cleanup(func() { _ = s.Close() })
+
+	// Test: Port 0 binds a free port, which Serve reports
+	v4, err := s.Serve(Listener{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	assert.NotZero(t, v4.(*net.TCPAddr).Port)
+
+	// Test: A Unix socket gets the requested permissions
+	path := filepath.Join(t.TempDir(), "http.sock")
+	unix, err := s.Serve(Listener{Network: "unix", Address: path, Mode: 0o600})
+	require.NoError(t, err)
+	assert.Equal(t, path, unix.String())
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// Test: A caller's listener is served as is
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	own, err := s.Serve(Listener{Listener: ln})
+	require.NoError(t, err)
+	assert.Equal(t, ln.Addr(), own)
+
+	addrs := []net.Addr{v4, unix, own}
+	// IPv6 may be unavailable in the sandbox
+	if v6, err := s.Serve(Listener{Network: "tcp6", Address: "[::1]:0"}); err == nil {
+		addrs = append(addrs, v6)
+	} else {
+		t.Logf("skipping IPv6: %v", err)
+	}
+	assert.Equal(t, addrs, s.Addrs())
+
+	// Test: Every listener answers
+	for _, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		require.NoError(t, err, addr)
+		assert.Equal(t, "/"+addr.Network(), getOver(t, conn, "/"+addr.Network()).body)
+		_ = conn.Close()
+	}
+
+	// Test: Shutdown stops them all and removes the socket file
+	require.NoError(t, s.Shutdown(context.Background()))
+	for _, addr := range addrs {
+		_, err := net.Dial(addr.Network(), addr.String())
+		assert.Error(t, err, addr)
+	}
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = s.Serve(Listener{Address: "127.0.0.1:0"})
+	assert.ErrorIs(t, err, ErrServerClosed)
+}
+
+func TestServeUnixStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// Test: A socket file left by a dead process is replaced
+	path := filepath.Join(dir, "stale.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	ln.SetUnlinkOnClose(false)
+	require.NoError(t, ln.Close())
+	s := New(okHandler, DefaultConfig)
+	t.Cleanup(func() { _ = s.Close() })
+	_, err = s.Serve(Listener{Network: "unix", Address: path})
+	require.NoError(t, err)
+
+	// Test: A socket in use is not
+	_, err = New(okHandler, DefaultConfig).Serve(Listener{Network: "unix", Address: path})
+	assert.ErrorContains(t, err, "in use")
+
+	// Test: Nor is a file that is not a socket
+	file := filepath.Join(dir, "data")
+	require.NoError(t, os.WriteFile(file, []byte("keep me"), 0o600))
+	_, err = New(okHandler, DefaultConfig).Serve(Listener{Network: "unix", Address: file})
+	assert.ErrorContains(t, err, "not a socket")
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "keep me", string(b))
+}
+
+func TestListenerFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	s := New(okHandler, DefaultConfig)
+	_, err := s.Serve(Listener{Network: "unix", Address: path})
+	require.NoError(t, err)
+
+	// Test: Taking the files leaves the socket file to the server, in case
+	// the handoff fails
+	files, err := s.ListenerFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	closeFiles(files)
+	require.NoError(t, s.Close())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Once the new process has them, Close leaves the file to it
+	s = New(okHandler, DefaultConfig)
+	_, err = s.Serve(Listener{Network: "unix", Address: path})
+	require.NoError(t, err)
+	files, err = s.ListenerFiles()
+	require.NoError(t, err)
+	ln, err := net.FileListener(files[0])
+	require.NoError(t, err)
+	closeFiles(files)
+	s.KeepSocketFiles()
+	require.NoError(t, s.Close())
+	t.Cleanup(func() { _ = ln.Close() })
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+func TestServeInvalidListener(t *testing.T) {
+	s := New(okHandler, DefaultConfig)
+	_, err := s.Serve(Listener{Network: "udp", Address: "127.0.0.1:0"})
+	assert.ErrorContains(t, err, "unsupported network")
+	_, err = s.Serve(Listener{Address: "127.0.0.1:-1"})
+	assert.Error(t, err)
+	_, err = s.Serve(Listener{Network: "unix", Address: filepath.Join(t.TempDir(), "s.sock"), Socket: SocketOptions{ReusePort: 2}})
+	assert.ErrorContains(t, err, "only for TCP")
+	assert.Empty(t, s.Addrs())
+}
+
+func TestServeConn(t *testing.T) {
+	s := New(okHandler, DefaultConfig)
+	client, conn := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	served := make(chan error, 1)
+	go func() { served <- s.ServeConn(conn) }()
+
+	// Test: A pipe carries keep-alive requests like a TCP connection
+	br := bufio.NewReader(client)
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	for _, target := range []string{"/one", "/two"} {
+		_, err := io.WriteString(client, "GET "+target+" HTTP/1.1\r\nHost: x\r\n\r\n")
+		require.NoError(t, err)
+		assert.Equal(t, target, readResponse(t, br).body)
+	}
+
+	// Test: ServeConn returns once the client hangs up
+	require.NoError(t, client.Close())
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+
+	// Test: Shutdown closes idle connections served this way too
+	client, conn = net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	go func() { served <- s.ServeConn(conn) }()
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	br = bufio.NewReader(client)
+	_, err := io.WriteString(client, "GET /idle HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/idle", readResponse(t, br).body)
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-served)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A closed server refuses, and closes, new connections
+	client, conn = net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	assert.ErrorIs(t, s.ServeConn(conn), ErrServerClosed)
+	_, err = conn.Write([]byte("x"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestServeConnTLS(t *testing.T) {
+	files, cert := writeCert(t, t.TempDir(), "a", "a.test")
+	s, err := NewTLS(okHandler, DefaultConfig, TLSConfig{Certificates: []CertificateFiles{files}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	client, conn := net.Pipe()
+	go func() { _ = s.ServeConn(conn) }()
+
+	// Test: A TLS server runs the handshake on connections it is handed
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	tc := tls.Client(client, &tls.Config{ServerName: "a.test", RootCAs: pool, NextProtos: []string{"http/1.1"}})
+	t.Cleanup(func() { _ = tc.Close() })
+	assert.Equal(t, "/secure", getOver(t, tc, "/secure").body)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"httpfromtcp.haonguyen.tech/internal/metrics"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// sizeBuckets are the response size buckets, from 100 bytes to 10 MB.
+var sizeBuckets = metrics.ExponentialBuckets(100, 10, 6)
+
+// serverMetrics are what a Server records about its connections and
+// requests.
+type serverMetrics struct {
+	activeConns   *metrics.Gauge
+	acceptedConns *metrics.Counter
+	closedConns   *metrics.Counter
+	rejectedConns *metrics.Counter
+	requests      *metrics.CounterVec
+	duration      *metrics.HistogramVec
+	size          *metrics.HistogramVec
+	parseErrors   *metrics.CounterVec
+}
+
+func newServerMetrics(r *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		activeConns: r.Gauge("http_server_active_connections",
+			"Connections being served."),
+		acceptedConns: r.Counter("http_server_connections_accepted_total",
+			"Connections taken on for serving."),
+		closedConns: r.Counter("http_server_connections_closed_total",
+			"Connections that were served and closed or hijacked."),
+		rejectedConns: r.Counter("http_server_connections_rejected_total",
+			"Connections turned away for being over the limits."),
+		requests: r.CounterVec("http_server_requests_total",
+			"Requests handled, by method, route and status code.", "method", "route", "status"),
+		duration: r.HistogramVec("http_server_request_duration_seconds",
+			"Time spent handling requests, by method and route.", metrics.DefBuckets, "method", "route"),
+		size: r.HistogramVec("http_server_response_size_bytes",
+			"Size of response bodies as sent, by method and route.", sizeBuckets, "method", "route"),
+		parseErrors: r.CounterVec("http_server_parse_errors_total",
+			"Requests that could not be read, by kind: timeout, too_long, too_large or malformed.", "kind"),
+	}
+}
+
+type routeKey struct{}
+
+// SetRoute records pattern, such as "/users/{id}", as the route req matched.
+// The server's request metrics are labelled with it rather than with the
+// target, which would make a series per URL. Routers call it before passing
+// req on; requests without a route are counted under "".
+func SetRoute(req *request.Request, pattern string) {
+	if route, ok := req.Context().Value(routeKey{}).(*string); ok {
+		*route = pattern
+	}
+}
+
+// Route returns the route pattern recorded for req with SetRoute, or "" if
+// there is none yet. Middleware can read it once the handler has returned.
+func Route(req *request.Request) string {
+	if route, ok := req.Context().Value(routeKey{}).(*string); ok {
+		return *route
+	}
+	return ""
+}
+
+// observeRequest records a request handled since start. route is read
+// once the handler has returned and set it.
+func (m *serverMetrics) observeRequest(w response.ResponseWriter, r *request.Request, route *string, start time.Time) {
+	st, _ := response.StatsOf(w)
+	method := methodLabel(r.RequestLine.Method)
+	m.requests.With(method, *route, strconv.Itoa(int(st.StatusCode))).Inc()
+	m.duration.With(method, *route).Observe(time.Since(start).Seconds())
+	m.size.With(method, *route).Observe(float64(st.EncodedBodyBytes))
+}
+
+// standardMethods are the methods of RFC 9110 and PATCH.
+var standardMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// methodLabel returns method for the standard methods and "OTHER" for the
+// rest, which clients may invent freely and would each add series that are
+// never freed.
+func methodLabel(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// parseErrorKind names the kind of a request reading error.
+func parseErrorKind(err error) string {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, request.ErrLineTooLong), errors.Is(err, request.ErrHeaderTooLarge):
+		return "too_long"
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return "too_large"
+	}
+	return "malformed"
+}
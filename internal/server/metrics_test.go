@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/metrics"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// scrape renders r and returns its lines.
+func scrape(t *testing.T, r *metrics.Registry) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	return strings.Split(buf.String(), "\n")
+}
+
+func TestMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	routed := func(w response.ResponseWriter, req *request.Request) {
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/users/") {
+			SetRoute(req, "/users/{id}")
+		}
+		okHandler(w, req)
+	}
+	addr := startServer(t, routed, Config{Metrics: registry})
+
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+	for _, target := range []string{"/users/1", "/users/2", "/other"} {
+		send(t, conn, target)
+		assert.Equal(t, target, readResponse(t, br).body)
+	}
+	for _, method := range []string{"FOO", "BAR"} {
+		_, err := io.WriteString(conn, method+" /other HTTP/1.1\r\nHost: x\r\n\r\n")
+		require.NoError(t, err)
+		readResponse(t, br)
+	}
+
+	// Test: Requests are counted by method, route and status, with their
+	// duration and body size, while the connection is active
+	lines := scrape(t, registry)
+	assert.Contains(t, lines, `http_server_requests_total{method="GET",route="/users/{id}",status="200"} 2`)
+	assert.Contains(t, lines, `http_server_requests_total{method="GET",route="",status="200"} 1`)
+	assert.Contains(t, lines, `http_server_request_duration_seconds_count{method="GET",route="/users/{id}"} 2`)
+	assert.Contains(t, lines, `http_server_response_size_bytes_bucket{method="GET",route="/users/{id}",le="100"} 2`)
+	assert.Contains(t, lines, `http_server_response_size_bytes_sum{method="GET",route="/users/{id}"} 16`)
+	assert.Contains(t, lines, `http_server_active_connections 1`)
+
+	// Test: Methods clients invent are counted together, not in series of
+	// their own
+	assert.Contains(t, lines, `http_server_requests_total{method="OTHER",route="",status="200"} 2`)
+	for _, line := range lines {
+		assert.NotContains(t, line, "FOO")
+	}
+	assert.Contains(t, lines, `http_server_connections_accepted_total 1`)
+
+	// Test: Requests that cannot be read are counted by kind
+	bad := dial(t, addr)
+	_, err := io.WriteString(bad, "NOT HTTP\r\n\r\n")
+	require.NoError(t, err)
+	_, _ = io.ReadAll(bad)
+	assert.Contains(t, scrape(t, registry), `http_server_parse_errors_total{kind="malformed"} 1`)
+
+	// Test: Closed connections are no longer active
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		lines := scrape(t, registry)
+		return slices.Contains(lines, `http_server_active_connections 0`) &&
+			slices.Contains(lines, `http_server_connections_closed_total 2`)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, scrape(t, registry), `http_server_connections_accepted_total 2`)
+}
+
+func TestParseErrorKind(t *testing.T) {
+	assert.Equal(t, "too_long", parseErrorKind(request.ErrLineTooLong))
+	assert.Equal(t, "too_long", parseErrorKind(request.ErrHeaderTooLarge))
+	assert.Equal(t, "too_large", parseErrorKind(request.ErrBodyTooLarge))
+	assert.Equal(t, "malformed", parseErrorKind(io.ErrUnexpectedEOF))
+}
@@ -1,86 +1,677 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/http2"
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/metrics"
+	"httpfromtcp.haonguyen.tech/internal/problem"
 	"httpfromtcp.haonguyen.tech/internal/request"
 	"httpfromtcp.haonguyen.tech/internal/response"
 )
 
-type Handler func(w *response.Writer, req *request.Request)
+// readBufferSize is the per-connection read buffer, which also caps the
+// length of a single request line or header field.
+const readBufferSize = 16 << 10
+
+type Handler func(w response.ResponseWriter, req *request.Request)
+
+// Middleware wraps a Handler with behaviour that runs around it, such as
+// logging, authentication or compression. It may pass the next handler a
+// wrapped ResponseWriter; see response.Wrapper.
+type Middleware func(next Handler) Handler
+
+// Chain combines middleware into one. The first is the outermost: it sees
+// the request first and the response last.
+func Chain(middleware ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			next = middleware[i](next)
+		}
+		return next
+	}
+}
+
+// Config holds the connection timeouts, limits and hooks of a Server. A zero duration
+// disables the corresponding timeout.
+type Config struct {
+	// ReadHeaderTimeout bounds reading the request line and headers, from
+	// the first byte of the request. Clients that are too slow get a 408
+	// Request Timeout. If zero, ReadTimeout is used.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading the whole request, body included.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing the response, from the end of the request.
+	// On HTTP/2 it bounds each write to the connection instead, 30 seconds
+	// if zero, as streams share it.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds how long a keep-alive connection waits for its next
+	// request. If zero, ReadTimeout is used.
+	IdleTimeout time.Duration
+	// MaxBodySize bounds request bodies, 16 MiB if zero. Larger ones get
+	// 413 Content Too Large, or have their HTTP/2 stream reset.
+	MaxBodySize int64
+
+	// OnPanic, if set, is called after a handler panic has been recovered
+	// and logged, with the panic value and the goroutine's stack trace. Use
+	// it to report panics to an error tracker.
+	OnPanic func(req *request.Request, recovered any, stack []byte)
+	// OnResponse, if set, is called once each request has been answered,
+	// with the time it started, whether the handler answered or the server
+	// did: after a panic, past MaxRequests, or for a request that could not
+	// be read, in which case req holds what was read of it. Access logs hook
+	// in here rather than in Middleware.
+	OnResponse func(w response.ResponseWriter, req *request.Request, start time.Time)
+
+	// Middleware is applied around the handler for every request, the first
+	// entry outermost.
+	Middleware []Middleware
+
+	// Logger receives the server's logs. If nil, slog.Default is used.
+	// Handlers find it, with the request's method, target and client
+	// attached, through logging.FromContext.
+	Logger *slog.Logger
+	// Metrics receives the server's connection and request metrics. If nil,
+	// metrics.Default is used. Servers sharing a registry add up.
+	Metrics *metrics.Registry
+
+	// MaxConns caps the connections accepted from listeners and served at
+	// once, and MaxRequests the requests being handled at once, HTTP/2
+	// streams included. Zero means no limit. Overload decides what happens
+	// to work past them.
+	MaxConns    int
+	MaxRequests int
+	Overload    OverloadPolicy
+	// MaxConnsPerIP caps the connections from one client IP address. Those
+	// past it always get a 503, as waiting would hold everyone else up too.
+	// Hijacked connections count towards MaxConns and MaxConnsPerIP until
+	// their new owner closes them.
+	MaxConnsPerIP int
+	// RetryAfter is how long clients turned away with a 503 are told to wait
+	// before trying again, in whole seconds. It is at least a second.
+	RetryAfter time.Duration
+}
+
+// DefaultConfig is used by Serve. It has no WriteTimeout so long-lived
+// streaming responses keep working.
+var DefaultConfig = Config{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       time.Minute,
+	IdleTimeout:       2 * time.Minute,
+}
 
 type Server struct {
-	listener net.Listener
 	isClosed atomic.Bool
-	handler  Handler
+	// done is closed by Close, to stop accept loops waiting for room
+	done    chan struct{}
+	handler Handler
+	config  Config
+	limits  *limits
+	log     *slog.Logger
+	metrics *serverMetrics
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	// accepting counts the running accept loops; only once they have all
+	// exited is it safe to wait on active.
+	accepting sync.WaitGroup
+	active    sync.WaitGroup
+	conns     map[*trackedConn]struct{}
+
+	// certs and tlsConfig are set when serving TLS
+	certs     *certStore
+	tlsConfig *tls.Config
+}
+
+// trackedConn is a connection the server is serving, so Shutdown can tell
+// idle connections from ones with a request in flight.
+type trackedConn struct {
+	net.Conn
+	// log is the server's logger with the client's address
+	log  *slog.Logger
+	mu   sync.Mutex
+	idle bool
+	// w is the writer of the in-flight response, nil while idle
+	w *response.Writer
+	// h2 is set once the connection speaks HTTP/2
+	h2 *http2.Conn
+	// hijacked is set once a handler has taken the connection over
+	hijacked bool
+	// draining is set once Shutdown has found the connection idle
+	draining bool
+	// release, if set, frees the connection's place under the limits
+	release func()
 }
 
+// Serve listens on port on every interface with DefaultConfig. Use New to
+// configure the addresses.
 func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return nil, err
-	}
+	return ServeConfig(port, handler, DefaultConfig)
+}
 
-	s := &Server{
-		listener: listener,
-		handler:  handler,
+// ServeConfig is like Serve but with explicit connection timeouts.
+func ServeConfig(port int, handler Handler, config Config) (*Server, error) {
+	s := New(handler, config)
+	if _, err := s.Serve(Listener{Address: fmt.Sprintf(":%d", port)}); err != nil {
+		return nil, err
 	}
-
-	go s.listen()
-
 	return s, nil
 }
 
+// Close stops accepting connections on every listener. Connections already
+// accepted are left to finish on their own; use Shutdown to wait for them.
 func (s *Server) Close() error {
-	s.isClosed.Store(true)
-	return s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isClosed.Swap(true) {
+		close(s.done)
+	}
+	var errs []error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (s *Server) listen() {
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			if s.isClosed.Load() {
-				return
+// Shutdown stops accepting connections, closes idle ones and asks active ones
+// to send "Connection: close" with their response. It then waits for every
+// handler to return. If ctx ends first, the remaining connections are closed
+// forcibly and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+	s.accepting.Wait()
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.mu.Lock()
+		if c.idle {
+			// interrupt the wait for a request rather than closing the
+			// connection, so one that has just come in is still answered
+			c.draining = true
+			if err := c.SetReadDeadline(time.Now()); err != nil && !isClosedErr(err) {
+				c.log.Error("interrupting read", "err", err)
 			}
-			log.Printf("error when accepting connection %v", err)
-			continue
+		} else if c.w != nil {
+			c.w.CloseAfterResponse()
+		} else if c.h2 != nil {
+			// sending GOAWAY may block, and must not hold up the loop
+			go c.h2.Shutdown()
 		}
-		go s.handle(conn)
+		c.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			s.closeConn(c)
+		}
+		s.mu.Unlock()
+		return ctx.Err()
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	w := response.NewWriter(conn)
+func (s *Server) handle(conn *trackedConn) {
 	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("error closing connection in handle: %v\n", err)
+		if conn.isHijacked() {
+			// the new owner closes it, and release did the rest
+			return
 		}
+		s.untrack(conn)
+		s.closeConn(conn)
+		s.active.Done()
 	}()
 
-	r, err := request.RequestFromReader(conn)
+	br := bufio.NewReaderSize(conn, readBufferSize)
+	if s.negotiateHTTP2(conn, br) {
+		return
+	}
+	for first := true; ; first = false {
+		// Wait for the next request to start. A fresh connection gets the
+		// header timeout, a kept-alive one the idle timeout.
+		wait := s.headerTimeout()
+		if !first {
+			wait = s.idleTimeout()
+		}
+		if !conn.awaitRequest(br, wait) {
+			// nothing was sent, so there is nobody to answer
+			return
+		}
+		if !s.serveRequest(conn, br) || s.isClosed.Load() {
+			return
+		}
+	}
+}
+
+// negotiateHTTP2 serves conn as HTTP/2 if the client picked "h2" with ALPN,
+// or sent the HTTP/2 connection preface straight away (h2c with prior
+// knowledge). It reports whether the connection has been dealt with,
+// including a TLS handshake that failed.
+func (s *Server) negotiateHTTP2(conn *trackedConn, br *bufio.Reader) bool {
+	conn.setReadDeadline(s.headerTimeout())
+	var state *tls.ConnectionState
+	if tc, ok := conn.Conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			// the client cannot be answered without a handshake
+			return true
+		}
+		cs := tc.ConnectionState()
+		if cs.NegotiatedProtocol != "h2" {
+			return false
+		}
+		state = &cs
+	} else if !hasPreface(br) {
+		return false
+	}
+
+	h2 := s.newHTTP2Conn(conn, br, state)
+	logHTTP2Error(conn, h2.Serve())
+	return true
+}
+
+// upgradeH2C switches conn to HTTP/2 if r is a cleartext HTTP/1.1 request
+// with "Upgrade: h2c" and an HTTP2-Settings header, answering r as the first
+// stream. It reports whether it did; if not, r is still to be answered.
+func (s *Server) upgradeH2C(conn *trackedConn, br *bufio.Reader, r *request.Request) bool {
+	if _, isTLS := conn.Conn.(*tls.Conn); isTLS || r.RequestLine.HttpVersion != "1.1" {
+		return false
+	}
+	header, ok := r.Headers.Get("HTTP2-Settings")
+	if !ok || !hasToken(r.Headers, "Upgrade", "h2c") ||
+		!hasToken(r.Headers, "Connection", "Upgrade") || !hasToken(r.Headers, "Connection", "HTTP2-Settings") {
+		return false
+	}
+	settings, err := http2.DecodeUpgradeSettings(header)
 	if err != nil {
-		log.Printf("error: parsing request: %v\n", err)
-		err := w.WriteStatusLine(response.StatusBadRequest)
-		if err != nil {
-			log.Printf("error when write status line %v\n", err)
+		// the upgrade is optional, so the request is answered as is
+		conn.log.Warn("ignoring h2c upgrade", "err", err)
+		return false
+	}
+	h2 := s.newHTTP2Conn(conn, br, nil)
+	// the client sends its preface after our 101
+	conn.setReadDeadline(s.headerTimeout())
+	conn.setWriteDeadline(0)
+	logHTTP2Error(conn, h2.ServeUpgrade(r, settings))
+	return true
+}
+
+// newHTTP2Conn prepares conn for HTTP/2 and registers it for Shutdown. state
+// is the TLS connection state handlers see, nil for h2c.
+func (s *Server) newHTTP2Conn(conn *trackedConn, br *bufio.Reader, state *tls.ConnectionState) *http2.Conn {
+	h2 := http2.NewConn(conn, br, func(w response.ResponseWriter, r *request.Request) {
+		r.TLS = state
+		r.RemoteAddr = conn.RemoteAddr().String()
+		if ok, sent := s.runHandler(conn, w, r); !ok && sent {
+			// the client must not take a cut-short response as complete
+			panic(http2.ErrAbortStream)
+		}
+	}, http2.Config{IdleTimeout: s.idleTimeout(), WriteTimeout: s.config.WriteTimeout, MaxBodySize: s.maxBodySize(), Logger: conn.log})
+	conn.setHTTP2(h2)
+	if s.isClosed.Load() {
+		h2.Shutdown()
+	}
+	return h2
+}
+
+func logHTTP2Error(conn *trackedConn, err error) {
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+		conn.log.Error("serving HTTP/2", "err", err)
+	}
+}
+
+// hasPreface reports whether br starts with the HTTP/2 client preface. It
+// reads no further than the bytes keep matching, so it never waits on an
+// HTTP/1.1 request shorter than the preface.
+func hasPreface(br *bufio.Reader) bool {
+	for n := 1; n <= len(http2.ClientPreface); n++ {
+		b, err := br.Peek(n)
+		if err != nil || b[n-1] != http2.ClientPreface[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) closeConn(conn net.Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.log.Error("closing connection", "remote", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// serveRequest reads one request from br and answers it. It reports whether
+// the connection can be used for another request.
+func (s *Server) serveRequest(conn *trackedConn, br *bufio.Reader) bool {
+	start := time.Now()
+	conn.setReadDeadlineFrom(start, s.headerTimeout())
+	r, err := request.ReadRequestLimited(br, s.maxBodySize(), func(*request.Request) {
+		conn.setReadDeadlineFrom(start, s.config.ReadTimeout)
+	})
+	// the writer is created once the request is in, so its stats time the
+	// response rather than the client
+	w := &connWriter{Writer: response.NewWriter(conn), s: s, conn: conn, br: br}
+	conn.setWriter(w.Writer)
+	if s.isClosed.Load() {
+		w.CloseAfterResponse()
+	}
+	conn.setWriteDeadline(s.config.WriteTimeout)
+	defer func() {
+		if w.hijacked {
 			return
 		}
-		body := fmt.Appendf(nil, "error: parsing request: %v\n", err)
-		err = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-		if err != nil {
-			log.Printf("error when write header %v\n", err)
+		if err := w.Flush(); err != nil {
+			conn.log.Error("flushing response", "err", err)
+		}
+		conn.setIdle()
+	}()
+	if err != nil {
+		s.metrics.parseErrors.With(parseErrorKind(err)).Inc()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			conn.log.Warn("reading request", "err", err)
+			err = problem.New(response.StatusRequestTimeout, "The request was not received in time.")
+		} else if errors.Is(err, request.ErrLineTooLong) || errors.Is(err, request.ErrHeaderTooLarge) {
+			// the error quotes the client's input, so it is only logged
+			conn.log.Warn("parsing request", "err", err)
+			err = problem.New(response.StatusRequestHeaderFieldsTooLarge, "The request line or header section is too large.")
+		} else if errors.Is(err, request.ErrBodyTooLarge) {
+			conn.log.Warn("reading request", "err", err)
+			err = problem.New(response.StatusContentTooLarge, "The request body is too large.")
+		} else {
+			conn.log.Warn("parsing request", "err", err)
+			err = problem.New(response.StatusBadRequest, "The request could not be parsed.")
+		}
+		if err := problem.Write(w, r, err); err != nil {
+			conn.log.Error("writing parse error response", "err", err)
+		}
+		if r == nil {
+			r = &request.Request{Headers: headers.NewHeaders()}
+		}
+		r.RemoteAddr = conn.RemoteAddr().String()
+		s.answered(w, r, start)
+		return false
+	}
+
+	if s.upgradeH2C(conn, br, r) {
+		return false
+	}
+	w.SetRequestVersion(r.RequestLine.HttpVersion)
+	// a request framed by both may have been read differently by a proxy in
+	// front, so what follows it cannot be trusted (RFC 9112 section 6.3)
+	_, chunked := r.Headers.Get("Transfer-Encoding")
+	if _, hasLength := r.Headers.Get("Content-Length"); chunked && hasLength {
+		w.CloseAfterResponse()
+	}
+	if tc, ok := conn.Conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		r.TLS = &state
+	}
+	r.RemoteAddr = conn.RemoteAddr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.watcher = watchDisconnect(conn, br, cancel)
+
+	handled, _ := s.runHandler(conn, w, r.WithContext(ctx))
+	if w.hijacked {
+		return false
+	}
+
+	if err := w.Flush(); err != nil {
+		conn.log.Error("flushing response", "err", err)
+		return false
+	}
+	clientGone := w.watcher.stop()
+	conn.setWriteDeadline(0)
+	return handled && !clientGone && keepAlive(r, w.Stats())
+}
+
+// runHandler calls the handler, recovering from a panic so it only takes
+// down its own connection. If nothing final was sent yet the client gets a
+// 500; otherwise the response is cut short. It reports whether the handler
+// returned normally and, if not, whether part of a response was already sent.
+func (s *Server) runHandler(conn *trackedConn, w response.ResponseWriter, r *request.Request) (ok, sent bool) {
+	logger := conn.log.With("method", r.RequestLine.Method, "target", r.RequestLine.RequestTarget)
+	var route string
+	ctx := context.WithValue(r.Context(), routeKey{}, &route)
+	r = r.WithContext(logging.NewContext(ctx, logger))
+	start := time.Now()
+	defer s.metrics.observeRequest(w, r, &route, start)
+	// deferred before the recover below, so it runs after it and sees the
+	// 500
+	defer s.answered(w, r, start)
+	defer func() {
+		// an HTTP/2 stream is ended here rather than once this returns, so
+		// the hooks above see the whole response; one cut short is reset
+		// by the caller instead
+		if f, isH2 := w.(interface{ Finish() error }); isH2 && (ok || !sent) {
+			_ = f.Finish()
+		}
+	}()
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
 			return
 		}
-		_, err = w.WriteBody(body)
-		if err != nil {
-			log.Printf("error when write body %v\n", err)
+		ok = false
+		stack := debug.Stack()
+		logger.Error("panic serving request", "panic", recovered, "stack", string(stack))
+		if s.config.OnPanic != nil {
+			s.config.OnPanic(r, recovered, stack)
+		}
+		if st, _ := response.StatsOf(w); st.StatusCode != 0 {
+			sent = true
 			return
 		}
-		return
+		if err := problem.Write(w, r, problem.New(response.StatusServerInternalError, "")); err != nil {
+			logger.Error("writing panic response", "err", err)
+		}
+	}()
+	if !s.limits.acquireRequest(r.Context()) {
+		// a client that went away while waiting is not answered
+		if r.Context().Err() == nil {
+			s.rejectRequest(w, r)
+		}
+		return true, false
 	}
+	defer s.limits.releaseRequest()
 	s.handler(w, r)
+	return true, false
+}
+
+// answered calls the OnResponse hook, if any, for r.
+func (s *Server) answered(w response.ResponseWriter, r *request.Request, start time.Time) {
+	if s.config.OnResponse != nil {
+		s.config.OnResponse(w, r, start)
+	}
+}
+
+// awaitRequest waits up to timeout for a request to start on br and marks
+// the connection active once one has. It reports false if none came, or
+// Shutdown found the connection idle before it did; input already buffered
+// arrived in time and is served either way.
+func (c *trackedConn) awaitRequest(br *bufio.Reader, timeout time.Duration) bool {
+	c.mu.Lock()
+	draining := c.draining
+	if !draining {
+		// set under mu, so it cannot undo the deadline Shutdown sets
+		c.setReadDeadline(timeout)
+	}
+	c.mu.Unlock()
+	if draining && br.Buffered() == 0 {
+		return false
+	}
+	if _, err := br.Peek(1); err != nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = false
+	return true
+}
+
+func (c *trackedConn) setWriter(w *response.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w = w
+}
+
+// setHTTP2 marks the connection active for good: HTTP/2 connections are
+// shut down with GOAWAY rather than closed while idle.
+func (c *trackedConn) setHTTP2(h2 *http2.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle, c.w, c.h2 = false, nil, h2
+}
+
+func (c *trackedConn) setIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle, c.w = true, nil
+}
+
+// defaultMaxBodySize is the MaxBodySize of a zero Config.
+const defaultMaxBodySize = 16 << 20
+
+func (s *Server) maxBodySize() int64 {
+	if s.config.MaxBodySize > 0 {
+		return s.config.MaxBodySize
+	}
+	return defaultMaxBodySize
+}
+
+func (s *Server) headerTimeout() time.Duration {
+	if s.config.ReadHeaderTimeout > 0 {
+		return s.config.ReadHeaderTimeout
+	}
+	return s.config.ReadTimeout
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.config.IdleTimeout > 0 {
+		return s.config.IdleTimeout
+	}
+	return s.config.ReadTimeout
+}
+
+// disconnectWatcher notices a client hanging up while its request is being
+// handled. It peeks rather than reads, so a pipelined request that arrives
+// in the meantime stays buffered for the next round.
+type disconnectWatcher struct {
+	conn *trackedConn
+	done chan struct{}
+	gone atomic.Bool
+}
+
+func watchDisconnect(conn *trackedConn, br *bufio.Reader, cancel context.CancelFunc) *disconnectWatcher {
+	dw := &disconnectWatcher{conn: conn, done: make(chan struct{})}
+	// the whole request has been read, so reads may block until the client
+	// sends more or goes away
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.log.Error("clearing read deadline", "err", err)
+	}
+	go func() {
+		defer close(dw.done)
+		_, err := br.Peek(1)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			dw.gone.Store(true)
+			cancel()
+		}
+	}()
+	return dw
+}
+
+// stop interrupts the pending peek and reports whether the client hung up.
+func (dw *disconnectWatcher) stop() bool {
+	if err := dw.conn.SetReadDeadline(time.Now()); err != nil && !isClosedErr(err) {
+		dw.conn.log.Error("interrupting read", "err", err)
+	}
+	<-dw.done
+	return dw.gone.Load()
+}
+
+// keepAlive reports whether the connection may carry another request after
+// r was answered with a response described by st.
+func keepAlive(r *request.Request, st response.Stats) bool {
+	if hasToken(r.Headers, "Connection", "close") || st.StatusCode == 0 {
+		return false
+	}
+
+	if hasToken(st.Headers, "Connection", "close") {
+		return false
+	}
+	if st.StatusCode == response.StatusNoContent {
+		return true
+	}
+	// without a length or chunked framing the client can only find the end
+	// of the body by the connection closing
+	_, hasLength := st.Headers.Get("Content-Length")
+	return hasLength || hasToken(st.Headers, "Transfer-Encoding", "chunked")
+}
+
+// hasToken reports whether the comma-separated header key lists token.
+func hasToken(h headers.Headers, key, token string) bool {
+	v, ok := h.Get(key)
+	if !ok {
+		return false
+	}
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *trackedConn) setReadDeadline(timeout time.Duration) {
+	c.setReadDeadlineFrom(time.Now(), timeout)
+}
+
+func (c *trackedConn) setReadDeadlineFrom(start time.Time, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = start.Add(timeout)
+	}
+	if err := c.SetReadDeadline(deadline); err != nil && !isClosedErr(err) {
+		c.log.Error("setting read deadline", "err", err)
+	}
+}
+
+func (c *trackedConn) setWriteDeadline(timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := c.SetWriteDeadline(deadline); err != nil && !isClosedErr(err) {
+		c.log.Error("setting write deadline", "err", err)
+	}
+}
+
+// isClosedErr reports whether err comes from using a closed connection, or
+// a pipe whose other end is closed.
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
 }
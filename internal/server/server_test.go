@@ -0,0 +1,555 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// okHandler answers every request with a keep-alive friendly 200 whose body
+// is the request target.
+func okHandler(w response.ResponseWriter, req *request.Request) {
+	body := []byte(req.RequestLine.RequestTarget)
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody(body)
+}
+
+func startServer(t *testing.T, handler Handler, config Config) string {
+	t.Helper()
+	s := New(handler, config)
+	t.Cleanup(func() { _ = s.Close() })
+	addr, err := s.Serve(Listener{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	return addr.String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	return conn
+}
+
+type testResponse struct {
+	status  string
+	headers map[string]string
+	body    string
+}
+
+// readResponse reads one response with a Content-Length body.
+func readResponse(t *testing.T, br *bufio.Reader) testResponse {
+	t.Helper()
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	res := testResponse{status: strings.TrimSpace(statusLine), headers: map[string]string{}}
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		k, v, _ := strings.Cut(strings.TrimSpace(line), ": ")
+		res.headers[k] = v
+	}
+	length, err := strconv.Atoi(res.headers["content-length"])
+	require.NoError(t, err)
+	b := make([]byte, length)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	res.body = string(b)
+	return res
+}
+
+// assertClosed checks the server closes conn within a second.
+func assertClosed(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestKeepAlive(t *testing.T) {
+	addr := startServer(t, okHandler, Config{})
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+
+	// Test: Sequential requests on one connection
+	_, err := io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	res := readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", res.status)
+	assert.Equal(t, "/one", res.body)
+
+	// Test: Pipelined requests, the first with a body
+	_, err = io.WriteString(conn, "POST /two HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /three HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/two", readResponse(t, br).body)
+	assert.Equal(t, "/three", readResponse(t, br).body)
+
+	// Test: Connection: close from the client ends the connection
+	_, err = io.WriteString(conn, "GET /four HTTP/1.1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/four", readResponse(t, br).body)
+	assertClosed(t, conn, br)
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	addr := startServer(t, okHandler, Config{ReadHeaderTimeout: 100 * time.Millisecond})
+
+	// Test: A client that sends nothing is dropped without a response
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+	assertClosed(t, conn, br)
+
+	// Test: A client that stalls mid-headers gets 408
+	conn = dial(t, addr)
+	br = bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHo")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", readResponse(t, br).status)
+	assertClosed(t, conn, br)
+
+	// Test: A slowloris trickling one byte at a time still times out
+	conn = dial(t, addr)
+	br = bufio.NewReader(conn)
+	go func() {
+		for i := 0; ; i++ {
+			if _, err := conn.Write([]byte{"GET / HTTP/1.1\r\nX-Slow: "[i%10]}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", readResponse(t, br).status)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestReadTimeout(t *testing.T) {
+	addr := startServer(t, okHandler, Config{ReadHeaderTimeout: time.Second, ReadTimeout: 150 * time.Millisecond})
+
+	// Test: Headers arrive in time but the body does not
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", readResponse(t, br).status)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := startServer(t, okHandler, Config{IdleTimeout: 100 * time.Millisecond})
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK", readResponse(t, br).status)
+	// the connection is closed once it has been idle for too long
+	assertClosed(t, conn, br)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	slow := func(w response.ResponseWriter, req *request.Request) {
+		time.Sleep(200 * time.Millisecond)
+		okHandler(w, req)
+	}
+	addr := startServer(t, slow, Config{WriteTimeout: 50 * time.Millisecond})
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	// the response misses its deadline, so the client sees the connection end
+	assertClosed(t, conn, br)
+}
+
+func TestParseError(t *testing.T) {
+	var logs lockedBuffer
+	addr := startServer(t, okHandler, Config{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	// Test: A request that cannot be parsed gets a fixed detail, and what
+	// went wrong, quoting the client's input, is only logged
+	conn := dial(t, addr)
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n<script>\r\n")
+	require.NoError(t, err)
+	res := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", res.status)
+	assert.Contains(t, res.body, "The request could not be parsed.")
+	assert.NotContains(t, res.body, "script")
+	assert.Contains(t, logs.String(), "script")
+
+	// Test: So does one with a line too long
+	conn = dial(t, addr)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nX-Long: "+strings.Repeat("a", 2*readBufferSize)+"\r\n\r\n")
+	require.NoError(t, err)
+	res = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 431 Request Header Fields Too Large", res.status)
+	assert.Contains(t, res.body, "The request line or header section is too large.")
+
+	// Test: And one with too many header fields
+	conn = dial(t, addr)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\n"+strings.Repeat("X-A: b\r\n", 1000)+"\r\n")
+	require.NoError(t, err)
+	res = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 431 Request Header Fields Too Large", res.status)
+}
+
+func TestRequestFraming(t *testing.T) {
+	addr := startServer(t, okHandler, Config{MaxBodySize: 5})
+
+	// Test: A request framed by both Transfer-Encoding and Content-Length
+	// is answered, but nothing after it is trusted
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "POST /both HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"0\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	res := readResponse(t, br)
+	assert.Equal(t, "/both", res.body)
+	assert.Equal(t, "close", res.headers["connection"])
+	assertClosed(t, conn, br)
+
+	// Test: One whose Transfer-Encoding does not end in chunked gets a 400
+	conn = dial(t, addr)
+	br = bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "POST /gzip HTTP/1.1\r\nContent-Length: 0\r\nTransfer-Encoding: gzip\r\n\r\n"+
+		"GET /smuggled HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", readResponse(t, br).status)
+	assertClosed(t, conn, br)
+
+	// Test: A body over MaxBodySize gets a 413
+	conn = dial(t, addr)
+	br = bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "POST /big HTTP/1.1\r\nContent-Length: 6\r\n\r\n123456")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large", readResponse(t, br).status)
+	assertClosed(t, conn, br)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := func(w response.ResponseWriter, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		okHandler(w, req)
+	}
+	s, err := ServeConfig(0, blocking, Config{})
+	require.NoError(t, err)
+	addr := s.Addrs()[0].String()
+
+	// an idle keep-alive connection
+	idle := dial(t, addr)
+	idleReader := bufio.NewReader(idle)
+	_, err = io.WriteString(idle, "GET /fast HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/fast", readResponse(t, idleReader).body)
+
+	// a connection with a request in flight
+	active := dial(t, addr)
+	activeReader := bufio.NewReader(active)
+	_, err = io.WriteString(active, "GET /slow HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	// Test: Idle connections are closed straight away
+	assertClosed(t, idle, idleReader)
+
+	// Test: New connections are refused
+	_, err = net.Dial("tcp", addr)
+	require.Error(t, err)
+
+	// Test: Shutdown waits for the active handler
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the handler finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	res := readResponse(t, activeReader)
+	assert.Equal(t, "/slow", res.body)
+	// Test: The in-flight response tells the client the connection is ending
+	assert.Equal(t, "close", res.headers["connection"])
+	assertClosed(t, active, activeReader)
+	require.NoError(t, <-shutdownErr)
+}
+
+// arrivingConn holds up the read that brings in the first request until
+// the server next sets a read deadline or closes the connection, as
+// Shutdown's sweep does. That is the moment a request has arrived while the
+// connection still counts as idle.
+type arrivingConn struct {
+	net.Conn
+	arrived chan struct{}
+	swept   chan struct{}
+	once    sync.Once
+	read    bool
+}
+
+func (c *arrivingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.read {
+		c.read = true
+		close(c.arrived)
+		<-c.swept
+	}
+	return n, err
+}
+
+func (c *arrivingConn) SetReadDeadline(t time.Time) error {
+	if c.read {
+		c.once.Do(func() { close(c.swept) })
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *arrivingConn) Close() error {
+	c.once.Do(func() { close(c.swept) })
+	return c.Conn.Close()
+}
+
+func TestShutdownRequestArriving(t *testing.T) {
+	s := New(okHandler, Config{})
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &arrivingConn{Conn: server, arrived: make(chan struct{}), swept: make(chan struct{})}
+	go func() { _ = s.ServeConn(conn) }()
+
+	br := bufio.NewReader(client)
+	_, err := io.WriteString(client, "GET /late HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	<-conn.arrived
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	// Test: A request that came in just as Shutdown swept the idle
+	// connections is answered, and the connection then closed
+	res := readResponse(t, br)
+	assert.Equal(t, "/late", res.body)
+	assert.Equal(t, "close", res.headers["connection"])
+	assertClosed(t, client, br)
+	require.NoError(t, <-shutdownErr)
+}
+
+func TestShutdownContextExpires(t *testing.T) {
+	stuck := func(w response.ResponseWriter, req *request.Request) {
+		<-req.Context().Done()
+	}
+	s, err := ServeConfig(0, stuck, Config{})
+	require.NoError(t, err)
+	conn := dial(t, s.Addrs()[0].String())
+	br := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	// Test: Remaining connections are force-closed
+	assertClosed(t, conn, br)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var reported []string
+	var mu sync.Mutex
+	panicky := func(w response.ResponseWriter, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/early":
+			panic("boom before writing")
+		case "/late":
+			_ = w.WriteStatusLine(response.StatusOK)
+			panic("boom after writing")
+		}
+		okHandler(w, req)
+	}
+	addr := startServer(t, panicky, Config{
+		OnPanic: func(req *request.Request, recovered any, stack []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, fmt.Sprintf("%s %v", req.RequestLine.RequestTarget, recovered))
+			assert.Contains(t, string(stack), "TestHandlerPanic")
+		},
+	})
+
+	// Test: A panic before the status line is answered with 500
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "GET /early HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	res := readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", res.status)
+	assertClosed(t, conn, br)
+
+	// Test: A panic after the status line aborts the connection
+	conn = dial(t, addr)
+	br = bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "GET /late HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	all, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", string(all))
+
+	// Test: The server keeps serving other clients
+	conn = dial(t, addr)
+	br = bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "GET /fine HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/fine", readResponse(t, br).body)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/early boom before writing", "/late boom after writing"}, reported)
+}
+
+func TestOnResponse(t *testing.T) {
+	var mu sync.Mutex
+	var answered []string
+	release := make(chan struct{})
+	handler := func(w response.ResponseWriter, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		blockingHandler(release)(w, req)
+	}
+	addr := startServer(t, handler, Config{
+		MaxRequests: 1,
+		Overload:    OverloadReject,
+		OnResponse: func(w response.ResponseWriter, req *request.Request, start time.Time) {
+			st, _ := response.StatsOf(w)
+			mu.Lock()
+			defer mu.Unlock()
+			answered = append(answered, fmt.Sprintf("%s %d", req.RequestLine.RequestTarget, st.StatusCode))
+			assert.NotEmpty(t, req.RemoteAddr)
+			assert.False(t, start.IsZero())
+		},
+	})
+
+	conn := dial(t, addr)
+	send(t, conn, "/panic")
+	readResponse(t, bufio.NewReader(conn))
+	conn = dial(t, addr)
+	_, err := io.WriteString(conn, "NOT HTTP\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, bufio.NewReader(conn))
+	first := dial(t, addr)
+	send(t, first, "/block")
+	// the first request must be in the handler before the second arrives
+	time.Sleep(100 * time.Millisecond)
+	conn = dial(t, addr)
+	send(t, conn, "/second")
+	readResponse(t, bufio.NewReader(conn))
+	close(release)
+	readResponse(t, bufio.NewReader(first))
+
+	// Test: The hook sees every answer, the server's own included: a
+	// panic's 500, a request that could not be parsed, and one past
+	// MaxRequests
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/panic 500", " 400", "/second 503", "/block 200"}, answered)
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	var mu sync.Mutex
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w response.ResponseWriter, req *request.Request) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				next(w, req)
+			}
+		}
+	}
+	// rewrite answers for the handler when the target is /blocked
+	rewrite := func(next Handler) Handler {
+		return func(w response.ResponseWriter, req *request.Request) {
+			if req.RequestLine.RequestTarget == "/blocked" {
+				req.RequestLine.RequestTarget = "/rewritten"
+			}
+			next(w, req)
+		}
+	}
+	addr := startServer(t, okHandler, Config{
+		Middleware: []Middleware{trace("outer"), Chain(trace("inner"), rewrite)},
+	})
+	conn := dial(t, addr)
+	br := bufio.NewReader(conn)
+
+	// Test: Global middleware runs around the handler, first entry outermost
+	_, err := io.WriteString(conn, "GET /blocked HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/rewritten", readResponse(t, br).body)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"outer", "inner"}, order)
+}
+
+// lockedBuffer is a bytes.Buffer safe for the server's goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	var out lockedBuffer
+	logged := func(w response.ResponseWriter, req *request.Request) {
+		logging.FromContext(req.Context()).Info("handling")
+		okHandler(w, req)
+	}
+	addr := startServer(t, logged, Config{Logger: slog.New(slog.NewTextHandler(&out, nil))})
+	conn := dial(t, addr)
+	_, err := io.WriteString(conn, "GET /logged HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/logged", readResponse(t, bufio.NewReader(conn)).body)
+
+	// Test: Handlers log through Config.Logger, with the request and the
+	// client
+	assert.Contains(t, out.String(), fmt.Sprintf("msg=handling remote=%s method=GET target=/logged\n", conn.LocalAddr()))
+
+	// Test: So does the server, for requests it cannot parse
+	conn = dial(t, addr)
+	_, err = io.WriteString(conn, "NOT HTTP\r\n\r\n")
+	require.NoError(t, err)
+	_, _ = io.ReadAll(conn)
+	assert.Contains(t, out.String(), fmt.Sprintf(`msg="parsing request" remote=%s`, conn.LocalAddr()))
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// SocketOptions tunes the sockets a Listener opens. The zero value keeps the
+// defaults of Go and the operating system. ReusePort, Backlog and
+// DeferAccept need Linux.
+type SocketOptions struct {
+	// ReusePort, if positive, opens the sockets with SO_REUSEPORT, and this
+	// many of them on the same address, each with its own accept loop. The
+	// kernel spreads new connections across them, and so across cores. Other
+	// processes, such as copies of the server started alongside it, may
+	// listen on the address too and take their share.
+	ReusePort int
+	// Backlog is how many connections the kernel queues until they are
+	// accepted. Zero uses the system maximum, net.core.somaxconn.
+	Backlog int
+	// DeferAccept has the kernel hold new TCP connections until the client
+	// sends its request, for up to this long, so accept loops do not wake for
+	// connections that stay silent (TCP_DEFER_ACCEPT). It is rounded up to
+	// whole seconds.
+	DeferAccept time.Duration
+	// Delay turns TCP_NODELAY off on accepted connections, letting Nagle's
+	// algorithm coalesce small writes at the cost of latency. Go turns it on.
+	Delay bool
+	// KeepAlive and KeepAliveConfig set the TCP keep-alive probes of
+	// accepted connections, as in net.ListenConfig: by default a probe after
+	// 15 seconds idle, and none if KeepAlive is negative.
+	KeepAlive       time.Duration
+	KeepAliveConfig net.KeepAliveConfig
+}
+
+func (o SocketOptions) listenConfig() net.ListenConfig {
+	return net.ListenConfig{
+		KeepAlive:       o.KeepAlive,
+		KeepAliveConfig: o.KeepAliveConfig,
+		Control:         o.control,
+	}
+}
+
+// tune sets the options that apply to an accepted connection.
+func (o SocketOptions) tune(conn net.Conn) error {
+	if tc, ok := conn.(*net.TCPConn); ok && o.Delay {
+		return tc.SetNoDelay(false)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// soReusePort is SO_REUSEPORT, which package syscall lacks on most
+// architectures. MIPS, which numbers it differently, goes without.
+const soReusePort = 0xf
+
+// control sets the options that have to be on the socket before it is bound.
+func (o SocketOptions) control(network, address string, c syscall.RawConn) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if o.ReusePort > 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+				err = &net.OpError{Op: "listen", Net: network, Err: err}
+				return
+			}
+		}
+		if o.DeferAccept > 0 {
+			secs := int((o.DeferAccept + time.Second - 1) / time.Second)
+			if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, secs); err != nil {
+				err = &net.OpError{Op: "listen", Net: network, Err: err}
+			}
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+// setBacklog resizes the accept queue of l, which Go sizes to the system
+// maximum, by calling listen(2) again.
+func (o SocketOptions) setBacklog(l net.Listener) error {
+	if o.Backlog <= 0 {
+		return nil
+	}
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ctrlErr := rc.Control(func(fd uintptr) {
+		err = syscall.Listen(int(fd), o.Backlog)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	if err != nil {
+		return &net.OpError{Op: "listen", Net: l.Addr().Network(), Addr: l.Addr(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// sockopt reads an integer socket option of c.
+func sockopt(t *testing.T, c any, level, opt int) int {
+	t.Helper()
+	rc, err := c.(syscall.Conn).SyscallConn()
+	require.NoError(t, err)
+	var v int
+	var serr error
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, serr)
+	return v
+}
+
+// namedHandler answers every request with name.
+func namedHandler(name string) Handler {
+	return func(w response.ResponseWriter, _ *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+		_, _ = w.WriteBody([]byte(name))
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	s := New(namedHandler("first"), DefaultConfig)
+	t.Cleanup(func() { _ = s.Close() })
+
+	// Test: ReusePort opens that many sockets on the one port
+	addr, err := s.Serve(Listener{Address: "127.0.0.1:0", Socket: SocketOptions{ReusePort: 4}})
+	require.NoError(t, err)
+	assert.Equal(t, []net.Addr{addr, addr, addr, addr}, s.Addrs())
+	for _, l := range s.listeners {
+		assert.Equal(t, 1, sockopt(t, l, syscall.SOL_SOCKET, soReusePort))
+	}
+
+	// Test: Another process, here another server, can join in with
+	// ReusePort, but not without
+	_, err = New(okHandler, DefaultConfig).Serve(Listener{Address: addr.String()})
+	assert.ErrorIs(t, err, syscall.EADDRINUSE)
+	other := New(namedHandler("second"), DefaultConfig)
+	t.Cleanup(func() { _ = other.Close() })
+	_, err = other.Serve(Listener{Address: addr.String(), Socket: SocketOptions{ReusePort: 1}})
+	require.NoError(t, err)
+
+	// Test: The kernel spreads connections across both servers
+	served := map[string]int{}
+	for range 100 {
+		conn := dial(t, addr.String())
+		_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		require.NoError(t, err)
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		_, body, _ := strings.Cut(string(b), "\r\n\r\n")
+		served[body]++
+		_ = conn.Close()
+	}
+	assert.Equal(t, 100, served["first"]+served["second"])
+	assert.NotZero(t, served["first"])
+	assert.NotZero(t, served["second"])
+}
+
+// acceptedConn serves one request on a listener with socket and returns the
+// server's end of the connection, with the listening socket.
+func acceptedConn(t *testing.T, socket SocketOptions) (net.Conn, net.Listener) {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	var s *Server
+	s = New(func(w response.ResponseWriter, req *request.Request) {
+		s.mu.Lock()
+		for c := range s.conns {
+			accepted <- c.Conn
+		}
+		s.mu.Unlock()
+		okHandler(w, req)
+	}, DefaultConfig)
+	t.Cleanup(func() { _ = s.Close() })
+	addr, err := s.Serve(Listener{Address: "127.0.0.1:0", Socket: socket})
+	require.NoError(t, err)
+
+	conn := dial(t, addr.String())
+	assert.Equal(t, "/", getOver(t, conn, "/").body)
+	return <-accepted, s.listeners[0]
+}
+
+func TestSocketOptions(t *testing.T) {
+	c, l := acceptedConn(t, SocketOptions{
+		Backlog:     16,
+		DeferAccept: 4500 * time.Millisecond,
+		Delay:       true,
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     42 * time.Second,
+			Interval: 7 * time.Second,
+			Count:    3,
+		},
+	})
+
+	// Test: TCP_DEFER_ACCEPT is set on the listening socket, in whole
+	// seconds, which the kernel rounds up to its retransmission schedule
+	assert.GreaterOrEqual(t, sockopt(t, l, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT), 5)
+
+	// Test: The accepted connection has Nagle's algorithm and the keep-alive
+	// probes asked for
+	assert.Equal(t, 0, sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	assert.Equal(t, 1, sockopt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 42, sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+	assert.Equal(t, 7, sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+	assert.Equal(t, 3, sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT))
+
+	// Test: Without options, Go's defaults apply
+	c, l = acceptedConn(t, SocketOptions{})
+	assert.Equal(t, 0, sockopt(t, l, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT))
+	assert.Equal(t, 1, sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	assert.Equal(t, 15, sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+}
+
+// BenchmarkAccept measures how many new connections per second the server
+// takes, each carrying one request, with one accept loop and with several
+// through SO_REUSEPORT.
+func BenchmarkAccept(b *testing.B) {
+	for _, sockets := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("reuseport=%d", sockets), func(b *testing.B) {
+			s := New(okHandler, DefaultConfig)
+			defer func() { _ = s.Close() }()
+			addr, err := s.Serve(Listener{Address: "127.0.0.1:0", Socket: SocketOptions{ReusePort: sockets}})
+			require.NoError(b, err)
+			req := []byte("GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr.String())
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := conn.Write(req); err != nil {
+						b.Error(err)
+					}
+					if _, err := io.Copy(io.Discard, conn); err != nil {
+						b.Error(err)
+					}
+					_ = conn.Close()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errSocketOptions = errors.New("server: ReusePort, Backlog and DeferAccept are not supported on this platform")
+
+func (o SocketOptions) control(network, address string, c syscall.RawConn) error {
+	if o.ReusePort > 0 || o.DeferAccept > 0 {
+		return errSocketOptions
+	}
+	return nil
+}
+
+func (o SocketOptions) setBacklog(l net.Listener) error {
+	if o.Backlog > 0 {
+		return errSocketOptions
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TLSConfig configures TLS termination for ServeTLS.
+type TLSConfig struct {
+	// Certificates are the certificate and key files to serve. A client
+	// gets the first one valid for the server name it asks for (SNI), or the
+	// first one overall if none matches or it asks for none.
+	Certificates []CertificateFiles
+	// MinVersion is the oldest TLS version accepted, TLS 1.2 if zero.
+	MinVersion uint16
+	// CipherSuites restricts the TLS 1.2 cipher suites, nil meaning the
+	// crypto/tls defaults. TLS 1.3 suites are not configurable. Suites that
+	// crypto/tls lists as insecure are refused.
+	CipherSuites []uint16
+	// ReloadInterval is how often the certificate files are checked for
+	// changes, reloading them when they do. Zero disables watching;
+	// ReloadCertificates still reloads on demand, e.g. on SIGHUP.
+	ReloadInterval time.Duration
+
+	// ClientAuth is whether clients are asked for a certificate, and
+	// whether one is required.
+	ClientAuth ClientAuthMode
+	// ClientCAFile is a PEM bundle of the CAs client certificates are
+	// verified against. It is required unless ClientAuth is ClientAuthNone.
+	ClientCAFile string
+}
+
+// ClientAuthMode is the policy for TLS client certificates.
+type ClientAuthMode int
+
+const (
+	// ClientAuthNone does not ask clients for a certificate.
+	ClientAuthNone ClientAuthMode = iota
+	// ClientAuthRequest asks for a certificate but lets clients without one
+	// connect. A certificate that is sent must verify.
+	ClientAuthRequest
+	// ClientAuthRequireAndVerify refuses clients without a valid
+	// certificate.
+	ClientAuthRequireAndVerify
+)
+
+// CertificateFiles names a PEM certificate chain and its private key.
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ServeTLS is like ServeConfig but terminates TLS on every connection.
+func ServeTLS(port int, handler Handler, config Config, tlsConfig TLSConfig) (*Server, error) {
+	s, err := NewTLS(handler, config, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Serve(Listener{Address: fmt.Sprintf(":%d", port)}); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewTLS is like New but terminates TLS on the connections of every
+// listener.
+func NewTLS(handler Handler, config Config, tlsConfig TLSConfig) (*Server, error) {
+	certs, tc, err := tlsConfig.build()
+	if err != nil {
+		return nil, err
+	}
+	s := New(handler, config)
+	s.certs, s.tlsConfig = certs, tc
+	if tlsConfig.ReloadInterval > 0 {
+		go s.watchCertificates(tlsConfig.ReloadInterval)
+	}
+	return s, nil
+}
+
+// ReloadCertificates reads the certificate files again. New connections use
+// the new certificates; established ones are not affected. If any file fails
+// to load, the previous certificates stay in use.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return errors.New("server: not serving TLS")
+	}
+	return s.certs.load()
+}
+
+func (s *Server) watchCertificates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.isClosed.Load() {
+			return
+		}
+		changed, err := s.certs.changed()
+		if err != nil {
+			s.log.Error("checking certificates", "err", err)
+		}
+		if !changed {
+			continue
+		}
+		if err := s.certs.load(); err != nil {
+			// the files may be half written; try again on the next tick
+			s.log.Error("reloading certificates", "err", err)
+			continue
+		}
+		s.log.Info("reloaded TLS certificates")
+	}
+}
+
+func (c TLSConfig) build() (*certStore, *tls.Config, error) {
+	if len(c.Certificates) == 0 {
+		return nil, nil, errors.New("server: TLS needs at least one certificate")
+	}
+	for _, id := range c.CipherSuites {
+		for _, insecure := range tls.InsecureCipherSuites() {
+			if insecure.ID == id {
+				return nil, nil, fmt.Errorf("server: insecure cipher suite %s", insecure.Name)
+			}
+		}
+	}
+	clientAuth := tls.NoClientCert
+	var clientCAs *x509.CertPool
+	switch c.ClientAuth {
+	case ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequireAndVerify:
+		clientAuth = tls.VerifyClientCertIfGiven
+		if c.ClientAuth == ClientAuthRequireAndVerify {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("server: reading client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("server: no certificates in %s", c.ClientCAFile)
+		}
+	default:
+		return nil, nil, fmt.Errorf("server: unknown client auth mode %d", c.ClientAuth)
+	}
+	minVersion := c.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	certs := &certStore{files: c.Certificates}
+	if err := certs.load(); err != nil {
+		return nil, nil, err
+	}
+	return certs, &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   c.CipherSuites,
+		GetCertificate: certs.getCertificate,
+		ClientAuth:     clientAuth,
+		ClientCAs:      clientCAs,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// certStore holds the loaded certificates, swapped atomically on reload so
+// handshakes never wait for one.
+type certStore struct {
+	files []CertificateFiles
+
+	mu     sync.Mutex // serializes loads
+	loaded atomic.Pointer[certSet]
+}
+
+type certSet struct {
+	certs []*tls.Certificate
+	// stamps record the files as they were when loaded, two per
+	// certificate, to tell when they change
+	stamps []fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (cs *certStore) load() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	set := &certSet{}
+	for _, f := range cs.files {
+		// stat before reading, so a write that lands mid-load shows up as a
+		// change on the next check
+		stamps, err := statFiles(f.CertFile, f.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", f.CertFile, err)
+		}
+		set.certs = append(set.certs, &cert)
+		set.stamps = append(set.stamps, stamps...)
+	}
+	cs.loaded.Store(set)
+	return nil
+}
+
+// changed reports whether any file differs from when it was last loaded.
+func (cs *certStore) changed() (bool, error) {
+	var names []string
+	for _, f := range cs.files {
+		names = append(names, f.CertFile, f.KeyFile)
+	}
+	stamps, err := statFiles(names...)
+	if err != nil {
+		return false, err
+	}
+	return !slices.Equal(stamps, cs.loaded.Load().stamps), nil
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := cs.loaded.Load().certs
+	if hello.ServerName != "" {
+		for _, c := range certs {
+			if c.Leaf.VerifyHostname(hello.ServerName) == nil && hello.SupportsCertificate(c) == nil {
+				return c, nil
+			}
+		}
+	}
+	return certs[0], nil
+}
+
+func statFiles(names ...string) ([]fileStamp, error) {
+	stamps := make([]fileStamp, 0, len(names))
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{modTime: info.ModTime(), size: info.Size()})
+	}
+	return stamps, nil
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// writeCert generates a self-signed certificate for hosts and writes it and
+// its key to dir as name.crt and name.key.
+func writeCert(t *testing.T, dir, name string, hosts ...string) (CertificateFiles, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertificateFiles{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return files, cert
+}
+
+func startTLSServer(t *testing.T, handler Handler, tlsConfig TLSConfig) (*Server, string) {
+	t.Helper()
+	s, err := NewTLS(handler, Config{}, tlsConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	addr, err := s.Serve(Listener{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	return s, addr.String()
+}
+
+// dialTLS connects trusting only roots and returns the connection and the
+// certificate the server presented.
+func dialTLS(t *testing.T, addr, serverName string, roots ...*x509.Certificate) (*tls.Conn, *x509.Certificate) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert(c)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, RootCAs: pool, NextProtos: []string{"http/1.1"}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	return conn, conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	filesA, certA := writeCert(t, dir, "a", "a.test")
+	filesB, certB := writeCert(t, dir, "b", "b.test", "*.b.test")
+	_, addr := startTLSServer(t, okHandler, TLSConfig{Certificates: []CertificateFiles{filesA, filesB}})
+
+	// Test: Requests are served over TLS
+	conn, peer := dialTLS(t, addr, "a.test", certA)
+	assert.True(t, peer.Equal(certA))
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	br := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "GET /secure HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/secure", readResponse(t, br).body)
+
+	// Test: The certificate is picked by SNI, wildcards included
+	_, peer = dialTLS(t, addr, "b.test", certB)
+	assert.True(t, peer.Equal(certB))
+	_, peer = dialTLS(t, addr, "www.b.test", certB)
+	assert.True(t, peer.Equal(certB))
+
+	// Test: Unknown names get the first certificate
+	raw, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer raw.Close()
+	assert.True(t, raw.ConnectionState().PeerCertificates[0].Equal(certA))
+}
+
+func TestServeTLSPolicy(t *testing.T) {
+	dir := t.TempDir()
+	files, _ := writeCert(t, dir, "a", "a.test")
+	_, addr := startTLSServer(t, okHandler, TLSConfig{
+		Certificates: []CertificateFiles{files},
+		MinVersion:   tls.VersionTLS13,
+	})
+
+	// Test: Clients below MinVersion fail the handshake
+	_, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	require.Error(t, err)
+
+	// Test: Insecure cipher suites are refused
+	_, err = ServeTLS(0, okHandler, Config{}, TLSConfig{
+		Certificates: []CertificateFiles{files},
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA},
+	})
+	require.Error(t, err)
+
+	// Test: Missing files are reported up front
+	_, err = ServeTLS(0, okHandler, Config{}, TLSConfig{
+		Certificates: []CertificateFiles{{CertFile: filepath.Join(dir, "nope.crt"), KeyFile: files.KeyFile}},
+	})
+	require.Error(t, err)
+}
+
+func TestReloadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	files, oldCert := writeCert(t, dir, "a", "a.test")
+	s, addr := startTLSServer(t, okHandler, TLSConfig{Certificates: []CertificateFiles{files}})
+
+	old, _ := dialTLS(t, addr, "a.test", oldCert)
+	oldReader := bufio.NewReader(old)
+	_, err := io.WriteString(old, "GET /before HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/before", readResponse(t, oldReader).body)
+
+	// Test: A broken file keeps the current certificate
+	require.NoError(t, os.WriteFile(files.KeyFile, []byte("garbage"), 0o600))
+	require.Error(t, s.ReloadCertificates())
+	_, peer := dialTLS(t, addr, "a.test", oldCert)
+	assert.True(t, peer.Equal(oldCert))
+
+	// Test: New connections get the reloaded certificate
+	_, newCert := writeCert(t, dir, "a", "a.test")
+	require.NoError(t, s.ReloadCertificates())
+	_, peer = dialTLS(t, addr, "a.test", newCert)
+	assert.True(t, peer.Equal(newCert))
+
+	// Test: Established connections keep working
+	_, err = io.WriteString(old, "GET /after HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/after", readResponse(t, oldReader).body)
+}
+
+func TestWatchCertificates(t *testing.T) {
+	dir := t.TempDir()
+	files, oldCert := writeCert(t, dir, "a", "a.test")
+	_, addr := startTLSServer(t, okHandler, TLSConfig{
+		Certificates:   []CertificateFiles{files},
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	_, peer := dialTLS(t, addr, "a.test", oldCert)
+	require.True(t, peer.Equal(oldCert))
+
+	// Test: Changed files are picked up without being asked
+	_, newCert := writeCert(t, dir, "a", "a.test")
+	assert.Eventually(t, func() bool {
+		_, peer := dialTLS(t, addr, "a.test", oldCert, newCert)
+		return peer.Equal(newCert)
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	serverFiles, serverCert := writeCert(t, dir, "server", "a.test")
+	clientFiles, _ := writeCert(t, dir, "client", "billing.internal")
+	strangerFiles, _ := writeCert(t, dir, "stranger", "stranger.internal")
+	clientPair, err := tls.LoadX509KeyPair(clientFiles.CertFile, clientFiles.KeyFile)
+	require.NoError(t, err)
+	strangerPair, err := tls.LoadX509KeyPair(strangerFiles.CertFile, strangerFiles.KeyFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+
+	// whoami answers with the verified client's SANs
+	whoami := func(w response.ResponseWriter, req *request.Request) {
+		body := []byte("anonymous")
+		if chain := req.PeerCertificates(); chain != nil {
+			body = []byte(strings.Join(req.PeerSANs().DNSNames, ","))
+		}
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody(body)
+	}
+	get := func(addr string, certs ...tls.Certificate) (string, error) {
+		config := &tls.Config{ServerName: "a.test", RootCAs: roots}
+		if len(certs) > 0 {
+			// send it even when it is not from a CA the server accepts
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &certs[0], nil
+			}
+		}
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n"); err != nil {
+			return "", err
+		}
+		// with TLS 1.3 a refused certificate only shows up on the first read
+		br := bufio.NewReader(conn)
+		if _, err := br.Peek(1); err != nil {
+			return "", err
+		}
+		return readResponse(t, br).body, nil
+	}
+
+	// Test: Required client certificates are verified against the CA bundle
+	_, addr := startTLSServer(t, whoami, TLSConfig{
+		Certificates: []CertificateFiles{serverFiles},
+		ClientAuth:   ClientAuthRequireAndVerify,
+		ClientCAFile: clientFiles.CertFile,
+	})
+	body, err := get(addr, clientPair)
+	require.NoError(t, err)
+	assert.Equal(t, "billing.internal", body)
+	_, err = get(addr)
+	assert.Error(t, err)
+	_, err = get(addr, strangerPair)
+	assert.Error(t, err)
+
+	// Test: Requested certificates are optional but still verified
+	_, addr = startTLSServer(t, whoami, TLSConfig{
+		Certificates: []CertificateFiles{serverFiles},
+		ClientAuth:   ClientAuthRequest,
+		ClientCAFile: clientFiles.CertFile,
+	})
+	body, err = get(addr, clientPair)
+	require.NoError(t, err)
+	assert.Equal(t, "billing.internal", body)
+	body, err = get(addr)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+	_, err = get(addr, strangerPair)
+	assert.Error(t, err)
+
+	// Test: Without client auth no certificate is seen
+	_, addr = startTLSServer(t, whoami, TLSConfig{Certificates: []CertificateFiles{serverFiles}})
+	body, err = get(addr, clientPair)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+
+	// Test: A CA bundle is needed to verify against
+	_, err = ServeTLS(0, whoami, Config{}, TLSConfig{
+		Certificates: []CertificateFiles{serverFiles},
+		ClientAuth:   ClientAuthRequireAndVerify,
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,199 @@
+// Package sse implements Server-Sent Events on top of a chunked response.
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// DefaultHeartbeat is how often a comment is sent on an otherwise quiet
+// stream, keeping proxies from timing it out and detecting dead clients.
+const DefaultHeartbeat = 15 * time.Second
+
+var ErrStreamClosed = errors.New("sse: stream closed")
+
+// Event is a single message on the stream. ID, Event and Retry are sent
+// only when set, but a data field always is, even for empty Data: browsers
+// do not dispatch an event without one.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// Stream writes events to one client. Send, Comment and Close are safe to
+// call from multiple goroutines.
+type Stream struct {
+	w           response.ResponseWriter
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewStream writes the event-stream status line and headers to w and starts
+// sending a heartbeat comment every heartbeat interval (none if zero). The
+// handler must call Close before it returns.
+func NewStream(w response.ResponseWriter, req *request.Request, heartbeat time.Duration) (*Stream, error) {
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Override("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	if err := response.Flush(w); err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := req.Headers.Get("Last-Event-ID")
+	ctx, cancel := context.WithCancel(req.Context())
+	s := &Stream{
+		w:           w,
+		lastEventID: lastEventID,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	if heartbeat > 0 {
+		go s.heartbeat(heartbeat)
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID the client sent when reconnecting,
+// or "" on a fresh connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client disconnects, a write fails, or the stream
+// is closed.
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Send writes ev and flushes it to the client immediately.
+func (s *Stream) Send(ev Event) error {
+	b, err := encodeEvent(ev)
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var sb strings.Builder
+	for _, line := range splitLines(text) {
+		fmt.Fprintf(&sb, ":%s\n", line)
+	}
+	sb.WriteString("\n")
+	return s.write([]byte(sb.String()))
+}
+
+// Close stops the heartbeat and terminates the chunked body.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	s.mu.Unlock()
+	<-s.done
+
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	if err := s.w.WriteTrailers(nil); err != nil {
+		return err
+	}
+	return response.Flush(s.w)
+}
+
+func (s *Stream) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.ctx.Err() != nil {
+		return ErrStreamClosed
+	}
+	if _, err := s.w.WriteChunkedBody(b); err != nil {
+		s.cancel()
+		return err
+	}
+	if err := response.Flush(s.w); err != nil {
+		s.cancel()
+		return err
+	}
+	return nil
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Comment(" heartbeat"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func encodeEvent(ev Event) ([]byte, error) {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return nil, errors.New("sse: event id must not contain newlines or NUL")
+	}
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return nil, errors.New("sse: event name must not contain newlines")
+	}
+
+	var sb strings.Builder
+	if ev.Event != "" {
+		fmt.Fprintf(&sb, "event: %s\n", ev.Event)
+	}
+	if ev.ID != "" {
+		fmt.Fprintf(&sb, "id: %s\n", ev.ID)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&sb, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	// Each line of the payload needs its own data field; the client joins
+	// them back together with "\n".
+	for _, line := range splitLines(ev.Data) {
+		fmt.Fprintf(&sb, "data: %s\n", line)
+	}
+	sb.WriteString("\n")
+	return []byte(sb.String()), nil
+}
+
+// splitLines splits on any of the line endings the event stream format
+// accepts: CRLF, LF or CR.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
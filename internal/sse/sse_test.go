@@ -0,0 +1,121 @@
+package sse
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// lockedBuffer lets the heartbeat goroutine and the test share a buffer.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// hangupWriter behaves like a connection whose client went away once
+// hungUp is set.
+type hangupWriter struct {
+	hungUp bool
+}
+
+func (w *hangupWriter) Write(p []byte) (int, error) {
+	if w.hungUp {
+		return 0, errors.New("broken pipe")
+	}
+	return len(p), nil
+}
+
+func newRequest(h map[string]string) *request.Request {
+	hs := headers.NewHeaders()
+	for k, v := range h {
+		hs.Set(k, v)
+	}
+	return &request.Request{Headers: hs}
+}
+
+func TestEncodeEvent(t *testing.T) {
+	b, err := encodeEvent(Event{ID: "42", Event: "log", Data: "line one\nline two\r\nline three\rend", Retry: 3 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "event: log\nid: 42\nretry: 3000\ndata: line one\ndata: line two\ndata: line three\ndata: end\n\n", string(b))
+
+	b, err = encodeEvent(Event{Data: "plain"})
+	require.NoError(t, err)
+	assert.Equal(t, "data: plain\n\n", string(b))
+
+	// an event without data still needs a data field to be dispatched
+	b, err = encodeEvent(Event{Event: "ping"})
+	require.NoError(t, err)
+	assert.Equal(t, "event: ping\ndata: \n\n", string(b))
+
+	_, err = encodeEvent(Event{ID: "bad\nid"})
+	require.Error(t, err)
+	_, err = encodeEvent(Event{Event: "bad\rname"})
+	require.Error(t, err)
+}
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := NewStream(response.NewWriter(&buf), newRequest(map[string]string{"Last-Event-ID": "7"}), 0)
+	require.NoError(t, err)
+	assert.Equal(t, "7", s.LastEventID())
+
+	require.NoError(t, s.Send(Event{ID: "8", Data: "hello"}))
+	// Events are flushed as soon as they are sent.
+	assert.True(t, strings.HasSuffix(buf.String(), "13\r\nid: 8\ndata: hello\n\n\r\n"))
+
+	require.NoError(t, s.Close())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: text/event-stream\r\n")
+	assert.Contains(t, out, "cache-control: no-cache\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "0\r\n\r\n"))
+
+	require.ErrorIs(t, s.Send(Event{Data: "late"}), ErrStreamClosed)
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	var buf lockedBuffer
+	s, err := NewStream(response.NewWriter(&buf), newRequest(nil), 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), ": heartbeat\n\n")
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, s.Close())
+}
+
+func TestStreamStopsOnWriteError(t *testing.T) {
+	conn := &hangupWriter{}
+	s, err := NewStream(response.NewWriter(conn), newRequest(nil), 0)
+	require.NoError(t, err)
+
+	conn.hungUp = true
+	require.Error(t, s.Send(Event{Data: "x"}))
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("stream should be done after a failed write")
+	}
+}
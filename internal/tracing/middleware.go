@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"fmt"
+	"net"
+
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/server"
+)
+
+// Middleware returns middleware that records a server span with tracer for
+// every request. The span continues the trace of a valid traceparent
+// header, or starts a new one, and is named after the method and route.
+// Handlers find it through SpanFromContext, and their logger gains the
+// trace and span IDs.
+func Middleware(tracer *Tracer) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w response.ResponseWriter, req *request.Request) {
+			parent, _ := Extract(req.Headers)
+			method := req.RequestLine.Method
+			ctx, span := tracer.Start(req.Context(), method, SpanKindServer, parent)
+			sc := span.Context()
+			logger := logging.FromContext(ctx).With("trace_id", sc.TraceID.String(), "span_id", sc.SpanID.String())
+			req = req.WithContext(logging.NewContext(ctx, logger))
+			defer func() {
+				finishServerSpan(span, w, req)
+				// the server answers a panic with a 500 only once this has
+				// run, so record it here and let it carry on up
+				if v := recover(); v != nil {
+					span.SetStatus(StatusError, fmt.Sprint("panic: ", v))
+					span.End()
+					panic(v)
+				}
+				span.End()
+			}()
+			next(w, req)
+		}
+	}
+}
+
+// finishServerSpan describes the request and its response on span, with
+// the OpenTelemetry semantic conventions for HTTP.
+func finishServerSpan(span *Span, w response.ResponseWriter, req *request.Request) {
+	method := req.RequestLine.Method
+	attrs := []Attribute{
+		{"http.request.method", method},
+		{"url.path", req.Path()},
+		{"network.protocol.version", req.RequestLine.HttpVersion},
+	}
+	if route := server.Route(req); route != "" {
+		span.SetName(method + " " + route)
+		attrs = append(attrs, Attribute{"http.route", route})
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		attrs = append(attrs, Attribute{"client.address", host})
+	}
+	if ua, ok := req.Headers.Get("User-Agent"); ok {
+		attrs = append(attrs, Attribute{"user_agent.original", ua})
+	}
+	if st, ok := response.StatsOf(w); ok && st.StatusCode != 0 {
+		attrs = append(attrs,
+			Attribute{"http.response.status_code", int(st.StatusCode)},
+			Attribute{"http.response.body.size", st.EncodedBodyBytes})
+		// for a server, only its own failures are errors
+		if st.StatusCode >= 500 {
+			span.SetStatus(StatusError, "")
+		}
+	}
+	span.SetAttributes(attrs...)
+}
@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/logging"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/server"
+)
+
+// serveTraced starts a server recording spans with tracer and returns its
+// address, and the buffer its handlers log to.
+func serveTraced(t *testing.T, tracer *Tracer) (string, *lockedBuffer) {
+	t.Helper()
+	var logs lockedBuffer
+	handler := func(w response.ResponseWriter, req *request.Request) {
+		server.SetRoute(req, "/users/{id}")
+		logging.FromContext(req.Context()).Info("handled")
+		if req.Path() == "/users/panic" {
+			panic("boom")
+		}
+		status := response.StatusOK
+		if req.Path() == "/users/fail" {
+			status = response.StatusServerInternalError
+		}
+		_ = w.WriteStatusLine(status)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(2))
+		_, _ = w.WriteBody([]byte("ok"))
+	}
+	s := server.New(handler, server.Config{
+		Logger:     slog.New(slog.NewTextHandler(&logs, nil)),
+		Middleware: []server.Middleware{Middleware(tracer)},
+	})
+	addr, err := s.Serve(server.Listener{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return addr.String(), &logs
+}
+
+// get requests target from addr with extra header lines and returns the
+// status code.
+func get(t *testing.T, addr, target, extra string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: x\r\nUser-Agent: test\r\n%s\r\n", target, extra)
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	return res.StatusCode
+}
+
+// attrs maps the attributes of span to their values as encoded.
+func attrs(span otlpSpan) map[string]string {
+	m := make(map[string]string)
+	for _, a := range span.Attributes {
+		switch v := a.Value; {
+		case v.StringValue != nil:
+			m[a.Key] = *v.StringValue
+		case v.IntValue != nil:
+			m[a.Key] = *v.IntValue
+		}
+	}
+	return m
+}
+
+func TestMiddleware(t *testing.T) {
+	var out lockedBuffer
+	tracer := NewTracer("checkout", NewFileExporter(&out))
+	addr, logs := serveTraced(t, tracer)
+
+	require.Equal(t, 200, get(t, addr, "/users/1", "Traceparent: "+traceparent+"\r\nTracestate: rojo=1\r\n"))
+	require.Equal(t, 500, get(t, addr, "/users/fail", ""))
+	require.Equal(t, 500, get(t, addr, "/users/panic", ""))
+	shutdown(t, tracer)
+	spans := exported(t, out.String())
+	require.Len(t, spans, 3)
+
+	// Test: A request with a traceparent continues the caller's trace, in a
+	// server span named after the method and route
+	s := spans[0]
+	assert.Equal(t, traceID, s.TraceID)
+	assert.Equal(t, parentID, s.ParentSpanID)
+	assert.Equal(t, "rojo=1", s.TraceState)
+	assert.Equal(t, "GET /users/{id}", s.Name)
+	assert.Equal(t, SpanKindServer, s.Kind)
+	assert.Equal(t, StatusUnset, s.Status.Code)
+	assert.Equal(t, map[string]string{
+		"http.request.method":       "GET",
+		"url.path":                  "/users/1",
+		"network.protocol.version":  "1.1",
+		"http.route":                "/users/{id}",
+		"client.address":            "127.0.0.1",
+		"user_agent.original":       "test",
+		"http.response.status_code": "200",
+		"http.response.body.size":   "2",
+	}, attrs(s))
+
+	// Test: One without starts a new trace, and a 5xx is an error
+	s = spans[1]
+	assert.NotEqual(t, traceID, s.TraceID)
+	assert.Empty(t, s.ParentSpanID)
+	assert.Equal(t, StatusError, s.Status.Code)
+
+	// Test: So is a panic, though the 500 is written after the span ends
+	s = spans[2]
+	assert.Equal(t, StatusError, s.Status.Code)
+	assert.Equal(t, "panic: boom", s.Status.Message)
+
+	// Test: The handler's logger carries the trace and span IDs
+	assert.Contains(t, logs.String(), "trace_id="+traceID+" span_id="+spans[0].SpanID)
+}
+
+func TestMiddlewareUnsampled(t *testing.T) {
+	var out lockedBuffer
+	tracer := NewTracer("checkout", NewFileExporter(&out))
+	addr, _ := serveTraced(t, tracer)
+
+	// Test: A trace the caller does not sample is not exported
+	require.Equal(t, 200, get(t, addr, "/users/1", "Traceparent: 00-"+traceID+"-"+parentID+"-00\r\n"))
+	require.NoError(t, tracer.Shutdown(context.Background()))
+	assert.Empty(t, out.String())
+}
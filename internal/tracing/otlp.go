@@ -0,0 +1,177 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter ships a batch of finished spans, encoded as an OTLP/JSON
+// ExportTraceServiceRequest.
+type Exporter interface {
+	Export(ctx context.Context, data []byte) error
+}
+
+// FileExporter writes each batch to a writer as one line, the layout of the
+// OpenTelemetry Collector's file exporter and receiver.
+type FileExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewFileExporter(w io.Writer) *FileExporter {
+	return &FileExporter{w: w}
+}
+
+func (e *FileExporter) Export(_ context.Context, data []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.w.Write(append(data, '\n'))
+	return err
+}
+
+// HTTPExporter posts each batch to an OTLP/HTTP collector endpoint, such
+// as http://localhost:4318/v1/traces.
+type HTTPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewHTTPExporter(endpoint string) *HTTPExporter {
+	return &HTTPExporter{endpoint: endpoint, client: &http.Client{}}
+}
+
+func (e *HTTPExporter) Export(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// the body is read so the connection can be reused
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("tracing: collector answered %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of spans. IDs are hex, and 64-bit integers
+// strings, as the protobuf JSON mapping has them.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		TraceState        string          `json:"traceState,omitempty"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Flags             uint32          `json:"flags"`
+		Name              string          `json:"name"`
+		Kind              SpanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    StatusCode `json:"code,omitempty"`
+		Message string     `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+// scopeName names the instrumentation that made the spans.
+const scopeName = "httpfromtcp.haonguyen.tech/internal/tracing"
+
+// marshalSpans encodes ended spans of service as an
+// ExportTraceServiceRequest.
+func marshalSpans(service string, spans []*Span) ([]byte, error) {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.context.TraceID.String(),
+			SpanID:            s.context.SpanID.String(),
+			TraceState:        s.context.State,
+			Flags:             uint32(s.context.Flags),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		if s.parent.IsValid() {
+			span.ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attributes {
+			span.Attributes = append(span.Attributes, otlpAttr(a))
+		}
+		s.mu.Unlock()
+		out = append(out, span)
+	}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttr(Attribute{"service.name", service})}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: out}},
+	}}})
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttr(a Attribute) otlpAttribute {
+	var v otlpValue
+	switch x := a.Value.(type) {
+	case string:
+		v.StringValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &x
+	case bool:
+		v.BoolValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: a.Key, Value: v}
+}
@@ -0,0 +1,142 @@
+// Package tracing follows requests across services with W3C Trace Context
+// (the traceparent and tracestate headers) and records a span for each,
+// exported as OTLP/JSON to a collector or a file.
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SpanKind says what part a span plays in a call, as OTLP numbers it.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// StatusCode is the outcome of a span, as OTLP numbers it.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key and a string, int64, float64 or bool value describing
+// a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Span is one operation of a trace, such as handling a request. Its fields
+// may be changed until End is called; after that they are read by the
+// exporter and must not be.
+type Span struct {
+	tracer *Tracer
+
+	mu         sync.Mutex
+	name       string
+	context    SpanContext
+	parent     SpanID
+	kind       SpanKind
+	start, end time.Time
+	attributes []Attribute
+	status     StatusCode
+	message    string
+	ended      bool
+}
+
+// Context returns the span context children of s inherit.
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// SetName renames s, such as once the route of a request is known.
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.name = name
+	}
+}
+
+// SetAttributes adds attributes to s.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.attributes = append(s.attributes, attrs...)
+	}
+}
+
+// SetStatus sets the outcome of s, with a message for errors.
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.status, s.message = code, message
+	}
+}
+
+// End finishes s and hands it to its tracer's exporter if it is sampled.
+// Calls after the first do nothing.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.tracer != nil && s.context.IsSampled() {
+		s.tracer.enqueue(s)
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying span, which SpanFromContext
+// returns.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+// SpanFromContext returns the span in ctx, or nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span named name as a child of the span in ctx, recorded
+// by the same tracer, and returns a context carrying it. Without a span in
+// ctx it starts a new trace that is propagated but not exported.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var tracer *Tracer
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		tracer, parent = p.tracer, p.context
+	}
+	span := newSpan(tracer, name, kind, parent)
+	return NewContext(ctx, span), span
+}
+
+// newSpan starts a span continuing the trace of parent, or a new sampled
+// trace if parent is not valid.
+func newSpan(tracer *Tracer, name string, kind SpanKind, parent SpanContext) *Span {
+	s := &Span{tracer: tracer, name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		s.context = SpanContext{TraceID: parent.TraceID, Flags: parent.Flags, State: parent.State}
+		s.parent = parent.SpanID
+	} else {
+		s.context = SpanContext{TraceID: newTraceID(), Flags: FlagSampled}
+	}
+	s.context.SpanID = newSpanID()
+	return s
+}
@@ -0,0 +1,215 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TraceID identifies a trace, the tree of spans a request makes across
+// services.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros, which marks an invalid ID.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+func newTraceID() TraceID {
+	var id TraceID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+// FlagSampled is the trace flag set when the caller may record the trace.
+const FlagSampled = 0x01
+
+// SpanContext is what a span passes on to its children, in this process or,
+// through the traceparent and tracestate headers, in the next one.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// State is the vendor data of the tracestate header, passed on as is.
+	State string
+}
+
+// IsValid reports whether sc has both a trace and a span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// IsSampled reports whether the sampled flag is set.
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+var errTraceparent = errors.New("tracing: invalid traceparent")
+
+// ParseTraceparent parses a traceparent header value,
+// "version-traceid-parentid-flags" in lowercase hex. Versions after 00 are
+// read as 00, ignoring whatever they append, as the W3C Trace Context
+// specification asks.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	// 00-<32 hex>-<16 hex>-<2 hex>
+	const size = 55
+	if len(s) < size || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, errTraceparent
+	}
+	version, ok := decodeHex(s[:2])
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(s) != size) || (len(s) > size && s[size] != '-') {
+		return sc, errTraceparent
+	}
+	trace, ok := decodeHex(s[3:35])
+	if !ok {
+		return sc, errTraceparent
+	}
+	span, ok := decodeHex(s[36:52])
+	if !ok {
+		return sc, errTraceparent
+	}
+	flags, ok := decodeHex(s[53:55])
+	if !ok {
+		return sc, errTraceparent
+	}
+	copy(sc.TraceID[:], trace)
+	copy(sc.SpanID[:], span)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, errTraceparent
+	}
+	return sc, nil
+}
+
+// decodeHex decodes lowercase hex only, as traceparent requires.
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// maxTracestateMembers is the most list members tracestate may have.
+const maxTracestateMembers = 32
+
+// validTracestate reports whether s is a well-formed tracestate header
+// value: up to 32 comma-separated key=value members with distinct keys.
+func validTracestate(s string) bool {
+	seen := make(map[string]bool)
+	for member := range strings.SplitSeq(s, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			// empty members are allowed and ignored
+			continue
+		}
+		key, value, ok := strings.Cut(member, "=")
+		if !ok || !validStateKey(key) || !validStateValue(value) || seen[key] {
+			return false
+		}
+		seen[key] = true
+	}
+	return len(seen) <= maxTracestateMembers
+}
+
+// validStateKey checks a key: lowercase letters, digits and _-*/, starting
+// with a letter, or a tenant and system joined by @.
+func validStateKey(key string) bool {
+	tenant, system, multi := strings.Cut(key, "@")
+	if !multi {
+		return len(key) <= 256 && isStateKeyPart(key, true)
+	}
+	return len(tenant) <= 241 && len(system) <= 14 &&
+		isStateKeyPart(tenant, false) && isStateKeyPart(system, true)
+}
+
+func isStateKeyPart(s string, letterFirst bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && (i > 0 || !letterFirst):
+		case (c == '_' || c == '-' || c == '*' || c == '/') && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validStateValue checks a value: up to 256 printable ASCII characters
+// other than comma and equals. Spaces around it were trimmed with the
+// member's.
+func validStateValue(v string) bool {
+	if v == "" || len(v) > 256 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// Getter reads a header, as headers.Headers does.
+type Getter interface {
+	Get(key string) (string, bool)
+}
+
+// Setter sets a header, as http.Header and headers.Headers do.
+type Setter interface {
+	Set(key, value string)
+}
+
+// Extract reads the span context of the caller from the traceparent and
+// tracestate headers in h. It reports false if there is no valid
+// traceparent; an invalid tracestate is dropped on its own.
+func Extract(h Getter) (SpanContext, bool) {
+	parent, ok := h.Get("traceparent")
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(strings.TrimSpace(parent))
+	if err != nil {
+		return SpanContext{}, false
+	}
+	if state, ok := h.Get("tracestate"); ok && validTracestate(state) {
+		sc.State = strings.TrimSpace(state)
+	}
+	return sc, true
+}
+
+// Inject sets the traceparent and tracestate headers in h for sc, so the
+// service called continues the trace.
+func Inject(sc SpanContext, h Setter) {
+	if !sc.IsValid() {
+		return
+	}
+	h.Set("traceparent", sc.Traceparent())
+	if sc.State != "" {
+		h.Set("tracestate", sc.State)
+	}
+}
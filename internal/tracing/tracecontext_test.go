@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID    = "00f067aa0ba902b7"
+	traceparent = "00-" + traceID + "-" + parentID + "-01"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(traceparent)
+	require.NoError(t, err)
+	assert.Equal(t, traceID, sc.TraceID.String())
+	assert.Equal(t, parentID, sc.SpanID.String())
+	assert.True(t, sc.IsSampled())
+	assert.Equal(t, traceparent, sc.Traceparent())
+
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{name: "not sampled", value: "00-" + traceID + "-" + parentID + "-00", valid: true},
+		{name: "future version", value: "cc-" + traceID + "-" + parentID + "-01-what-comes-next", valid: true},
+		{name: "future version, exact length", value: "cc-" + traceID + "-" + parentID + "-01", valid: true},
+		{name: "forbidden version", value: "ff-" + traceID + "-" + parentID + "-01"},
+		{name: "version 00 with more", value: traceparent + "-01"},
+		{name: "future version without dash", value: "cc-" + traceID + "-" + parentID + "-01x"},
+		{name: "uppercase", value: "00-" + strings.ToUpper(traceID) + "-" + parentID + "-01"},
+		{name: "zero trace ID", value: "00-" + strings.Repeat("0", 32) + "-" + parentID + "-01"},
+		{name: "zero parent ID", value: "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01"},
+		{name: "not hex", value: "00-" + traceID + "-" + parentID + "-0g"},
+		{name: "short", value: "00-" + traceID + "-" + parentID[1:] + "-01"},
+		{name: "wrong separator", value: "00_" + traceID + "-" + parentID + "-01"},
+		{name: "empty", value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTraceparent(tt.value)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestValidTracestate(t *testing.T) {
+	var many []string
+	for i := range 33 {
+		many = append(many, "k"+strings.Repeat("x", i)+"=v")
+	}
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{value: "congo=t61rcWkgMzE", valid: true},
+		{value: "rojo=00f067aa0ba902b7, congo=t61rcWkgMzE", valid: true},
+		{value: "tenant1@vendor=a b,,", valid: true},
+		{value: "1tenant@vendor=x", valid: true},
+		{value: strings.Join(many[:32], ","), valid: true},
+		{value: strings.Join(many, ",")},
+		{value: "Rojo=1"},
+		{value: "rojo=1,rojo=2"},
+		{value: "rojo"},
+		{value: "rojo=a=b"},
+		{value: "@vendor=x"},
+		{value: "tenant@vendor-name-too-long=x"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.valid, validTracestate(tt.value), tt.value)
+	}
+}
+
+func TestExtractInject(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Traceparent", traceparent)
+	h.Set("Tracestate", "rojo=00f067aa0ba902b7")
+	h.Set("Tracestate", "congo=t61rcWkgMzE")
+
+	// Test: tracestate headers are combined and kept with the traceparent
+	sc, ok := Extract(h)
+	require.True(t, ok)
+	assert.Equal(t, "rojo=00f067aa0ba902b7, congo=t61rcWkgMzE", sc.State)
+
+	// Test: They go out as they came in
+	out := http.Header{}
+	Inject(sc, out)
+	assert.Equal(t, traceparent, out.Get("Traceparent"))
+	assert.Equal(t, sc.State, out.Get("Tracestate"))
+
+	// Test: An invalid tracestate is dropped, an invalid traceparent drops
+	// both
+	h = headers.NewHeaders()
+	h.Set("Traceparent", traceparent)
+	h.Set("Tracestate", "Invalid")
+	sc, ok = Extract(h)
+	require.True(t, ok)
+	assert.Empty(t, sc.State)
+	h.Override("Traceparent", "00-nonsense")
+	_, ok = Extract(h)
+	assert.False(t, ok)
+	_, ok = Extract(headers.NewHeaders())
+	assert.False(t, ok)
+}
@@ -0,0 +1,130 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queueSize bounds the finished spans waiting to be exported; past it
+	// spans are dropped rather than holding up requests.
+	queueSize = 2048
+	// maxBatch spans are exported at once, at least every batchInterval.
+	maxBatch      = 512
+	batchInterval = 5 * time.Second
+	// exportTimeout bounds exporting one batch.
+	exportTimeout = 10 * time.Second
+)
+
+// Tracer starts spans for a service and exports the finished ones in
+// batches, in the background.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	queue    chan *Span
+	dropped  atomic.Int64
+	closed   atomic.Bool
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewTracer returns a tracer for the service named service. A nil exporter
+// keeps nothing; trace context is still propagated.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if exporter == nil {
+		close(t.stopped)
+		return t
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a span named name continuing the trace of parent, or a new
+// trace if parent is not valid, and returns a context carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, parent SpanContext) (context.Context, *Span) {
+	span := newSpan(t, name, kind, parent)
+	return NewContext(ctx, span), span
+}
+
+// Shutdown exports the spans that have ended and stops the tracer. Spans
+// ending afterwards are dropped. If ctx ends first, its error is returned.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if !t.closed.Swap(true) && t.exporter != nil {
+		close(t.done)
+	}
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	if t.exporter == nil || t.closed.Load() {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run batches finished spans for the exporter until Shutdown.
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) >= maxBatch {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends batch and returns it emptied for reuse.
+func (t *Tracer) export(batch []*Span) []*Span {
+	if n := t.dropped.Swap(0); n > 0 {
+		slog.Warn("dropped spans: export queue full", "spans", n)
+	}
+	if len(batch) == 0 {
+		return batch
+	}
+	data, err := marshalSpans(t.service, batch)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		err = t.exporter.Export(ctx, data)
+		cancel()
+	}
+	if err != nil {
+		slog.Error("exporting spans", "spans", len(batch), "err", err)
+	}
+	clear(batch)
+	return batch[:0]
+}
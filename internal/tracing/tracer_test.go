@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockedBuffer is a bytes.Buffer safe for the tracer's goroutine.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// exported decodes the spans of every batch in out, one per line.
+func exported(t *testing.T, out string) []otlpSpan {
+	t.Helper()
+	var spans []otlpSpan
+	for line := range strings.Lines(out) {
+		var req otlpRequest
+		require.NoError(t, json.Unmarshal([]byte(line), &req))
+		require.Len(t, req.ResourceSpans, 1)
+		rs := req.ResourceSpans[0]
+		require.Len(t, rs.ScopeSpans, 1)
+		spans = append(spans, rs.ScopeSpans[0].Spans...)
+	}
+	return spans
+}
+
+func shutdown(t *testing.T, tracer *Tracer) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, tracer.Shutdown(ctx))
+}
+
+func TestTracerExport(t *testing.T) {
+	var out lockedBuffer
+	tracer := NewTracer("checkout", NewFileExporter(&out))
+	parent, err := ParseTraceparent(traceparent)
+	require.NoError(t, err)
+	parent.State = "rojo=1"
+
+	ctx, server := tracer.Start(context.Background(), "GET /cart", SpanKindServer, parent)
+	_, client := StartSpan(ctx, "GET", SpanKindClient)
+	client.SetAttributes(Attribute{"http.response.status_code", 502}, Attribute{"retry", true})
+	client.SetStatus(StatusError, "bad gateway")
+	client.End()
+	server.End()
+	// spans ended after Shutdown are dropped
+	shutdown(t, tracer)
+	_, late := tracer.Start(context.Background(), "late", SpanKindServer, SpanContext{})
+	late.End()
+
+	// Test: Spans are written as OTLP/JSON on Shutdown, continuing the
+	// caller's trace, with the client span a child of the server span
+	require.Equal(t, 1, strings.Count(out.String(), "\n"))
+	assert.Contains(t, out.String(), `"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]}`)
+	spans := exported(t, out.String())
+	require.Len(t, spans, 2)
+	c, s := spans[0], spans[1]
+	assert.Equal(t, traceID, s.TraceID)
+	assert.Equal(t, parentID, s.ParentSpanID)
+	assert.Equal(t, "rojo=1", s.TraceState)
+	assert.Equal(t, SpanKindServer, s.Kind)
+	assert.Equal(t, traceID, c.TraceID)
+	assert.Equal(t, s.SpanID, c.ParentSpanID)
+	assert.Equal(t, "GET", c.Name)
+	assert.Equal(t, SpanKindClient, c.Kind)
+	assert.Equal(t, otlpStatus{Code: StatusError, Message: "bad gateway"}, c.Status)
+	require.Len(t, c.Attributes, 2)
+	assert.Equal(t, "502", *c.Attributes[0].Value.IntValue)
+	assert.True(t, *c.Attributes[1].Value.BoolValue)
+	assert.NotEqual(t, c.StartTimeUnixNano, c.EndTimeUnixNano)
+}
+
+func TestTracerSampling(t *testing.T) {
+	var out lockedBuffer
+	tracer := NewTracer("checkout", NewFileExporter(&out))
+	parent, err := ParseTraceparent("00-" + traceID + "-" + parentID + "-00")
+	require.NoError(t, err)
+
+	// Test: A trace the caller does not sample is propagated, not exported
+	_, span := tracer.Start(context.Background(), "GET", SpanKindServer, parent)
+	assert.Equal(t, parent.TraceID, span.Context().TraceID)
+	assert.False(t, span.Context().IsSampled())
+	span.End()
+
+	// Test: New traces are sampled
+	_, span = tracer.Start(context.Background(), "GET", SpanKindServer, SpanContext{})
+	assert.True(t, span.Context().IsValid())
+	assert.True(t, span.Context().IsSampled())
+	span.End()
+	shutdown(t, tracer)
+	spans := exported(t, out.String())
+	require.Len(t, spans, 1)
+	assert.Equal(t, span.Context().TraceID.String(), spans[0].TraceID)
+	assert.Empty(t, spans[0].ParentSpanID)
+}
+
+func TestHTTPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, string(b))
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	// Test: Batches are posted to the collector
+	tracer := NewTracer("checkout", NewHTTPExporter(collector.URL+"/v1/traces"))
+	_, span := tracer.Start(context.Background(), "GET", SpanKindServer, SpanContext{})
+	span.End()
+	shutdown(t, tracer)
+	mu.Lock()
+	require.Len(t, received, 1)
+	assert.Len(t, exported(t, received[0]), 1)
+	mu.Unlock()
+
+	// Test: A collector's refusal is an error
+	err := NewHTTPExporter(collector.URL+"/elsewhere").Export(context.Background(), []byte("{}"))
+	assert.ErrorContains(t, err, "404 Not Found")
+}
@@ -0,0 +1,261 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+)
+
+// Compression configures the permessage-deflate extension (RFC 7692).
+type Compression struct {
+	// Level is the flate level messages are compressed with, from
+	// flate.BestSpeed to flate.BestCompression. Zero means
+	// flate.DefaultCompression.
+	Level int
+	// NoContextTakeover makes the server compress every message on its own,
+	// so it does not keep a 32 KiB window per connection between messages,
+	// at the cost of compression ratio.
+	NoContextTakeover bool
+	// ClientNoContextTakeover asks clients to compress every message on its
+	// own, so the server does not keep their window between messages either.
+	ClientNoContextTakeover bool
+}
+
+const (
+	deflateExtension = "permessage-deflate"
+	// deflateTail ends the flush that ends every compressed message. Senders
+	// strip it and receivers put it back.
+	deflateTail = "\x00\x00\xff\xff"
+	// deflateEnd is an empty final block, which lets the decompressor reach
+	// EOF after a message.
+	deflateEnd = "\x01\x00\x00\xff\xff"
+	// maxWindow is the largest LZ77 window, 2^15 bytes.
+	maxWindow = 1 << 15
+)
+
+// deflateParams are the agreed parameters of permessage-deflate. The window
+// bits are zero unless limited.
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+// negotiateDeflate accepts the first permessage-deflate offer of r the
+// server can honour. It returns the agreed parameters and the extension
+// response, or false if there is none.
+func negotiateDeflate(r *request.Request, opts *Compression) (deflateParams, string, bool) {
+	v, ok := r.Headers.Get("Sec-WebSocket-Extensions")
+	if !ok {
+		return deflateParams{}, "", false
+	}
+	for _, offer := range strings.Split(v, ",") {
+		name, params, _ := strings.Cut(offer, ";")
+		if strings.TrimSpace(name) != deflateExtension {
+			continue
+		}
+		p, err := parseDeflateOffer(params)
+		if err != nil {
+			continue
+		}
+		p.serverNoContextTakeover = p.serverNoContextTakeover || opts.NoContextTakeover
+		p.clientNoContextTakeover = p.clientNoContextTakeover || opts.ClientNoContextTakeover
+		return p, p.String(), true
+	}
+	return deflateParams{}, "", false
+}
+
+// parseDeflateOffer parses the parameters of an offer. Offers with unknown,
+// repeated or malformed parameters must be declined.
+func parseDeflateOffer(s string) (deflateParams, error) {
+	var p deflateParams
+	seen := map[string]bool{}
+	for _, param := range strings.Split(s, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(param, "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return p, fmt.Errorf("repeated parameter %s", name)
+		}
+		seen[name] = true
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if hasValue {
+				return p, fmt.Errorf("%s takes no value", name)
+			}
+			if name == "server_no_context_takeover" {
+				p.serverNoContextTakeover = true
+			} else {
+				p.clientNoContextTakeover = true
+			}
+		case "server_max_window_bits":
+			bits, err := windowBits(value)
+			if err != nil {
+				return p, err
+			}
+			p.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			// without a value the client only says it supports the limit,
+			// which the server has no need for
+			if hasValue {
+				bits, err := windowBits(value)
+				if err != nil {
+					return p, err
+				}
+				p.clientMaxWindowBits = bits
+			}
+		default:
+			return p, fmt.Errorf("unknown parameter %s", name)
+		}
+	}
+	return p, nil
+}
+
+func windowBits(s string) (int, error) {
+	bits, err := strconv.Atoi(s)
+	if err != nil || bits < 8 || bits > 15 || strconv.Itoa(bits) != s {
+		return 0, fmt.Errorf("invalid window bits %q", s)
+	}
+	return bits, nil
+}
+
+// String formats p as the extension response.
+func (p deflateParams) String() string {
+	var b strings.Builder
+	b.WriteString(deflateExtension)
+	if p.serverNoContextTakeover {
+		b.WriteString("; server_no_context_takeover")
+	}
+	if p.clientNoContextTakeover {
+		b.WriteString("; client_no_context_takeover")
+	}
+	if p.serverMaxWindowBits != 0 {
+		fmt.Fprintf(&b, "; server_max_window_bits=%d", p.serverMaxWindowBits)
+	}
+	if p.clientMaxWindowBits != 0 {
+		fmt.Fprintf(&b, "; client_max_window_bits=%d", p.clientMaxWindowBits)
+	}
+	return b.String()
+}
+
+// flateWriter compresses the messages one end sends.
+type flateWriter struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+	// reset drops the window after every message (no context takeover)
+	reset bool
+	// pending is set when buf's tail was held back from the last fragment
+	pending bool
+}
+
+// newFlateWriter returns a writer that compresses at level, honouring a
+// window limit of maxWindowBits if it is not zero.
+func newFlateWriter(level int, maxWindowBits int, reset bool) (*flateWriter, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if maxWindowBits != 0 && maxWindowBits < 15 {
+		// compress/flate always uses the largest window, so only Huffman
+		// coding, which makes no back references, stays within a smaller one
+		level = flate.HuffmanOnly
+	}
+	fw := &flateWriter{reset: reset}
+	w, err := flate.NewWriter(&fw.buf, level)
+	if err != nil {
+		return nil, fmt.Errorf("websocket: compression level: %w", err)
+	}
+	fw.w = w
+	return fw, nil
+}
+
+// write compresses p as the next part of a message. The result is only
+// valid until the next call.
+func (f *flateWriter) write(p []byte) ([]byte, error) {
+	f.buf.Reset()
+	if f.pending {
+		f.buf.WriteString(deflateTail)
+	}
+	if _, err := f.w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := f.w.Flush(); err != nil {
+		return nil, err
+	}
+	// every flush ends with the tail, which only the last one may drop
+	f.pending = true
+	b := f.buf.Bytes()
+	return b[:len(b)-len(deflateTail)], nil
+}
+
+// finish ends the message, dropping the held back tail.
+func (f *flateWriter) finish() {
+	f.pending = false
+	if f.reset {
+		f.buf.Reset()
+		f.w.Reset(&f.buf)
+	}
+}
+
+// flateReader decompresses the messages the peer sends.
+type flateReader struct {
+	r io.ReadCloser
+	// window is the end of the previous messages, which the next may refer
+	// back to unless reset is set
+	window []byte
+	reset  bool
+}
+
+func newFlateReader(reset bool) *flateReader {
+	return &flateReader{r: flate.NewReader(nil), reset: reset}
+}
+
+// errTooBig is returned by decompress when a message inflates past the limit.
+var errTooBig = errors.New("websocket: decompressed message too big")
+
+// decompress inflates a whole message. It stops reading at limit bytes, so
+// a small message cannot expand into an unbounded one.
+func (f *flateReader) decompress(p []byte, limit int64) ([]byte, error) {
+	in := io.MultiReader(bytes.NewReader(p), strings.NewReader(deflateTail+deflateEnd))
+	if err := f.r.(flate.Resetter).Reset(in, f.window); err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(f.r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errTooBig
+	}
+	if !f.reset {
+		f.window = append(f.window, out...)
+		if len(f.window) > maxWindow {
+			f.window = append(f.window[:0], f.window[len(f.window)-maxWindow:]...)
+		}
+	}
+	return out, nil
+}
+
+// enableDeflate turns permessage-deflate on with the agreed parameters.
+func (c *Conn) enableDeflate(p deflateParams, level int) error {
+	writeReset, readReset, writeBits := p.serverNoContextTakeover, p.clientNoContextTakeover, p.serverMaxWindowBits
+	if !c.isServer {
+		writeReset, readReset, writeBits = p.clientNoContextTakeover, p.serverNoContextTakeover, p.clientMaxWindowBits
+	}
+	fw, err := newFlateWriter(level, writeBits, writeReset)
+	if err != nil {
+		return err
+	}
+	c.fw, c.fr = fw, newFlateReader(readReset)
+	return nil
+}
@@ -0,0 +1,359 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		offer    string
+		opts     Compression
+		response string // empty if declined
+	}{
+		{"permessage-deflate", Compression{}, "permessage-deflate"},
+		// what browsers send
+		{"permessage-deflate; client_max_window_bits", Compression{}, "permessage-deflate"},
+		{"permessage-deflate; client_max_window_bits=10; server_no_context_takeover", Compression{}, "permessage-deflate; server_no_context_takeover; client_max_window_bits=10"},
+		{`permessage-deflate; client_max_window_bits="12"`, Compression{}, "permessage-deflate; client_max_window_bits=12"},
+		{"x-webkit-deflate-frame, permessage-deflate; server_max_window_bits=10", Compression{}, "permessage-deflate; server_max_window_bits=10"},
+		{"permessage-deflate", Compression{NoContextTakeover: true, ClientNoContextTakeover: true}, "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		// an offer that cannot be accepted falls back to the next
+		{"permessage-deflate; server_max_window_bits=16, permessage-deflate", Compression{}, "permessage-deflate"},
+		{"permessage-deflate; server_max_window_bits", Compression{}, ""},
+		{"permessage-deflate; server_max_window_bits=010", Compression{}, ""},
+		{"permessage-deflate; mystery", Compression{}, ""},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", Compression{}, ""},
+		{"permessage-deflate; client_no_context_takeover=1", Compression{}, ""},
+		{"x-webkit-deflate-frame", Compression{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.offer, func(t *testing.T) {
+			r := &request.Request{Headers: headers.Headers{"sec-websocket-extensions": tt.offer}}
+			_, response, ok := negotiateDeflate(r, &tt.opts)
+			assert.Equal(t, tt.response != "", ok)
+			assert.Equal(t, tt.response, response)
+		})
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// deflatePair returns the client and server Conns of a connection using
+// permessage-deflate with p, and the client's end of the connection.
+func deflatePair(t *testing.T, p deflateParams, maxMessageSize int64) (*Conn, *Conn, *countingConn) {
+	t.Helper()
+	cc, sc := pipe(t)
+	counted := &countingConn{Conn: cc}
+	client := newConn(counted, bufio.NewReader(cc), false, 0)
+	server := newConn(sc, bufio.NewReader(sc), true, maxMessageSize)
+	require.NoError(t, client.enableDeflate(p, 0))
+	require.NoError(t, server.enableDeflate(p, 0))
+	return client, server, counted
+}
+
+// dashboard is a large, repetitive JSON message.
+func dashboard(t *testing.T) []byte {
+	t.Helper()
+	type point struct {
+		Host   string  `json:"host"`
+		Metric string  `json:"metric"`
+		Value  float64 `json:"value"`
+	}
+	var points []point
+	for i := range 2000 {
+		points = append(points, point{Host: "web-" + string(rune('a'+i%26)), Metric: "cpu.utilization", Value: float64(i%100) / 3})
+	}
+	b, err := json.Marshal(points)
+	require.NoError(t, err)
+	return b
+}
+
+func TestCompressedMessages(t *testing.T) {
+	msg := dashboard(t)
+	tests := []struct {
+		name   string
+		params deflateParams
+	}{
+		{"context takeover", deflateParams{}},
+		{"no context takeover", deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true}},
+		{"small windows", deflateParams{serverMaxWindowBits: 9, clientMaxWindowBits: 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, wire := deflatePair(t, tt.params, 0)
+
+			// Test: Messages are compressed on the wire and arrive intact
+			for i := range 3 {
+				before := wire.written.Load()
+				require.NoError(t, client.WriteMessage(TextMessage, msg))
+				typ, got, err := server.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, TextMessage, typ)
+				assert.Equal(t, msg, got, "message %d", i)
+				// Huffman coding alone, for small windows, saves the least
+				assert.Less(t, wire.written.Load()-before, int64(len(msg)*3/4))
+			}
+
+			// Test: Both directions, and empty messages
+			for _, m := range [][]byte{[]byte("ping"), {}, bytes.Repeat([]byte{0, 1, 2}, 50000)} {
+				require.NoError(t, server.WriteMessage(BinaryMessage, m))
+				_, got, err := client.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, string(m), string(got))
+			}
+
+			// Test: Fragmented messages are compressed as one
+			w, err := client.NextWriter(TextMessage)
+			require.NoError(t, err)
+			for part := range bytes.SplitSeq(msg, []byte("},{")) {
+				_, err = w.Write(append(part, "},{"...))
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Close())
+			_, got, err := server.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, string(msg)+"},{", string(got))
+
+			w, err = server.NextWriter(BinaryMessage)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			_, got, err = client.ReadMessage()
+			require.NoError(t, err)
+			assert.Empty(t, got)
+		})
+	}
+}
+
+func TestContextTakeover(t *testing.T) {
+	// short enough to fit the window
+	msg := dashboard(t)[:maxWindow/2]
+	sizes := func(p deflateParams) (first, second int64) {
+		client, server, wire := deflatePair(t, p, 0)
+		for _, size := range []*int64{&first, &second} {
+			before := wire.written.Load()
+			require.NoError(t, client.WriteMessage(TextMessage, msg))
+			_, _, err := server.ReadMessage()
+			require.NoError(t, err)
+			*size = wire.written.Load() - before
+		}
+		return first, second
+	}
+
+	// Test: A repeated message refers back to the previous one
+	first, second := sizes(deflateParams{})
+	assert.Less(t, second, first/2)
+
+	// Test: Unless the window is reset between messages
+	first, second = sizes(deflateParams{clientNoContextTakeover: true})
+	assert.InDelta(t, first, second, float64(first)/10)
+}
+
+func TestCompressionErrors(t *testing.T) {
+	compressed := func(b []byte) []byte {
+		fw, err := newFlateWriter(flate.BestCompression, 0, false)
+		require.NoError(t, err)
+		out, err := fw.write(b)
+		require.NoError(t, err)
+		return bytes.Clone(out)
+	}
+	masked := func(rsv, opcode byte, fin bool, payload []byte) []byte {
+		return appendFrame(nil, frameHeader{fin: fin, rsv: rsv, opcode: opcode, masked: true, mask: [4]byte{9, 8, 7, 6}}, payload)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		code  CloseCode
+	}{
+		// 16 MiB of zeros compress to a few KiB
+		{"decompression bomb", masked(rsv1Bit, opBinary, true, compressed(make([]byte, 16<<20))), CloseMessageTooBig},
+		{"corrupt data", masked(rsv1Bit, opBinary, true, []byte{0xff, 0xff, 0xff, 0xff}), CloseInvalidPayload},
+		{"invalid UTF-8", masked(rsv1Bit, opText, true, compressed([]byte("ok \xff"))), CloseInvalidPayload},
+		{"RSV1 on a continuation", append(masked(rsv1Bit, opText, false, nil), masked(rsv1Bit, opContinuation, true, nil)...), CloseProtocolError},
+		{"RSV1 on a ping", masked(rsv1Bit, opPing, true, nil), CloseProtocolError},
+		{"RSV2", masked(0x20, opText, true, nil), CloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, sc := pipe(t)
+			server := newConn(sc, bufio.NewReader(sc), true, 1<<20)
+			require.NoError(t, server.enableDeflate(deflateParams{}, 0))
+			_, err := cc.Write(tt.input)
+			require.NoError(t, err)
+
+			_, _, err = server.ReadMessage()
+			var ce *CloseError
+			require.ErrorAs(t, err, &ce)
+			assert.Equal(t, tt.code, ce.Code)
+		})
+	}
+}
+
+func TestUpgradeCompression(t *testing.T) {
+	const raw = "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	opts := Options{Compression: &Compression{ClientNoContextTakeover: true}}
+
+	// Test: An offer is answered in the handshake
+	cc, br, head, res := handshake(t, raw+"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n", opts)
+	require.NoError(t, res.err)
+	_, fields := parseHead(head)
+	assert.Equal(t, "permessage-deflate; client_no_context_takeover", fields["sec-websocket-extensions"])
+	client := newConn(cc, br, false, 0)
+	require.NoError(t, client.enableDeflate(deflateParams{clientNoContextTakeover: true}, 0))
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("squeeze me")))
+	_, got, err := res.conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "squeeze me", string(got))
+
+	// Test: Without an offer, or without Compression, messages are sent as is
+	_, _, head, res = handshake(t, raw+"\r\n", opts)
+	require.NoError(t, res.err)
+	assert.NotContains(t, head, "sec-websocket-extensions")
+	assert.Nil(t, res.conn.fw)
+	_, _, head, res = handshake(t, raw+"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n", Options{})
+	require.NoError(t, res.err)
+	assert.NotContains(t, head, "sec-websocket-extensions")
+
+	// Test: An invalid level is the handler's error, not the client's
+	cc, sc := pipe(t)
+	_, err = cc.Write([]byte(raw + "\r\n"))
+	require.NoError(t, err)
+	sbr := bufio.NewReader(sc)
+	r, err := request.RequestFromReader(sbr)
+	require.NoError(t, err)
+	_, err = Upgrade(hijackWriter{response.NewWriter(sc), sc, sbr}, r, Options{Compression: &Compression{Level: 42}})
+	assert.ErrorContains(t, err, "compression level")
+}
+
+// nodeClient is run by TestNodeInterop: it sends the messages it is given
+// to an echo server, checks the echoes and reports the extensions agreed.
+const nodeClient = `
+const [url, text] = process.argv.slice(2);
+const ws = new WebSocket(url);
+ws.binaryType = 'arraybuffer';
+const binary = new Uint8Array(100000).map((_, i) => i % 7);
+const expected = [text, binary, text];
+ws.onopen = () => expected.forEach((m) => ws.send(m));
+ws.onmessage = (e) => {
+  const want = expected.shift();
+  const ok = typeof want === 'string'
+    ? e.data === want
+    : Buffer.from(e.data).equals(Buffer.from(want));
+  if (!ok) { console.log(JSON.stringify({ error: 'echo mismatch' })); process.exit(1); }
+  if (expected.length === 0) ws.close(1000);
+};
+ws.onclose = (e) => console.log(JSON.stringify({ extensions: ws.extensions, code: e.code, clean: e.wasClean }));
+ws.onerror = (e) => { console.log(JSON.stringify({ error: String(e.message) })); process.exit(1); };
+`
+
+func TestNodeInterop(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	// WebSocket is global from Node 22, and behind a flag before
+	args := []string{"--experimental-websocket"}
+	if out, err := exec.Command(node, append(args, "-e", "new WebSocket('ws://0.0.0.0:1').onerror = () => {}")...).CombinedOutput(); err != nil {
+		args = nil
+		if out, err = exec.Command(node, "-e", "new WebSocket('ws://0.0.0.0:1').onerror = () => {}").CombinedOutput(); err != nil {
+			t.Skipf("node has no WebSocket client: %s", out)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	type result struct {
+		sent int64 // bytes written to the client
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		counted := &countingConn{Conn: conn}
+		br := bufio.NewReader(counted)
+		r, err := request.RequestFromReader(br)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		ws, err := Upgrade(hijackWriter{response.NewWriter(counted), counted, br}, r, Options{Compression: &Compression{}})
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		for {
+			typ, msg, err := ws.ReadMessage()
+			if err != nil {
+				results <- result{sent: counted.written.Load(), err: err}
+				return
+			}
+			if err := ws.WriteMessage(typ, msg); err != nil {
+				results <- result{err: err}
+				return
+			}
+		}
+	}()
+
+	script := filepath.Join(t.TempDir(), "client.js")
+	require.NoError(t, os.WriteFile(script, []byte(nodeClient), 0o600))
+	text := string(dashboard(t))
+	cmd := exec.Command(node, append(args, script, "ws://"+listener.Addr().String()+"/", text)...)
+	out, err := cmd.Output()
+	require.NoError(t, err, "%s", out)
+
+	var report struct {
+		Extensions string `json:"extensions"`
+		Code       int    `json:"code"`
+		Clean      bool   `json:"clean"`
+		Error      string `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(out, &report), "%s", out)
+	require.Empty(t, report.Error)
+	assert.Equal(t, "permessage-deflate", report.Extensions)
+	assert.Equal(t, 1000, report.Code)
+	assert.True(t, report.Clean)
+
+	res := <-results
+	var ce *CloseError
+	require.ErrorAs(t, res.err, &ce)
+	assert.Equal(t, CloseNormalClosure, ce.Code)
+	// the echoes were compressed. Node only decompresses, so what it sent
+	// was not.
+	assert.Less(t, res.sent, int64(2*len(text)+100000)/2)
+}
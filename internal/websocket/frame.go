@@ -0,0 +1,125 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Opcodes (RFC 6455, section 5.2). Text and binary are exported as
+// MessageType.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	// maxControlPayload is the largest payload a control frame may carry.
+	maxControlPayload = 125
+)
+
+type frameHeader struct {
+	fin    bool
+	rsv    byte // the three RSV bits, in place
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// readFrameHeader reads the header of the next frame from br.
+func readFrameHeader(br *bufio.Reader) (frameHeader, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return frameHeader{}, err
+	}
+	h := frameHeader{
+		fin:    b[0]&finBit != 0,
+		rsv:    b[0] & rsvBits,
+		opcode: b[0] & 0xf,
+		masked: b[1]&maskBit != 0,
+		length: int64(b[1] & 0x7f),
+	}
+	switch h.length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return frameHeader{}, unexpectedEOF(err)
+		}
+		h.length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return frameHeader{}, unexpectedEOF(err)
+		}
+		// the most significant bit must be 0, which keeps length positive
+		h.length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if h.masked {
+		if _, err := io.ReadFull(br, h.mask[:]); err != nil {
+			return frameHeader{}, unexpectedEOF(err)
+		}
+	}
+	return h, nil
+}
+
+// appendFrame appends a frame carrying payload to dst, masking it with
+// mask if masked is set.
+func appendFrame(dst []byte, h frameHeader, payload []byte) []byte {
+	b0 := h.rsv | h.opcode
+	if h.fin {
+		b0 |= finBit
+	}
+	var b1 byte
+	if h.masked {
+		b1 = maskBit
+	}
+	n := len(payload)
+	switch {
+	case n <= 125:
+		dst = append(dst, b0, b1|byte(n))
+	case n <= 0xffff:
+		dst = append(dst, b0, b1|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	default:
+		dst = append(dst, b0, b1|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(n))
+	}
+	if !h.masked {
+		return append(dst, payload...)
+	}
+	dst = append(dst, h.mask[:]...)
+	start := len(dst)
+	dst = append(dst, payload...)
+	maskBytes(h.mask, 0, dst[start:])
+	return dst
+}
+
+// maskBytes XORs b with key, starting pos bytes into the key stream, and
+// returns the position after b. Masking twice unmasks.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[(pos+i)&3]
+	}
+	return (pos + len(b)) & 3
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
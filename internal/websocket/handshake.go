@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"httpfromtcp.haonguyen.tech/internal/headers"
+	"httpfromtcp.haonguyen.tech/internal/problem"
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+	"httpfromtcp.haonguyen.tech/internal/server"
+)
+
+// acceptGUID is appended to the client's key to derive Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Options configure Upgrade.
+type Options struct {
+	// Subprotocols the server speaks, most preferred first. The first one
+	// the client also offers is agreed on; if there is none, the handshake
+	// goes ahead without a subprotocol.
+	Subprotocols []string
+	// CheckOrigin decides whether to accept a request from a browser page.
+	// If nil, requests with an Origin header are only accepted when its
+	// host matches the Host header, which stops other sites' pages from
+	// connecting with the user's cookies.
+	CheckOrigin func(r *request.Request) bool
+	// MaxMessageSize bounds received messages, DefaultMaxMessageSize if
+	// zero. Larger messages close the connection with 1009.
+	MaxMessageSize int64
+	// Compression enables permessage-deflate with clients that offer it. If
+	// nil, messages are sent uncompressed.
+	Compression *Compression
+}
+
+// Upgrade checks that r is a WebSocket opening handshake, answers it with
+// 101 Switching Protocols and returns the connection, which the caller must
+// close. The handler must not have written anything to w. If the handshake
+// is invalid Upgrade writes the error response itself and returns the
+// problem.
+func Upgrade(w response.ResponseWriter, r *request.Request, opts Options) (*Conn, error) {
+	key, err := checkHandshake(r, opts)
+	if err != nil {
+		if werr := problem.Write(w, r, err); werr != nil {
+			return nil, errors.Join(err, werr)
+		}
+		return nil, err
+	}
+	var deflate deflateParams
+	var extensions string
+	compress := false
+	if opts.Compression != nil {
+		if l := opts.Compression.Level; l < flate.HuffmanOnly || l > flate.BestCompression {
+			return nil, fmt.Errorf("websocket: invalid compression level %d", l)
+		}
+		deflate, extensions, compress = negotiateDeflate(r, opts.Compression)
+	}
+
+	h := headers.Headers{"sec-websocket-accept": acceptKey(key)}
+	protocol := selectSubprotocol(r, opts.Subprotocols)
+	if protocol != "" {
+		h["sec-websocket-protocol"] = protocol
+	}
+	if compress {
+		h["sec-websocket-extensions"] = extensions
+	}
+	conn, rw, err := server.Upgrade(w, r, "websocket", h)
+	if err != nil {
+		return nil, fmt.Errorf("websocket: taking over the connection: %w", err)
+	}
+
+	c := newConn(conn, rw.Reader, true, opts.MaxMessageSize)
+	c.subprotocol = protocol
+	if compress {
+		if err := c.enableDeflate(deflate, opts.Compression.Level); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkHandshake validates the opening handshake (RFC 6455, section 4.2.1)
+// and returns the client's key.
+func checkHandshake(r *request.Request, opts Options) (string, error) {
+	if r.RequestLine.Method != "GET" {
+		p := problem.New(response.StatusMethodNotAllowed, "A WebSocket handshake must be a GET request.")
+		p.Headers = headers.Headers{"allow": "GET"}
+		return "", p
+	}
+	if r.RequestLine.HttpVersion != "1.1" {
+		return "", problem.New(response.StatusBadRequest, "WebSocket requires HTTP/1.1.")
+	}
+	if !server.IsUpgrade(r, "websocket") {
+		p := problem.New(response.StatusUpgradeRequired, "This endpoint only speaks WebSocket.")
+		p.Headers = headers.Headers{"upgrade": "websocket", "connection": "Upgrade"}
+		return "", p
+	}
+	if v, _ := r.Headers.Get("Sec-WebSocket-Version"); v != "13" {
+		p := problem.New(response.StatusUpgradeRequired, "Unsupported WebSocket version.")
+		p.Headers = headers.Headers{"sec-websocket-version": "13"}
+		return "", p
+	}
+	key, _ := r.Headers.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", problem.New(response.StatusBadRequest, "Invalid Sec-WebSocket-Key.")
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return "", problem.New(response.StatusForbidden, "Cross-origin WebSocket requests are not allowed.")
+	}
+	return key, nil
+}
+
+// sameOrigin accepts requests without an Origin header, and those whose
+// origin's host is the Host header.
+func sameOrigin(r *request.Request) bool {
+	origin, ok := r.Headers.Get("Origin")
+	if !ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := r.Headers.Get("Host")
+	return strings.EqualFold(u.Host, host)
+}
+
+// selectSubprotocol returns the first of supported that the client offers.
+func selectSubprotocol(r *request.Request, supported []string) string {
+	offered := tokens(r.Headers, "Sec-WebSocket-Protocol")
+	for _, p := range supported {
+		for _, o := range offered {
+			if o == p {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tokens splits the comma-separated header key.
+func tokens(h headers.Headers, key string) []string {
+	v, ok := h.Get(key)
+	if !ok {
+		return nil
+	}
+	var list []string
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			list = append(list, t)
+		}
+	}
+	return list
+}
@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp.haonguyen.tech/internal/request"
+	"httpfromtcp.haonguyen.tech/internal/response"
+)
+
+// hijackWriter is a response writer over a connection that can be taken
+// over, like the server's.
+type hijackWriter struct {
+	*response.Writer
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(w.br, bufio.NewWriter(w.conn)), nil
+}
+
+type handshakeResult struct {
+	conn *Conn
+	err  error
+}
+
+// handshake sends raw as the opening handshake and runs Upgrade on the
+// other end. It returns the client's reader, positioned after the response
+// head, and the response head.
+func handshake(t *testing.T, raw string, opts Options) (net.Conn, *bufio.Reader, string, handshakeResult) {
+	t.Helper()
+	cc, sc := pipe(t)
+	results := make(chan handshakeResult, 1)
+	go func() {
+		br := bufio.NewReader(sc)
+		r, err := request.RequestFromReader(br)
+		if err != nil {
+			results <- handshakeResult{err: err}
+			return
+		}
+		w := hijackWriter{response.NewWriter(sc), sc, br}
+		conn, err := Upgrade(w, r, opts)
+		if err != nil {
+			_ = w.Flush()
+		}
+		results <- handshakeResult{conn, err}
+	}()
+	_, err := io.WriteString(cc, raw)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(cc)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	return cc, br, head.String(), <-results
+}
+
+// parseHead splits a response head into its status line and fields.
+func parseHead(head string) (string, map[string]string) {
+	lines := strings.Split(strings.TrimSuffix(head, "\r\n\r\n"), "\r\n")
+	fields := map[string]string{}
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, ": ")
+		fields[k] = v
+	}
+	return lines[0], fields
+}
+
+func TestUpgrade(t *testing.T) {
+	// Test: The example handshake from RFC 6455, section 1.3
+	cc, br, head, res := handshake(t, "GET /chat HTTP/1.1\r\n"+
+		"Host: server.example.com\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Origin: http://server.example.com\r\n"+
+		"Sec-WebSocket-Protocol: chat, superchat\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n",
+		Options{Subprotocols: []string{"superchat", "chat"}})
+	require.NoError(t, res.err)
+	status, fields := parseHead(head)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", status)
+	assert.Equal(t, map[string]string{
+		"upgrade":              "websocket",
+		"connection":           "Upgrade",
+		"sec-websocket-accept": "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+		// the server's preference wins
+		"sec-websocket-protocol": "superchat",
+	}, fields)
+	assert.Equal(t, "superchat", res.conn.Subprotocol())
+
+	// Test: The connection then carries messages
+	client := newConn(cc, br, false, 0)
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("hello")))
+	typ, got, err := res.conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "hello", string(got))
+	require.NoError(t, res.conn.WriteMessage(BinaryMessage, []byte("world")))
+	_, got, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(got))
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	const valid = "Host: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	tests := []struct {
+		name   string
+		raw    string
+		opts   Options
+		status string
+		header string
+	}{
+		{"not GET", "POST / HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 13\r\nContent-Length: 0\r\n\r\n", Options{}, "405", "allow: GET"},
+		{"not an upgrade", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", Options{}, "426", "upgrade: websocket"},
+		{"old version", "GET / HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 8\r\n\r\n", Options{}, "426", "sec-websocket-version: 13"},
+		{"short key", "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: c2hvcnQ=\r\nSec-WebSocket-Version: 13\r\n\r\n", Options{}, "400", ""},
+		{"cross origin", "GET / HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 13\r\nOrigin: https://evil.example\r\n\r\n", Options{}, "403", ""},
+		{"origin refused", "GET / HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 13\r\n\r\n", Options{CheckOrigin: func(*request.Request) bool { return false }}, "403", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, head, res := handshake(t, tt.raw, tt.opts)
+			assert.Error(t, res.err)
+			assert.Nil(t, res.conn)
+			assert.True(t, strings.HasPrefix(head, "HTTP/1.1 "+tt.status+" "), head)
+			assert.Contains(t, head, tt.header)
+		})
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
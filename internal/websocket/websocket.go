@@ -0,0 +1,494 @@
+// Package websocket serves WebSocket (RFC 6455) connections: the opening
+// handshake, framing with masking and fragmentation, ping/pong, and the
+// closing handshake, and the permessage-deflate extension (RFC 7692). A
+// handler calls Upgrade to turn its request into a Conn.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the kind of a data message.
+type MessageType int
+
+const (
+	TextMessage   MessageType = opText
+	BinaryMessage MessageType = opBinary
+)
+
+// CloseCode is the status code of a close frame (RFC 6455, section 7.4).
+type CloseCode uint16
+
+const (
+	CloseNormalClosure    CloseCode = 1000
+	CloseGoingAway        CloseCode = 1001
+	CloseProtocolError    CloseCode = 1002
+	CloseUnsupportedData  CloseCode = 1003
+	CloseNoStatusReceived CloseCode = 1005 // never sent: the close frame had no code
+	CloseInvalidPayload   CloseCode = 1007
+	ClosePolicyViolation  CloseCode = 1008
+	CloseMessageTooBig    CloseCode = 1009
+	CloseMandatoryExt     CloseCode = 1010
+	CloseInternalError    CloseCode = 1011
+	CloseServiceRestart   CloseCode = 1012
+	CloseTryAgainLater    CloseCode = 1013
+)
+
+// validCloseCode reports whether code may appear in a close frame.
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+	// registered with IANA, or private
+	return code >= 3000 && code <= 4999
+}
+
+// CloseError is the close frame that ended a connection: either the peer's,
+// or the one sent because the peer broke the protocol or a limit.
+type CloseError struct {
+	Code CloseCode
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket: close %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: close %d: %s", e.Code, e.Text)
+}
+
+// ErrCloseSent is returned when writing after the close frame was sent.
+var ErrCloseSent = errors.New("websocket: close frame already sent")
+
+const (
+	// DefaultMaxMessageSize bounds received messages unless Options say
+	// otherwise.
+	DefaultMaxMessageSize = 1 << 20
+	// closeTimeout bounds the wait for the peer's close frame, and writes of
+	// close frames.
+	closeTimeout = 5 * time.Second
+)
+
+// Conn is an open WebSocket connection. One goroutine may read while
+// others write: writes of whole messages and of control frames are
+// serialized.
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+
+	subprotocol    string
+	maxMessageSize int64
+
+	readMu      sync.Mutex // held by ReadMessage
+	readErr     error
+	pongHandler func(data []byte)
+
+	msgMu     sync.Mutex // held while a data message is written
+	wmu       sync.Mutex // held while a frame is written
+	closeSent bool
+
+	// permessage-deflate state, nil unless negotiated. fw is used under
+	// msgMu and fr under readMu.
+	fw *flateWriter
+	fr *flateReader
+}
+
+// newConn wraps a connection whose opening handshake is done. br holds
+// anything already read past the handshake. Servers expect masked frames
+// and send unmasked ones; clients the other way round.
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool, maxMessageSize int64) *Conn {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	return &Conn{conn: conn, br: br, isServer: isServer, maxMessageSize: maxMessageSize}
+}
+
+// Subprotocol returns the subprotocol agreed in the handshake, or "".
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline bounds the wait for the next message, control frames
+// included. A zero time waits forever.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline bounds writes of frames.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets a function called from ReadMessage with the payload of
+// every pong received. Pings are answered with pongs automatically.
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pongHandler = h
+}
+
+// ReadMessage returns the next data message, reassembled from its
+// fragments, answering pings and handling close frames on the way. When the
+// peer closes, or the connection fails, it returns a *CloseError or the
+// network error, and so does every later call.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, msg, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+	}
+	return typ, msg, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var typ MessageType
+	var msg []byte
+	compressed := false
+	checked := 0 // bytes of msg known to be valid UTF-8
+	for {
+		h, err := readFrameHeader(c.br)
+		if err != nil {
+			return 0, nil, c.abort(err)
+		}
+		if err := c.checkFrame(h, typ != 0); err != nil {
+			return 0, nil, c.fail(err)
+		}
+		if !isControl(h.opcode) && int64(len(msg))+h.length > c.maxMessageSize {
+			return 0, nil, c.fail(&CloseError{Code: CloseMessageTooBig, Text: fmt.Sprintf("message exceeds %d bytes", c.maxMessageSize)})
+		}
+		payload := make([]byte, h.length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return 0, nil, c.abort(unexpectedEOF(err))
+		}
+		if h.masked {
+			maskBytes(h.mask, 0, payload)
+		}
+
+		switch h.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, c.abort(err)
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(payload)
+		case opContinuation:
+			msg = append(msg, payload...)
+		default:
+			typ, msg = MessageType(h.opcode), payload
+			compressed = h.rsv&rsv1Bit != 0
+		}
+
+		if typ == TextMessage && !compressed {
+			// check as fragments arrive, so bad text fails early
+			n, ok := checkUTF8(msg[checked:], h.fin)
+			if !ok {
+				return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Text: "invalid UTF-8 in text message"})
+			}
+			checked += n
+		}
+		if !h.fin {
+			continue
+		}
+		if compressed {
+			if msg, err = c.decompress(typ, msg); err != nil {
+				return 0, nil, err
+			}
+		}
+		return typ, msg, nil
+	}
+}
+
+// decompress inflates a compressed message and checks it like an
+// uncompressed one.
+func (c *Conn) decompress(typ MessageType, msg []byte) ([]byte, error) {
+	msg, err := c.fr.decompress(msg, c.maxMessageSize)
+	if errors.Is(err, errTooBig) {
+		return nil, c.fail(&CloseError{Code: CloseMessageTooBig, Text: fmt.Sprintf("message exceeds %d bytes", c.maxMessageSize)})
+	}
+	if err != nil {
+		return nil, c.fail(&CloseError{Code: CloseInvalidPayload, Text: "invalid compressed data"})
+	}
+	if typ == TextMessage && !utf8.Valid(msg) {
+		return nil, c.fail(&CloseError{Code: CloseInvalidPayload, Text: "invalid UTF-8 in text message"})
+	}
+	return msg, nil
+}
+
+// checkFrame applies the framing rules to a frame header. inMessage is set
+// while a fragmented message is being received.
+func (c *Conn) checkFrame(h frameHeader, inMessage bool) *CloseError {
+	protocolError := func(text string) *CloseError {
+		return &CloseError{Code: CloseProtocolError, Text: text}
+	}
+	// RSV1 marks the first frame of a compressed message
+	compressed := h.rsv == rsv1Bit && c.fr != nil && (h.opcode == opText || h.opcode == opBinary)
+	switch {
+	case h.rsv != 0 && !compressed:
+		return protocolError("reserved bits set")
+	case c.isServer && !h.masked:
+		return protocolError("unmasked frame from client")
+	case !c.isServer && h.masked:
+		return protocolError("masked frame from server")
+	}
+	switch h.opcode {
+	case opPing, opPong, opClose:
+		if !h.fin {
+			return protocolError("fragmented control frame")
+		}
+		if h.length > maxControlPayload {
+			return protocolError("control frame too long")
+		}
+	case opContinuation:
+		if !inMessage {
+			return protocolError("continuation frame outside a message")
+		}
+	case opText, opBinary:
+		if inMessage {
+			return protocolError("data frame inside a fragmented message")
+		}
+	default:
+		return protocolError(fmt.Sprintf("unknown opcode %d", h.opcode))
+	}
+	return nil
+}
+
+// handleClose answers the peer's close frame and closes the connection.
+func (c *Conn) handleClose(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return c.fail(&CloseError{Code: CloseProtocolError, Text: "close frame of 1 byte"})
+	case len(payload) >= 2:
+		ce.Code = CloseCode(binary.BigEndian.Uint16(payload))
+		ce.Text = string(payload[2:])
+		if !validCloseCode(ce.Code) {
+			return c.fail(&CloseError{Code: CloseProtocolError, Text: fmt.Sprintf("invalid close code %d", ce.Code)})
+		}
+		if !utf8.ValidString(ce.Text) {
+			return c.fail(&CloseError{Code: CloseInvalidPayload, Text: "invalid UTF-8 in close reason"})
+		}
+	}
+	// echo the code, unless our close frame is already out
+	var reply []byte
+	if ce.Code != CloseNoStatusReceived {
+		reply = closePayload(ce.Code, "")
+	}
+	c.setCloseWriteDeadline()
+	if err := c.writeFrame(opClose, reply); err != nil && !errors.Is(err, ErrCloseSent) {
+		_ = c.conn.Close()
+		return err
+	}
+	_ = c.conn.Close()
+	return ce
+}
+
+// fail closes the connection with the close frame ce describes.
+func (c *Conn) fail(ce *CloseError) error {
+	c.setCloseWriteDeadline()
+	_ = c.writeFrame(opClose, closePayload(ce.Code, ce.Text))
+	_ = c.conn.Close()
+	return ce
+}
+
+// abort closes the connection without a closing handshake.
+func (c *Conn) abort(err error) error {
+	_ = c.conn.Close()
+	return err
+}
+
+func (c *Conn) setCloseWriteDeadline() {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+}
+
+func closePayload(code CloseCode, reason string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	// the reason must fit a control frame
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	return append(b, reason...)
+}
+
+// checkUTF8 reports whether b is valid UTF-8. Unless final is set, b may
+// end in the middle of a rune that the next fragment completes. It also
+// returns how many bytes of b hold complete runes.
+func checkUTF8(b []byte, final bool) (int, bool) {
+	end := len(b)
+	if !final {
+		for i := len(b) - 1; i >= 0 && i > len(b)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(b[i]) {
+				if !utf8.FullRune(b[i:]) {
+					end = i
+				}
+				break
+			}
+		}
+	}
+	return end, utf8.Valid(b[:end])
+}
+
+// WriteMessage sends data as a single-frame message. Text must be valid
+// UTF-8.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	if typ == TextMessage && !utf8.Valid(data) {
+		return errors.New("websocket: invalid UTF-8 in text message")
+	}
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	if c.fw == nil {
+		return c.writeFrame(byte(typ), data)
+	}
+	compressed, err := c.fw.write(data)
+	if err != nil {
+		return err
+	}
+	defer c.fw.finish()
+	return c.writeFragment(byte(typ), rsv1Bit, true, compressed)
+}
+
+// NextWriter starts a fragmented message: every Write sends a fragment and
+// Close ends the message. Other messages wait until then; control frames
+// may still go out between the fragments. Text is not checked for UTF-8.
+func (c *Conn) NextWriter(typ MessageType) (io.WriteCloser, error) {
+	if typ != TextMessage && typ != BinaryMessage {
+		return nil, fmt.Errorf("websocket: invalid message type %d", typ)
+	}
+	c.msgMu.Lock()
+	return &messageWriter{c: c, opcode: byte(typ)}, nil
+}
+
+type messageWriter struct {
+	c      *Conn
+	opcode byte
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("websocket: write to closed message writer")
+	}
+	payload, rsv := p, byte(0)
+	if w.c.fw != nil {
+		var err error
+		if payload, err = w.c.fw.write(p); err != nil {
+			return 0, err
+		}
+		if w.opcode != opContinuation {
+			rsv = rsv1Bit
+		}
+	}
+	if err := w.c.writeFragment(w.opcode, rsv, false, payload); err != nil {
+		return 0, err
+	}
+	w.opcode = opContinuation
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.msgMu.Unlock()
+	if w.c.fw != nil {
+		defer w.c.fw.finish()
+		if w.opcode != opContinuation {
+			// nothing was written: send an empty compressed message
+			payload, err := w.c.fw.write(nil)
+			if err != nil {
+				return err
+			}
+			return w.c.writeFragment(w.opcode, rsv1Bit, true, payload)
+		}
+	}
+	return w.c.writeFragment(w.opcode, 0, true, nil)
+}
+
+// Ping sends a ping with data, at most 125 bytes. The peer's pong reaches
+// the pong handler.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: ping payload too long")
+	}
+	return c.writeFrame(opPing, data)
+}
+
+// Close runs the closing handshake: it sends a close frame with code and
+// reason, waits a few seconds for the peer's, and closes the connection. If
+// a ReadMessage is in progress, that call receives the peer's close frame
+// and closes the connection instead.
+func (c *Conn) Close(code CloseCode, reason string) error {
+	c.setCloseWriteDeadline()
+	if err := c.writeFrame(opClose, closePayload(code, reason)); err != nil {
+		_ = c.conn.Close()
+		if errors.Is(err, ErrCloseSent) {
+			return nil
+		}
+		return err
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(closeTimeout)); err != nil {
+		_ = c.conn.Close()
+		return err
+	}
+	if !c.readMu.TryLock() {
+		return nil
+	}
+	defer c.readMu.Unlock()
+	for c.readErr == nil {
+		_, _, c.readErr = c.readMessage()
+	}
+	_ = c.conn.Close()
+	return nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	return c.writeFragment(opcode, 0, true, payload)
+}
+
+// writeFragment sends one frame, masking it if this is the client side. rsv
+// holds the RSV bits to set.
+func (c *Conn) writeFragment(opcode, rsv byte, fin bool, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	h := frameHeader{fin: fin, rsv: rsv, opcode: opcode, masked: !c.isServer}
+	if h.masked {
+		if _, err := rand.Read(h.mask[:]); err != nil {
+			return err
+		}
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	_, err := c.conn.Write(appendFrame(nil, h, payload))
+	return err
+}
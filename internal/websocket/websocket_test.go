@@ -0,0 +1,216 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipe returns the two ends of a loopback TCP connection. Unlike net.Pipe,
+// writes do not wait for the other end to read.
+func pipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	server = <-accepted
+	require.NotNil(t, server)
+	for _, c := range []net.Conn{client, server} {
+		require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+		t.Cleanup(func() { _ = c.Close() })
+	}
+	return client, server
+}
+
+// connPair returns the client and server Conns of a connection.
+func connPair(t *testing.T, maxMessageSize int64) (client, server *Conn) {
+	t.Helper()
+	cc, sc := pipe(t)
+	return newConn(cc, bufio.NewReader(cc), false, 0), newConn(sc, bufio.NewReader(sc), true, maxMessageSize)
+}
+
+func TestMessages(t *testing.T) {
+	client, server := connPair(t, 0)
+
+	// Test: Messages of every length encoding arrive intact both ways
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		data := bytes.Repeat([]byte("x"), size)
+		require.NoError(t, client.WriteMessage(BinaryMessage, data))
+		typ, got, err := server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, BinaryMessage, typ)
+		assert.Equal(t, data, got)
+	}
+	require.NoError(t, server.WriteMessage(TextMessage, []byte("héllo")))
+	typ, got, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "héllo", string(got))
+
+	// Test: Text must be UTF-8
+	assert.Error(t, server.WriteMessage(TextMessage, []byte{0xff}))
+}
+
+func TestMasking(t *testing.T) {
+	cc, sc := pipe(t)
+	client := newConn(cc, bufio.NewReader(cc), false, 0)
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("secret")))
+
+	// the client's frame is masked on the wire
+	br := bufio.NewReader(sc)
+	h, err := readFrameHeader(br)
+	require.NoError(t, err)
+	assert.True(t, h.masked)
+	payload := make([]byte, h.length)
+	_, err = io.ReadFull(br, payload)
+	require.NoError(t, err)
+	assert.NotEqual(t, "secret", string(payload))
+	maskBytes(h.mask, 0, payload)
+	assert.Equal(t, "secret", string(payload))
+}
+
+func TestFragmentation(t *testing.T) {
+	client, server := connPair(t, 0)
+	pongs := make(chan string, 1)
+	client.SetPongHandler(func(data []byte) { pongs <- string(data) })
+
+	// a ping may come between the fragments of a message
+	w, err := client.NextWriter(TextMessage)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("frag"))
+	require.NoError(t, err)
+	require.NoError(t, client.Ping([]byte("are you there")))
+	// the é is split across fragments
+	_, err = w.Write([]byte("ments caf\xc3"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("\xa9"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	typ, got, err := server.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "fragments café", string(got))
+
+	// the server answered the ping while reading
+	require.NoError(t, server.WriteMessage(BinaryMessage, []byte("after")))
+	_, got, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(got))
+	assert.Equal(t, "are you there", <-pongs)
+}
+
+// frame builds a masked client frame.
+func frame(fin bool, opcode byte, payload []byte) []byte {
+	return appendFrame(nil, frameHeader{fin: fin, opcode: opcode, masked: true, mask: [4]byte{1, 2, 3, 4}}, payload)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		code  CloseCode
+	}{
+		{"unmasked frame", appendFrame(nil, frameHeader{fin: true, opcode: opText}, []byte("hi")), CloseProtocolError},
+		{"reserved bit", appendFrame(nil, frameHeader{fin: true, rsv: rsv1Bit, opcode: opText, masked: true}, []byte("hi")), CloseProtocolError},
+		{"unknown opcode", frame(true, 0x3, nil), CloseProtocolError},
+		{"fragmented ping", frame(false, opPing, nil), CloseProtocolError},
+		{"long ping", frame(true, opPing, make([]byte, 126)), CloseProtocolError},
+		{"continuation outside message", frame(true, opContinuation, []byte("x")), CloseProtocolError},
+		{"data inside message", append(frame(false, opText, []byte("a")), frame(true, opText, []byte("b"))...), CloseProtocolError},
+		{"invalid UTF-8", frame(true, opText, []byte("ok \xff")), CloseInvalidPayload},
+		// fails on the first fragment, without waiting for the rest
+		{"invalid UTF-8 fragment", frame(false, opText, []byte("\xff")), CloseInvalidPayload},
+		{"close of 1 byte", frame(true, opClose, []byte{3}), CloseProtocolError},
+		{"reserved close code", frame(true, opClose, binary.BigEndian.AppendUint16(nil, 1005)), CloseProtocolError},
+		{"invalid close reason", frame(true, opClose, append(binary.BigEndian.AppendUint16(nil, 1000), 0xff)), CloseInvalidPayload},
+		{"message too big", append(frame(false, opBinary, make([]byte, 60)), frame(true, opContinuation, make([]byte, 60))...), CloseMessageTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, sc := pipe(t)
+			server := newConn(sc, bufio.NewReader(sc), true, 100)
+			_, err := cc.Write(tt.input)
+			require.NoError(t, err)
+
+			_, _, err = server.ReadMessage()
+			var ce *CloseError
+			require.ErrorAs(t, err, &ce)
+			assert.Equal(t, tt.code, ce.Code)
+			// later reads fail the same way
+			_, _, err2 := server.ReadMessage()
+			assert.Equal(t, err, err2)
+
+			// the client is told why, then the connection closes
+			client := newConn(cc, bufio.NewReader(cc), false, 0)
+			_, _, err = client.ReadMessage()
+			require.ErrorAs(t, err, &ce)
+			assert.Equal(t, tt.code, ce.Code)
+		})
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	// Test: The server closes while the client reads
+	client, server := connPair(t, 0)
+	done := make(chan error, 1)
+	go func() { done <- server.Close(CloseGoingAway, "restarting") }()
+	_, _, err := client.ReadMessage()
+	var ce *CloseError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Text: "restarting"}, ce)
+	// the client echoed the close, which ends the server's wait
+	require.NoError(t, <-done)
+	assert.ErrorIs(t, server.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+
+	// Test: The client closes while the server reads
+	client, server = connPair(t, 0)
+	go func() { done <- client.Close(CloseNormalClosure, "") }()
+	_, _, err = server.ReadMessage()
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, CloseNormalClosure, ce.Code)
+	require.NoError(t, <-done)
+
+	// Test: A close frame without a code is echoed without one
+	cc, sc := pipe(t)
+	server = newConn(sc, bufio.NewReader(sc), true, 0)
+	_, err = cc.Write(frame(true, opClose, nil))
+	require.NoError(t, err)
+	_, _, err = server.ReadMessage()
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, CloseNoStatusReceived, ce.Code)
+	reply, err := io.ReadAll(cc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{finBit | opClose, 0}, reply)
+}
+
+func TestCloseReasonTruncated(t *testing.T) {
+	p := closePayload(CloseNormalClosure, strings.Repeat("é", 100))
+	assert.LessOrEqual(t, len(p), maxControlPayload)
+	_, ok := checkUTF8(p[2:], true)
+	assert.True(t, ok)
+}
+
+func TestReadAfterPeerGone(t *testing.T) {
+	cc, sc := pipe(t)
+	server := newConn(sc, bufio.NewReader(sc), true, 0)
+	require.NoError(t, cc.Close())
+	_, _, err := server.ReadMessage()
+	assert.True(t, errors.Is(err, io.EOF), "got %v", err)
+}